@@ -0,0 +1,146 @@
+// lenspix-fsck compares the image storage with the database and reports
+// orphaned gallery directories, images whose files are missing, checksum
+// mismatches, files that aren't images and files that no image points at. It
+// uses the same .env file (or environment variables) as the server.
+//
+// Untracked files, like the ones uploaded before images were stored in the
+// database, are repaired by adding them to their gallery like an upload, so
+// the image limits, quotas and virus scanner of the server apply to them too.
+// Files that aren't images or don't fit into the quota are quarantined instead.
+// This has to be done once after upgrading from a version that didn't keep
+// images in the database.
+// Files that were stored less than an hour ago aren't reported, as they might
+// belong to an upload that is still being committed, so it is safe to run
+// while the server is running.
+//
+//	lenspix-fsck --dry-run   only report the problems (the default)
+//	lenspix-fsck --repair    report the problems and fix them
+//
+// It exits with status 1 if problems were found that weren't repaired.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+
+	"github.com/ayushthe1/lenspix/models"
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "only report problems, don't change anything (the default)")
+	repair := flag.Bool("repair", false, "fix the problems that are found")
+	flag.Parse()
+	if *dryRun && *repair {
+		fmt.Fprintln(os.Stderr, "--dry-run and --repair can't be used together")
+		os.Exit(2)
+	}
+
+	unrepaired, err := run(*repair)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if unrepaired > 0 {
+		os.Exit(1)
+	}
+}
+
+// run checks the storage and returns how many problems are left
+func run(repair bool) (int, error) {
+	err := godotenv.Load()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	db, err := models.Open(models.PostgresConfig{
+		Host:     os.Getenv("PSQL_HOST"),
+		Port:     os.Getenv("PSQL_PORT"),
+		User:     os.Getenv("PSQL_USER"),
+		Password: os.Getenv("PSQL_PASSWORD"),
+		Database: os.Getenv("PSQL_DATABASE"),
+		SSLMode:  os.Getenv("PSQL_SSLMODE"),
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	galleryService := &models.GalleryService{
+		DB:        db,
+		ImagesDir: os.Getenv("IMAGES_DIR"),
+	}
+	err = configureUploads(galleryService)
+	if err != nil {
+		return 0, err
+	}
+	problems, err := galleryService.Check()
+	if err != nil {
+		return 0, err
+	}
+
+	unrepaired := 0
+	for _, problem := range problems {
+		if !repair {
+			fmt.Println(problem)
+			unrepaired++
+			continue
+		}
+		err = galleryService.Repair(problem)
+		if err != nil {
+			fmt.Printf("%v (not repaired: %v)\n", problem, err)
+			unrepaired++
+			continue
+		}
+		fmt.Printf("%v (repaired)\n", problem)
+	}
+	fmt.Printf("%d problems found, %d left\n", len(problems), unrepaired)
+	return unrepaired, nil
+}
+
+// configureUploads sets the image limits, quotas and scanner of the server,
+// for the untracked files that are added to their galleries
+func configureUploads(galleryService *models.GalleryService) error {
+	ints := map[string]*int{
+		"IMAGES_MAX_WIDTH":     &galleryService.ImageLimits.MaxWidth,
+		"IMAGES_MAX_HEIGHT":    &galleryService.ImageLimits.MaxHeight,
+		"IMAGES_MAX_FRAMES":    &galleryService.ImageLimits.MaxFrames,
+		"QUOTA_USER_IMAGES":    &galleryService.UserQuota.MaxImages,
+		"QUOTA_GALLERY_IMAGES": &galleryService.GalleryQuota.MaxImages,
+	}
+	for name, value := range ints {
+		if os.Getenv(name) == "" {
+			continue
+		}
+		n, err := strconv.Atoi(os.Getenv(name))
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		*value = n
+	}
+	int64s := map[string]*int64{
+		"IMAGES_MAX_PIXELS":   &galleryService.ImageLimits.MaxPixels,
+		"QUOTA_USER_BYTES":    &galleryService.UserQuota.MaxBytes,
+		"QUOTA_GALLERY_BYTES": &galleryService.GalleryQuota.MaxBytes,
+	}
+	for name, value := range int64s {
+		if os.Getenv(name) == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(os.Getenv(name), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		*value = n
+	}
+	if os.Getenv("CLAMD_ADDRESS") != "" {
+		galleryService.Scanner = models.ClamdScanner{
+			Network: os.Getenv("CLAMD_NETWORK"),
+			Address: os.Getenv("CLAMD_ADDRESS"),
+		}
+	}
+	return nil
+}
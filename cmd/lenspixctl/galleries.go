@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ayushthe1/lenspix/models"
+)
+
+// gallery is how galleries are printed as JSON
+type gallery struct {
+	ID         int               `json:"id"`
+	UserID     int               `json:"user_id"`
+	Title      string            `json:"title"`
+	Slug       string            `json:"slug"`
+	Visibility models.Visibility `json:"visibility"`
+}
+
+func newGallery(g models.Gallery) gallery {
+	return gallery{
+		ID:         g.ID,
+		UserID:     g.UserID,
+		Title:      g.Title,
+		Slug:       g.Slug,
+		Visibility: g.Visibility,
+	}
+}
+
+func printGalleries(w io.Writer, galleries []gallery) {
+	fmt.Fprintln(w, "ID\tUSER\tSLUG\tVISIBILITY\tTITLE")
+	for _, g := range galleries {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\n", g.ID, g.UserID, g.Slug, g.Visibility, g.Title)
+	}
+}
+
+func listGalleries(app *app, args []string) error {
+	flags := app.flags("galleries list")
+	email := flags.String("user", "", "only list the galleries of the user with this email `address`")
+	err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+
+	var found []models.Gallery
+	if *email == "" {
+		found, err = app.galleryService.All()
+	} else {
+		var owner *models.User
+		owner, err = app.userByEmail(*email)
+		if err != nil {
+			return err
+		}
+		found, err = app.galleryService.ByUserID(owner.ID)
+	}
+	if err != nil {
+		return err
+	}
+	galleries := []gallery{}
+	for _, g := range found {
+		galleries = append(galleries, newGallery(g))
+	}
+	return app.print(galleries, func(w io.Writer) { printGalleries(w, galleries) })
+}
+
+// deleteGallery moves a gallery to the trash of its owner, or deletes it for good with --purge
+func deleteGallery(app *app, args []string) error {
+	flags := app.flags("galleries delete")
+	id := flags.Int("id", 0, "`id` of the gallery")
+	purge := flags.Bool("purge", false, "delete the gallery and its images for good instead of moving it to the trash")
+	err := parse(flags, args, "id")
+	if err != nil {
+		return err
+	}
+
+	result := struct {
+		ID     int  `json:"id"`
+		Purged bool `json:"purged"`
+	}{
+		ID:     *id,
+		Purged: *purge,
+	}
+	if *purge {
+		err = app.galleryService.Purge(*id)
+	} else {
+		// galleries that are in the trash already aren't found
+		_, err = app.galleryService.ByID(*id)
+		if err == nil {
+			err = app.galleryService.Delete(*id)
+		}
+	}
+	if errors.Is(err, models.ErrNotFound) {
+		return fmt.Errorf("there is no gallery with the id %d", *id)
+	}
+	if err != nil {
+		return err
+	}
+	return app.print(result, func(w io.Writer) {
+		if *purge {
+			fmt.Fprintf(w, "gallery %d was deleted for good\n", *id)
+		} else {
+			fmt.Fprintf(w, "gallery %d was moved to the trash\n", *id)
+		}
+	})
+}
+
+// moveGallery gives a gallery to another user
+func moveGallery(app *app, args []string) error {
+	flags := app.flags("galleries move")
+	id := flags.Int("id", 0, "`id` of the gallery")
+	email := flags.String("to", "", "email `address` of the user to give the gallery to")
+	err := parse(flags, args, "id", "to")
+	if err != nil {
+		return err
+	}
+
+	owner, err := app.userByEmail(*email)
+	if err != nil {
+		return err
+	}
+	moved, err := app.galleryService.Transfer(*id, owner.ID)
+	if errors.Is(err, models.ErrNotFound) {
+		return fmt.Errorf("there is no gallery with the id %d", *id)
+	}
+	if err != nil {
+		return err
+	}
+	g := newGallery(*moved)
+	return app.print(g, func(w io.Writer) { printGalleries(w, []gallery{g}) })
+}
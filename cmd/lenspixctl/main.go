@@ -0,0 +1,209 @@
+// lenspixctl manages the users and galleries of LensPix from the command
+// line. It uses the same .env file (or environment variables) as the server.
+//
+//	lenspixctl users list [--query text]
+//	lenspixctl users create --email address [--admin]
+//	lenspixctl users reset-password --email address
+//	lenspixctl users promote --email address
+//	lenspixctl users demote --email address
+//	lenspixctl galleries list [--user address]
+//	lenspixctl galleries delete --id id [--purge]
+//	lenspixctl galleries move --id id --to address
+//	lenspixctl tokens purge
+//
+// Passwords are read from the first line of stdin, so that they don't show
+// up in the shell history or the process list. Every command takes --json to
+// print its result as JSON, for scripts.
+//
+// It exits with status 1 if the command failed and 2 if it wasn't used
+// correctly.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ayushthe1/lenspix/models"
+	"github.com/joho/godotenv"
+)
+
+// commands are the subcommands of each group of commands
+var commands = map[string]map[string]func(app *app, args []string) error{
+	"users": {
+		"list":           listUsers,
+		"create":         createUser,
+		"reset-password": resetPassword,
+		"promote":        promoteUser,
+		"demote":         demoteUser,
+	},
+	"galleries": {
+		"list":   listGalleries,
+		"delete": deleteGallery,
+		"move":   moveGallery,
+	},
+	"tokens": {
+		"purge": purgeTokens,
+	},
+}
+
+// errUsage is returned by commands that weren't used correctly, after they printed how to use them
+var errUsage = errors.New("usage")
+
+func main() {
+	if len(os.Args) < 3 || commands[os.Args[1]][os.Args[2]] == nil {
+		fmt.Fprintln(os.Stderr, "usage: lenspixctl users list|create|reset-password|promote|demote [flags]")
+		fmt.Fprintln(os.Stderr, "       lenspixctl galleries list|delete|move [flags]")
+		fmt.Fprintln(os.Stderr, "       lenspixctl tokens purge [flags]")
+		os.Exit(2)
+	}
+
+	app, err := newApp()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer app.close()
+
+	err = commands[os.Args[1]][os.Args[2]](app, os.Args[3:])
+	if errors.Is(err, errUsage) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// app holds the services that the commands use
+type app struct {
+	close func() error
+	// json is set by the --json flag of the command
+	json bool
+	// stdin is where passwords are read from
+	stdin *bufio.Reader
+
+	userService        *models.UserService
+	sessionService     *models.SessionService
+	adminService       *models.AdminService
+	galleryService     *models.GalleryService
+	pwResetService     *models.PasswordResetService
+	emailChangeService *models.EmailChangeService
+	signInLinkService  *models.SignInLinkService
+}
+
+func newApp() (*app, error) {
+	err := godotenv.Load()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	db, err := models.Open(models.PostgresConfig{
+		Host:     os.Getenv("PSQL_HOST"),
+		Port:     os.Getenv("PSQL_PORT"),
+		User:     os.Getenv("PSQL_USER"),
+		Password: os.Getenv("PSQL_PASSWORD"),
+		Database: os.Getenv("PSQL_DATABASE"),
+		SSLMode:  os.Getenv("PSQL_SSLMODE"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sessionService := &models.SessionService{
+		DB: db,
+	}
+	return &app{
+		close: db.Close,
+		stdin: bufio.NewReader(os.Stdin),
+		userService: &models.UserService{
+			DB: db,
+		},
+		sessionService: sessionService,
+		adminService: &models.AdminService{
+			DB:             db,
+			SessionService: sessionService,
+		},
+		galleryService: &models.GalleryService{
+			DB:        db,
+			ImagesDir: os.Getenv("IMAGES_DIR"),
+		},
+		pwResetService: &models.PasswordResetService{
+			DB: db,
+		},
+		emailChangeService: &models.EmailChangeService{
+			DB: db,
+		},
+		signInLinkService: &models.SignInLinkService{
+			DB: db,
+		},
+	}, nil
+}
+
+// flags returns the flag set of a command, with the --json flag that every command has
+func (app *app) flags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet("lenspixctl "+name, flag.ContinueOnError)
+	flags.BoolVar(&app.json, "json", false, "print the result as JSON")
+	return flags
+}
+
+// parse parses the flags of a command and checks that the required ones aren't left at their zero value
+func parse(flags *flag.FlagSet, args []string, required ...string) error {
+	err := flags.Parse(args)
+	if err != nil {
+		return errUsage
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected argument %q\n", flags.Arg(0))
+		flags.Usage()
+		return errUsage
+	}
+	for _, name := range required {
+		if value := flags.Lookup(name).Value.String(); value == "" || value == "0" {
+			fmt.Fprintf(os.Stderr, "--%s is required\n", name)
+			flags.Usage()
+			return errUsage
+		}
+	}
+	return nil
+}
+
+// print prints the result of a command, as JSON with --json and otherwise as text in aligned columns
+func (app *app) print(result interface{}, text func(w io.Writer)) error {
+	if app.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	text(tw)
+	return tw.Flush()
+}
+
+// readPassword reads a password from the first line of stdin
+func (app *app) readPassword() (string, error) {
+	line, err := app.stdin.ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("read password: %w", err)
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", fmt.Errorf("read password: no password on stdin")
+	}
+	return password, nil
+}
+
+// userByEmail looks up a user, with an error that says which one wasn't found
+func (app *app) userByEmail(email string) (*models.User, error) {
+	user, err := app.userService.ByEmail(email)
+	if errors.Is(err, models.ErrNotFound) {
+		return nil, fmt.Errorf("there is no user with the email address %v", email)
+	}
+	return user, err
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// purgeTokens deletes the password resets, email changes and sign in links that have expired
+func purgeTokens(app *app, args []string) error {
+	flags := app.flags("tokens purge")
+	err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+
+	var result struct {
+		PasswordResets int `json:"password_resets"`
+		EmailChanges   int `json:"email_changes"`
+		SignInLinks    int `json:"sign_in_links"`
+	}
+	result.PasswordResets, err = app.pwResetService.DeleteExpired()
+	if err != nil {
+		return err
+	}
+	result.EmailChanges, err = app.emailChangeService.DeleteExpired()
+	if err != nil {
+		return err
+	}
+	result.SignInLinks, err = app.signInLinkService.DeleteExpired()
+	if err != nil {
+		return err
+	}
+	return app.print(result, func(w io.Writer) {
+		fmt.Fprintf(w, "password resets\t%d\n", result.PasswordResets)
+		fmt.Fprintf(w, "email changes\t%d\n", result.EmailChanges)
+		fmt.Fprintf(w, "sign in links\t%d\n", result.SignInLinks)
+	})
+}
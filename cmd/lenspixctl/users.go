@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/ayushthe1/lenspix/models"
+)
+
+// user is how users are printed as JSON
+type user struct {
+	ID          int        `json:"id"`
+	Email       string     `json:"email"`
+	Username    string     `json:"username,omitempty"`
+	Admin       bool       `json:"admin"`
+	SuspendedAt *time.Time `json:"suspended_at,omitempty"`
+	DeleteAt    *time.Time `json:"delete_at,omitempty"`
+}
+
+func printUser(w io.Writer, u user) {
+	fmt.Fprintf(w, "id\t%d\n", u.ID)
+	fmt.Fprintf(w, "email\t%s\n", u.Email)
+	fmt.Fprintf(w, "admin\t%t\n", u.Admin)
+}
+
+func listUsers(app *app, args []string) error {
+	flags := app.flags("users list")
+	query := flags.String("query", "", "only list users whose email address or username contains `text`")
+	err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+
+	accounts, err := app.adminService.Accounts(*query)
+	if err != nil {
+		return err
+	}
+	if len(accounts) == models.MaxAccounts {
+		fmt.Fprintf(os.Stderr, "only the first %d users are listed, use --query to find the others\n", models.MaxAccounts)
+	}
+	users := []user{}
+	for _, account := range accounts {
+		users = append(users, user{
+			ID:          account.ID,
+			Email:       account.Email,
+			Username:    account.Username,
+			Admin:       account.IsAdmin,
+			SuspendedAt: account.SuspendedAt,
+			DeleteAt:    account.DeleteAt,
+		})
+	}
+	return app.print(users, func(w io.Writer) {
+		fmt.Fprintln(w, "ID\tEMAIL\tUSERNAME\tADMIN\tSUSPENDED")
+		for _, u := range users {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%t\t%t\n", u.ID, u.Email, u.Username, u.Admin, u.SuspendedAt != nil)
+		}
+	})
+}
+
+func createUser(app *app, args []string) error {
+	flags := app.flags("users create")
+	email := flags.String("email", "", "email `address` of the new user")
+	admin := flags.Bool("admin", false, "make the new user an admin")
+	err := parse(flags, args, "email")
+	if err != nil {
+		return err
+	}
+
+	password, err := app.readPassword()
+	if err != nil {
+		return err
+	}
+	created, err := app.userService.Create(*email, password)
+	if err != nil {
+		if errors.Is(err, models.ErrEmailTaken) {
+			return fmt.Errorf("there already is a user with the email address %v", *email)
+		}
+		return err
+	}
+	if *admin {
+		err = app.userService.SetAdmin(created.ID, true)
+		if err != nil {
+			return err
+		}
+	}
+	u := user{ID: created.ID, Email: created.Email, Admin: *admin}
+	return app.print(u, func(w io.Writer) { printUser(w, u) })
+}
+
+// resetPassword sets a new password for the user and signs them out everywhere
+func resetPassword(app *app, args []string) error {
+	flags := app.flags("users reset-password")
+	email := flags.String("email", "", "email `address` of the user")
+	err := parse(flags, args, "email")
+	if err != nil {
+		return err
+	}
+
+	found, err := app.userByEmail(*email)
+	if err != nil {
+		return err
+	}
+	password, err := app.readPassword()
+	if err != nil {
+		return err
+	}
+	err = app.userService.UpdatePassword(found.ID, password)
+	if err != nil {
+		return err
+	}
+	// no session has an empty token, so all of them are deleted
+	err = app.sessionService.DeleteOthers(found.ID, "")
+	if err != nil {
+		return err
+	}
+	u := user{ID: found.ID, Email: found.Email, Admin: found.IsAdmin}
+	return app.print(u, func(w io.Writer) { printUser(w, u) })
+}
+
+func promoteUser(app *app, args []string) error {
+	return setAdmin(app, "users promote", args, true)
+}
+
+func demoteUser(app *app, args []string) error {
+	return setAdmin(app, "users demote", args, false)
+}
+
+func setAdmin(app *app, name string, args []string, isAdmin bool) error {
+	flags := app.flags(name)
+	email := flags.String("email", "", "email `address` of the user")
+	err := parse(flags, args, "email")
+	if err != nil {
+		return err
+	}
+
+	found, err := app.userByEmail(*email)
+	if err != nil {
+		return err
+	}
+	err = app.userService.SetAdmin(found.ID, isAdmin)
+	if err != nil {
+		return err
+	}
+	u := user{ID: found.ID, Email: found.Email, Admin: isAdmin}
+	return app.print(u, func(w io.Writer) { printUser(w, u) })
+}
@@ -3,13 +3,17 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ayushthe1/lenspix/controllers"
 	"github.com/ayushthe1/lenspix/migrations"
 	"github.com/ayushthe1/lenspix/models"
+	"github.com/ayushthe1/lenspix/oidc"
 	"github.com/ayushthe1/lenspix/templates"
 	"github.com/ayushthe1/lenspix/views"
 	"github.com/go-chi/chi/v5"
@@ -27,6 +31,31 @@ type config struct {
 	Server struct {
 		Address string
 	}
+	Images struct {
+		Dir string
+		// Cache-Control header for images, by gallery visibility
+		CacheControl map[models.Visibility]string
+		Limits       models.ImageLimits
+	}
+	Clamd struct {
+		Network string
+		Address string
+	}
+	// Quotas limit how much users can upload
+	Quotas struct {
+		User    models.Quota
+		Gallery models.Quota
+	}
+	Trash struct {
+		// how long deleted galleries and images can be restored
+		Retention time.Duration
+	}
+	// how long accounts are kept after their users asked for them to be deleted
+	DeletionGracePeriod time.Duration
+	// who can sign up
+	Registration models.RegistrationMode
+	// OpenID Connect providers that users can sign in with
+	OIDCProviders []*oidc.Provider
 }
 
 func loadEnvConfig() (config, error) {
@@ -63,9 +92,127 @@ func loadEnvConfig() (config, error) {
 
 	cfg.Server.Address = os.Getenv("SERVER_ADDRESS")
 
+	cfg.Images.Dir = os.Getenv("IMAGES_DIR")
+	cfg.Images.CacheControl = make(map[models.Visibility]string)
+	for _, visibility := range models.Visibilities {
+		// eg IMAGES_CACHE_CONTROL_PUBLIC
+		cc := os.Getenv("IMAGES_CACHE_CONTROL_" + strings.ToUpper(string(visibility)))
+		if cc != "" {
+			cfg.Images.CacheControl[visibility] = cc
+		}
+	}
+
+	// image limits are optional, any that aren't set use models.DefaultImageLimits
+	limits := map[string]*int{
+		"IMAGES_MAX_WIDTH":  &cfg.Images.Limits.MaxWidth,
+		"IMAGES_MAX_HEIGHT": &cfg.Images.Limits.MaxHeight,
+		"IMAGES_MAX_FRAMES": &cfg.Images.Limits.MaxFrames,
+	}
+	for name, limit := range limits {
+		if os.Getenv(name) == "" {
+			continue
+		}
+		*limit, err = strconv.Atoi(os.Getenv(name))
+		if err != nil {
+			return cfg, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if maxPixels := os.Getenv("IMAGES_MAX_PIXELS"); maxPixels != "" {
+		cfg.Images.Limits.MaxPixels, err = strconv.ParseInt(maxPixels, 10, 64)
+		if err != nil {
+			return cfg, fmt.Errorf("IMAGES_MAX_PIXELS: %w", err)
+		}
+	}
+
+	cfg.Clamd.Network = os.Getenv("CLAMD_NETWORK")
+	cfg.Clamd.Address = os.Getenv("CLAMD_ADDRESS")
+
+	// quotas are optional, any that aren't set aren't enforced
+	quotaImages := map[string]*int{
+		"QUOTA_USER_IMAGES":    &cfg.Quotas.User.MaxImages,
+		"QUOTA_GALLERY_IMAGES": &cfg.Quotas.Gallery.MaxImages,
+	}
+	for name, limit := range quotaImages {
+		if os.Getenv(name) == "" {
+			continue
+		}
+		*limit, err = strconv.Atoi(os.Getenv(name))
+		if err != nil {
+			return cfg, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	quotaBytes := map[string]*int64{
+		"QUOTA_USER_BYTES":    &cfg.Quotas.User.MaxBytes,
+		"QUOTA_GALLERY_BYTES": &cfg.Quotas.Gallery.MaxBytes,
+	}
+	for name, limit := range quotaBytes {
+		if os.Getenv(name) == "" {
+			continue
+		}
+		*limit, err = strconv.ParseInt(os.Getenv(name), 10, 64)
+		if err != nil {
+			return cfg, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	cfg.Trash.Retention = models.DefaultTrashRetention
+	if retention := os.Getenv("TRASH_RETENTION"); retention != "" {
+		cfg.Trash.Retention, err = time.ParseDuration(retention)
+		if err != nil {
+			return cfg, fmt.Errorf("TRASH_RETENTION: %w", err)
+		}
+	}
+
+	cfg.DeletionGracePeriod = models.DefaultDeletionGracePeriod
+	if grace := os.Getenv("ACCOUNT_DELETION_GRACE_PERIOD"); grace != "" {
+		cfg.DeletionGracePeriod, err = time.ParseDuration(grace)
+		if err != nil {
+			return cfg, fmt.Errorf("ACCOUNT_DELETION_GRACE_PERIOD: %w", err)
+		}
+	}
+
+	cfg.Registration, err = models.ParseRegistrationMode(os.Getenv("REGISTRATION_MODE"))
+	if err != nil {
+		return cfg, fmt.Errorf("REGISTRATION_MODE: %w", err)
+	}
+
+	// identity providers are optional, eg OIDC_PROVIDERS=studio with OIDC_STUDIO_ISSUER etc
+	for _, id := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			continue
+		}
+		if !oidcProviderID.MatchString(id) {
+			return cfg, fmt.Errorf("OIDC_PROVIDERS: invalid provider id %q", id)
+		}
+		prefix := "OIDC_" + strings.ToUpper(id) + "_"
+		provider := &oidc.Provider{
+			ID:           id,
+			Name:         os.Getenv(prefix + "NAME"),
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+			Scopes:       strings.Fields(os.Getenv(prefix + "SCOPES")),
+		}
+		if provider.Issuer == "" || provider.ClientID == "" {
+			return cfg, fmt.Errorf("%sISSUER and %sCLIENT_ID are required", prefix, prefix)
+		}
+		if provider.Name == "" {
+			provider.Name = id
+		}
+		if provider.RedirectURL == "" {
+			provider.RedirectURL = "https://www.lenspix.com/oauth/" + id + "/callback"
+		}
+		cfg.OIDCProviders = append(cfg.OIDCProviders, provider)
+	}
+
 	return cfg, nil
 }
 
+// oidcProviderID matches the ids of identity providers, which are used in URLs and env variable names
+var oidcProviderID = regexp.MustCompile(`^[a-z0-9_]+$`)
+
 func main() {
 	cfg, err := loadEnvConfig()
 	if err != nil {
@@ -103,10 +250,12 @@ func run(cfg config) error {
 
 	// Setup services
 	// Setup our model services
+	// setup our user service
 	userService := &models.UserService{
-		DB: db,
+		DB:                  db,
+		DeletionGracePeriod: cfg.DeletionGracePeriod,
 	}
-	// setup our user service
+	// setup session service
 	sessionService := &models.SessionService{
 		DB: db,
 	}
@@ -114,12 +263,70 @@ func run(cfg config) error {
 	pwResetService := &models.PasswordResetService{
 		DB: db,
 	}
+	// setup sign in link service, for users that sign in with a link sent by email
+	signInLinkService := &models.SignInLinkService{
+		DB: db,
+	}
+	// setup email change service
+	emailChangeService := &models.EmailChangeService{
+		DB: db,
+	}
 	// setup email service
 	emailService := models.NewEmailService(cfg.SMTP)
 	// setup gallery service
 	galleryService := &models.GalleryService{
+		DB:           db,
+		ImagesDir:    cfg.Images.Dir,
+		ImageLimits:  cfg.Images.Limits,
+		UserQuota:    cfg.Quotas.User,
+		GalleryQuota: cfg.Quotas.Gallery,
+	}
+	if cfg.Clamd.Address != "" {
+		// scan uploads for viruses
+		galleryService.Scanner = models.ClamdScanner{
+			Network: cfg.Clamd.Network,
+			Address: cfg.Clamd.Address,
+		}
+	}
+
+	// purge the trash and remove the files of deleted images in the background
+	go purgeTrash(galleryService, cfg.Trash.Retention)
+	go cleanStorage(galleryService)
+	// delete the accounts whose grace period is over
+	go deleteAccounts(userService, galleryService, emailService)
+
+	// setup data export service
+	exportService := &models.ExportService{
+		DB:             db,
+		GalleryService: galleryService,
+	}
+	// build the data exports users asked for in the background
+	go runExports(exportService, userService, emailService)
+
+	// setup profile service
+	profileService := &models.ProfileService{
+		DB:             db,
+		GalleryService: galleryService,
+	}
+
+	// setup identity service, for users that sign in with an identity provider
+	identityService := &models.IdentityService{
+		DB:           db,
+		Registration: cfg.Registration,
+	}
+	// setup invite service
+	inviteService := &models.InviteService{
 		DB: db,
 	}
+	// setup admin service
+	adminService := &models.AdminService{
+		DB:             db,
+		SessionService: sessionService,
+	}
+	oidcProviders := make(map[string]*oidc.Provider)
+	for _, provider := range cfg.OIDCProviders {
+		oidcProviders[provider.ID] = provider
+	}
 
 	// Setup middleware
 	umw := controllers.UserMiddleware{
@@ -139,7 +346,15 @@ func run(cfg config) error {
 		UserService:          userService,
 		SessionService:       sessionService,
 		PasswordResetService: pwResetService,
+		SignInLinkService:    signInLinkService,
+		EmailChangeService:   emailChangeService,
+		ExportService:        exportService,
+		ProfileService:       profileService,
+		IdentityService:      identityService,
+		InviteService:        inviteService,
 		EmailService:         emailService,
+		Registration:         cfg.Registration,
+		OIDCProviders:        oidcProviders,
 	}
 	userC.Templates.New = views.Must(views.ParseFS(templates.FS, "signup.gohtml", "tailwind.gohtml"))
 	userC.Templates.SignIn = views.Must(views.ParseFS(templates.FS, "signin.gohtml", "tailwind.gohtml"))
@@ -155,9 +370,23 @@ func run(cfg config) error {
 		templates.FS,
 		"reset-pw.gohtml", "tailwind.gohtml",
 	))
+	userC.Templates.Settings = views.Must(views.ParseFS(
+		templates.FS,
+		"settings.gohtml", "tailwind.gohtml",
+	))
+	userC.Templates.VerifyEmail = views.Must(views.ParseFS(
+		templates.FS,
+		"verify-email.gohtml", "tailwind.gohtml",
+	))
+	userC.Templates.SignInLink = views.Must(views.ParseFS(
+		templates.FS,
+		"sign-in-link.gohtml", "tailwind.gohtml",
+	))
 
 	galleriesC := controllers.Galleries{
 		GalleryService: galleryService,
+		CacheControl:   cfg.Images.CacheControl,
+		TrashRetention: cfg.Trash.Retention,
 	}
 	galleriesC.Templates.New = views.Must(views.ParseFS(
 		templates.FS,
@@ -175,6 +404,60 @@ func run(cfg config) error {
 		templates.FS,
 		"galleries/show.gohtml", "tailwind.gohtml",
 	))
+	galleriesC.Templates.Duplicates = views.Must(views.ParseFS(
+		templates.FS,
+		"galleries/duplicates.gohtml", "tailwind.gohtml",
+	))
+	galleriesC.Templates.EditImage = views.Must(views.ParseFS(
+		templates.FS,
+		"galleries/edit_image.gohtml", "tailwind.gohtml",
+	))
+	galleriesC.Templates.Trash = views.Must(views.ParseFS(
+		templates.FS,
+		"galleries/trash.gohtml", "tailwind.gohtml",
+	))
+
+	invitesC := controllers.Invites{
+		InviteService:  inviteService,
+		GalleryService: galleryService,
+	}
+	invitesC.Templates.Index = views.Must(views.ParseFS(
+		templates.FS,
+		"invites.gohtml", "tailwind.gohtml",
+	))
+
+	adminC := controllers.Admin{
+		AdminService:         adminService,
+		GalleryService:       galleryService,
+		SessionService:       sessionService,
+		PasswordResetService: pwResetService,
+		EmailService:         emailService,
+	}
+	adminC.Templates.Users = views.Must(views.ParseFS(
+		templates.FS,
+		"admin/users.gohtml", "tailwind.gohtml",
+	))
+	adminC.Templates.User = views.Must(views.ParseFS(
+		templates.FS,
+		"admin/user.gohtml", "admin/audit-log.gohtml", "tailwind.gohtml",
+	))
+	adminC.Templates.AuditLog = views.Must(views.ParseFS(
+		templates.FS,
+		"admin/audit.gohtml", "admin/audit-log.gohtml", "tailwind.gohtml",
+	))
+	adminC.Templates.Quarantine = views.Must(views.ParseFS(
+		templates.FS,
+		"admin/quarantine.gohtml", "tailwind.gohtml",
+	))
+
+	profilesC := controllers.Profiles{
+		ProfileService: profileService,
+		GalleryService: galleryService,
+	}
+	profilesC.Templates.Show = views.Must(views.ParseFS(
+		templates.FS,
+		"profile.gohtml", "tailwind.gohtml",
+	))
 
 	// Setup our router and routes
 
@@ -199,18 +482,36 @@ func run(cfg config) error {
 	r.Get("/signin", userC.SignIn)
 	r.Post("/signup", userC.Create)
 	r.Post("/signin", userC.ProcessSignIn)
+	r.Post("/signin/link", userC.SendSignInLink)
+	r.Get("/signin/link", userC.SignInWithLink)
+	r.Post("/signin/link/confirm", userC.ProcessSignInWithLink)
 	r.Post("/signout", userC.ProcessSignOut)
 	r.Get("/forgot-pw", userC.ForgotPassword)
 	r.Post("/forgot-pw", userC.ProcessForgotPassword)
 	r.Get("/users/me", userC.CurrentUser)
 	r.Get("/reset-pw", userC.ResetPassword)
 	r.Post("/reset-pw", userC.ProcessResetPassword)
+	r.Get("/oauth/{provider}/signin", userC.OIDCSignIn)
+	r.Get("/oauth/{provider}/callback", userC.OIDCCallback)
+	r.Get("/verify-email", userC.VerifyEmail)
+	r.Post("/verify-email", userC.ProcessVerifyEmail)
 
 	// Apply the router to all routes that match the prefix 'users/me'
 	r.Route("/users/me", func(r chi.Router) {
 		// RequireUser middleware will be used on all routes with the /users/me prefix
 		r.Use(umw.RequireUser)
 		r.Get("/", userC.CurrentUser)
+		r.Get("/settings", userC.Settings)
+		r.Post("/settings/password", userC.UpdatePassword)
+		r.Post("/settings/email", userC.UpdateEmail)
+		r.Post("/profile", userC.UpdateProfile)
+		r.Post("/exports", userC.RequestExport)
+		r.Get("/exports/{id}", userC.DownloadExport)
+		r.Post("/delete", userC.DeleteAccount)
+		r.Post("/delete/cancel", userC.CancelAccountDeletion)
+		r.Get("/invites", invitesC.Index)
+		r.Post("/invites", invitesC.Create)
+		r.Post("/invites/{id}/delete", invitesC.Delete)
 		r.Get("/hello", func(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprint(w, "Hellooo")
 		})
@@ -228,13 +529,57 @@ func run(cfg config) error {
 			r.Post("/{id}", galleriesC.Update)
 			r.Post("/", galleriesC.Create)
 			r.Get("/", galleriesC.Index)
+			r.Get("/duplicates", galleriesC.UserDuplicates)
+			r.Get("/trash", galleriesC.Trash)
+			r.Post("/trash/galleries/{id}/restore", galleriesC.RestoreTrashedGallery)
+			r.Post("/trash/galleries/{id}/purge", galleriesC.PurgeTrashedGallery)
+			r.Post("/trash/images/{id}/restore", galleriesC.RestoreTrashedImage)
+			r.Post("/trash/images/{id}/purge", galleriesC.PurgeTrashedImage)
+			r.Get("/{id}/duplicates", galleriesC.GalleryDuplicates)
 			r.Post("/{id}/delete", galleriesC.Delete)
 			r.Post("/{id}/images/{filename}/delete", galleriesC.DeleteImage)
+			r.Post("/{id}/images/{filename}/rename", galleriesC.RenameImage)
+			r.Get("/{id}/images/{filename}/edit", galleriesC.EditImage)
+			r.Post("/{id}/images/{filename}/edits", galleriesC.AddImageEdit)
+			r.Post("/{id}/images/{filename}/edits/undo", galleriesC.UndoImageEdit)
+			r.Post("/{id}/images/{filename}/edits/revert", galleriesC.RevertImage)
 			r.Post("/{id}/images", galleriesC.UploadImage)
+			r.Post("/{id}/images/move", galleriesC.MoveImages)
+			r.Post("/{id}/images/copy", galleriesC.CopyImages)
+			r.Post("/{id}/images/bulk", galleriesC.BulkImages)
+			r.Post("/{id}/watermark", galleriesC.UpdateWatermark)
+			r.Post("/{id}/watermark/delete", galleriesC.DeleteWatermark)
+			r.Post("/{id}/members/{userID}/delete", galleriesC.RemoveMember)
 		})
 
 	})
 
+	// public profiles, and vanity URLs for the galleries of their users
+	r.Route("/u/{username}", func(r chi.Router) {
+		r.Get("/", profilesC.Show)
+		r.Get("/avatar", profilesC.Avatar)
+		r.Get("/{gallery}", galleriesC.Show)
+	})
+
+	// the admin area, to manage the accounts of users and review quarantined uploads
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(umw.RequireAdmin)
+		r.Get("/", http.RedirectHandler("/admin/users", http.StatusFound).ServeHTTP)
+		r.Get("/users", adminC.Users)
+		r.Get("/users/{id}", adminC.User)
+		r.Post("/users/{id}/suspend", adminC.Suspend)
+		r.Post("/users/{id}/unsuspend", adminC.Unsuspend)
+		r.Post("/users/{id}/reset-password", adminC.ForcePasswordReset)
+		r.Post("/users/{id}/impersonate", adminC.Impersonate)
+		r.Get("/audit", adminC.AuditLog)
+		r.Get("/quarantine", adminC.Quarantine)
+		r.Get("/quarantine/{id}/download", adminC.DownloadQuarantined)
+		r.Post("/quarantine/{id}/release", adminC.ReleaseQuarantined)
+		r.Post("/quarantine/{id}/delete", adminC.DeleteQuarantined)
+	})
+	// admins that are signed in as another user aren't admins until they stop
+	r.With(umw.RequireUser).Post("/impersonation/stop", adminC.StopImpersonating)
+
 	assetsHandler := http.FileServer(http.Dir("assets"))
 	// HTTP FileServer looks for a file using the entire URL Path. So it needs to be trimmed
 	r.Get("/assets/*", http.StripPrefix("/assets", assetsHandler).ServeHTTP)
@@ -254,6 +599,101 @@ func run(cfg config) error {
 
 }
 
+// purgeTrash deletes galleries and images that have been in the trash for
+// longer than retention for good, once an hour.
+func purgeTrash(galleryService *models.GalleryService, retention time.Duration) {
+	for {
+		n, err := galleryService.PurgeTrash(time.Now().Add(-retention))
+		if err != nil {
+			fmt.Println(err)
+		} else if n > 0 {
+			fmt.Printf("purged %d items from the trash\n", n)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// cleanStorage retries the removal of files of deleted galleries and images
+// that couldn't be removed right away, once a minute.
+func cleanStorage(galleryService *models.GalleryService) {
+	for {
+		_, err := galleryService.CleanStorage()
+		if err != nil {
+			fmt.Println(err)
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
+// deleteAccounts deletes the users whose accounts were scheduled to be
+// deleted and whose grace period is over, once an hour. Their galleries are
+// purged first, so that the files of their images are removed as well.
+func deleteAccounts(userService *models.UserService, galleryService *models.GalleryService, emailService *models.EmailService) {
+	for {
+		users, err := userService.DueForDeletion(time.Now())
+		if err != nil {
+			fmt.Println(err)
+		}
+		for _, user := range users {
+			err = galleryService.PurgeUser(user.ID)
+			if err == nil {
+				err = userService.Delete(user.ID)
+			}
+			if err != nil {
+				// tried again in the next round
+				fmt.Println(err)
+				continue
+			}
+			err = emailService.AccountDeleted(user.Email)
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// runExports builds the data exports that are waiting and emails their users
+// the download link, checking for new ones every minute. Expired archives are
+// removed along the way.
+func runExports(exportService *models.ExportService, userService *models.UserService, emailService *models.EmailService) {
+	for {
+		_, err := exportService.PurgeExpired()
+		if err != nil {
+			fmt.Println(err)
+		}
+		for {
+			export, err := exportService.RunNext()
+			if err != nil {
+				fmt.Println(err)
+				break
+			}
+			if export == nil {
+				break
+			}
+			user, err := userService.ByID(export.UserID)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			if export.Status == models.ExportFailed {
+				fmt.Println("data export", export.ID, "failed:", export.Error)
+				err = emailService.DataExportFailed(user.Email)
+			} else {
+				vals := url.Values{
+					"token": {export.Token},
+				}
+				downloadURL := fmt.Sprintf("https://www.lenspix.com/users/me/exports/%d?", export.ID) + vals.Encode()
+				err = emailService.DataExportReady(user.Email, downloadURL, *export.ExpiresAt)
+			}
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
 // timer middleware to know the response time for our requests
 func TimeMiddleware(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,291 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/ayushthe1/lenspix/context"
+	"github.com/ayushthe1/lenspix/errors"
+	"github.com/ayushthe1/lenspix/models"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// CookieImpersonator keeps the session of an admin while they are signed in as another user
+	CookieImpersonator = "impersonator_session"
+)
+
+type Admin struct {
+	Templates struct {
+		// Users template lists and searches the accounts of all users
+		Users Template
+		// User template shows an account with its galleries, storage use and audit log, and what admins can do to it
+		User Template
+		// AuditLog template lists what admins did to the accounts of users
+		AuditLog Template
+		// Quarantine template lists the uploads that wait for an admin to release or delete them
+		Quarantine Template
+	}
+	AdminService         *models.AdminService
+	GalleryService       *models.GalleryService
+	SessionService       *models.SessionService
+	PasswordResetService *models.PasswordResetService
+	EmailService         *models.EmailService
+}
+
+// handler to list the accounts of all users, or the ones matching the search query
+func (a Admin) Users(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Query    string
+		Accounts []models.Account
+		// More is set when there are more accounts than the ones shown
+		More bool
+	}
+	data.Query = r.FormValue("q")
+	accounts, err := a.AdminService.Accounts(data.Query)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Accounts = accounts
+	data.More = len(accounts) == models.MaxAccounts
+	a.Templates.Users.Execute(w, r, data)
+}
+
+// handler to show the account of a user
+func (a Admin) User(w http.ResponseWriter, r *http.Request) {
+	a.renderUser(w, r, "")
+}
+
+// renderUser renders the account page of the user from the URL with an optional notice about a change that was made
+func (a Admin) renderUser(w http.ResponseWriter, r *http.Request, notice string, errs ...error) {
+	account, ok := a.account(w, r)
+	if !ok {
+		return
+	}
+
+	type Gallery struct {
+		ID         int
+		Title      string
+		Visibility models.Visibility
+		Images     int
+		Size       string
+	}
+
+	var data struct {
+		Account   *models.Account
+		Notice    string
+		Galleries []Gallery
+		// Images and Size are the storage use of the user, including the trash
+		Images int
+		Size   string
+		Audit  []models.AuditEntry
+	}
+	data.Account = account
+	data.Notice = notice
+
+	galleries, err := a.GalleryService.ByUserID(account.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	usages, err := a.GalleryService.GalleryUsages(account.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, gallery := range galleries {
+		data.Galleries = append(data.Galleries, Gallery{
+			ID:         gallery.ID,
+			Title:      gallery.Title,
+			Visibility: gallery.Visibility,
+			Images:     usages[gallery.ID].Images,
+			Size:       models.FormatBytes(usages[gallery.ID].Bytes),
+		})
+	}
+	var total models.Usage
+	for _, usage := range usages {
+		total.Images += usage.Images
+		total.Bytes += usage.Bytes
+	}
+	data.Images = total.Images
+	data.Size = models.FormatBytes(total.Bytes)
+
+	data.Audit, err = a.AdminService.AuditLog(account.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	a.Templates.User.Execute(w, r, data, errs...)
+}
+
+// handler to suspend the account of a user
+func (a Admin) Suspend(w http.ResponseWriter, r *http.Request) {
+	a.change(w, r, a.AdminService.Suspend, "The account was suspended and its user signed out.")
+}
+
+// handler to let a suspended user sign in again
+func (a Admin) Unsuspend(w http.ResponseWriter, r *http.Request) {
+	a.change(w, r, a.AdminService.Unsuspend, "The account is no longer suspended.")
+}
+
+// handler to remove the password of a user and email them a link to pick a new one
+func (a Admin) ForcePasswordReset(w http.ResponseWriter, r *http.Request) {
+	account, ok := a.account(w, r)
+	if !ok {
+		return
+	}
+	admin := context.User(r.Context())
+	err := a.AdminService.ForcePasswordReset(admin.ID, account.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	pwReset, err := a.PasswordResetService.Create(account.Email)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	vals := url.Values{
+		"token": {pwReset.Token},
+	}
+	resetURL := "https://www.lenspix.com/reset-pw?" + vals.Encode()
+	err = a.EmailService.ForgotPassword(account.Email, resetURL)
+	if err != nil {
+		fmt.Println(err)
+		err = errors.Public(err, "The password was removed, but the email to pick a new one couldn't be sent.")
+		a.renderUser(w, r, "", err)
+		return
+	}
+	a.renderUser(w, r, fmt.Sprintf("The password was removed and %v was emailed a link to pick a new one.", account.Email))
+}
+
+// handler to sign the admin in as another user for support. The admin's own session is kept in a cookie, so that
+// they are signed back in to it when they stop.
+func (a Admin) Impersonate(w http.ResponseWriter, r *http.Request) {
+	account, ok := a.account(w, r)
+	if !ok {
+		return
+	}
+	token, err := readCookie(r, CookieSession)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	admin := context.User(r.Context())
+	session, err := a.AdminService.Impersonate(admin.ID, account.ID)
+	if err != nil {
+		var adminErr models.AdminError
+		if errors.As(err, &adminErr) {
+			a.renderUser(w, r, "", errors.Public(err, fmt.Sprintf("You can't sign in as this user: %v.", adminErr.Issue)))
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	setCookie(w, CookieImpersonator, token)
+	setCookie(w, CookieSession, session.Token)
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
+// handler for an admin to stop impersonating a user and get back to their own session
+func (a Admin) StopImpersonating(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if user.ImpersonatorID == 0 {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	token, err := readCookie(r, CookieSession)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	err = a.SessionService.Delete(token)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = a.AdminService.StopImpersonating(user.ImpersonatorID, user.ID)
+	if err != nil {
+		// the session is gone already, so this isn't worth failing the request for
+		fmt.Println(err)
+	}
+
+	adminToken, err := readCookie(r, CookieImpersonator)
+	deleteCookie(w, CookieImpersonator)
+	if err != nil {
+		deleteCookie(w, CookieSession)
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	setCookie(w, CookieSession, adminToken)
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusFound)
+}
+
+// handler to list what admins did to the accounts of users
+func (a Admin) AuditLog(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Entries []models.AuditEntry
+	}
+	entries, err := a.AdminService.AuditLog(0)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Entries = entries
+	a.Templates.AuditLog.Execute(w, r, data)
+}
+
+// change makes a change to the account of the user from the URL and renders the account with the notice, or with the
+// reason why the change isn't allowed
+func (a Admin) change(w http.ResponseWriter, r *http.Request, fn func(adminID, userID int) error, notice string) {
+	account, ok := a.account(w, r)
+	if !ok {
+		return
+	}
+	admin := context.User(r.Context())
+	err := fn(admin.ID, account.ID)
+	if err != nil {
+		var adminErr models.AdminError
+		if errors.As(err, &adminErr) {
+			a.renderUser(w, r, "", errors.Public(err, fmt.Sprintf("Nothing was changed: %v.", adminErr.Issue)))
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	a.renderUser(w, r, notice)
+}
+
+// account looks up the account of the user from the URL, and writes a 404 if there is none
+func (a Admin) account(w http.ResponseWriter, r *http.Request) (*models.Account, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return nil, false
+	}
+	account, err := a.AdminService.Account(id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return nil, false
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return nil, false
+	}
+	return account, true
+}
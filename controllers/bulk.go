@@ -0,0 +1,187 @@
+package controllers
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/ayushthe1/lenspix/errors"
+	"github.com/ayushthe1/lenspix/models"
+)
+
+// MaxCaptionLength is the longest caption, in characters, that can be set on an image
+const MaxCaptionLength = 1000
+
+// bulkResult is the outcome of a bulk action for a single image
+type bulkResult struct {
+	Filename string
+	OK       bool
+	Message  string
+}
+
+// handler for the bulk actions on the gallery edit page. The action form value is applied to every selected image on its own,
+// so a single image that fails doesn't stop the others, and the edit page is rendered with the result for each image.
+func (g Galleries) BulkImages(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	filenames := r.PostForm["filename"]
+	if len(filenames) == 0 {
+		err = fmt.Errorf("no images selected")
+		g.renderEdit(w, r, gallery, errors.Public(err, "Please select at least one image."))
+		return
+	}
+
+	// apply performs the action on a single image and returns the message to show for it
+	var apply func(image models.Image) (string, error)
+	switch r.FormValue("action") {
+	case "download":
+		g.downloadImages(w, gallery, filenames)
+		return
+	case "delete":
+		apply = func(image models.Image) (string, error) {
+			return "Moved to the trash", g.GalleryService.DeleteImage(gallery.ID, image.Filename)
+		}
+	case "move", "copy":
+		target, ok := g.targetGallery(w, r, gallery)
+		if !ok {
+			return
+		}
+		if r.FormValue("action") == "copy" {
+			apply = func(image models.Image) (string, error) {
+				copies, err := g.GalleryService.CopyImages([]models.Image{image}, target.ID)
+				if err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("Copied to %v as %v", target.Title, copies[0].Filename), nil
+			}
+		} else {
+			apply = func(image models.Image) (string, error) {
+				moved, err := g.GalleryService.MoveImages([]models.Image{image}, target.ID)
+				if err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("Moved to %v as %v", target.Title, moved[0].Filename), nil
+			}
+		}
+	case "caption":
+		caption := strings.TrimSpace(r.FormValue("caption"))
+		if len([]rune(caption)) > MaxCaptionLength {
+			err = fmt.Errorf("caption too long")
+			msg := fmt.Sprintf("Captions can be at most %d characters long.", MaxCaptionLength)
+			g.renderEdit(w, r, gallery, errors.Public(err, msg))
+			return
+		}
+		apply = func(image models.Image) (string, error) {
+			image.Caption = caption
+			if caption == "" {
+				return "Caption removed", g.GalleryService.UpdateImage(&image)
+			}
+			return "Caption updated", g.GalleryService.UpdateImage(&image)
+		}
+	case "visibility":
+		// an empty visibility gives the images the visibility of the gallery again
+		var visibility models.Visibility
+		if v := r.FormValue("visibility"); v != "" {
+			visibility, err = models.ParseVisibility(v)
+			if err != nil {
+				http.Error(w, "Invalid visibility", http.StatusBadRequest)
+				return
+			}
+		}
+		apply = func(image models.Image) (string, error) {
+			image.Visibility = visibility
+			if visibility == "" {
+				return "Visibility set to the gallery's", g.GalleryService.UpdateImage(&image)
+			}
+			return fmt.Sprintf("Visibility set to %v", visibility), g.GalleryService.UpdateImage(&image)
+		}
+	default:
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+
+	var results []bulkResult
+	for _, filename := range filenames {
+		result := bulkResult{Filename: filename}
+		image, err := g.GalleryService.Image(gallery.ID, filename)
+		if err == nil {
+			result.Message, err = apply(image)
+		}
+		var quotaErr models.QuotaError
+		switch {
+		case err == nil:
+			result.OK = true
+		case errors.Is(err, models.ErrNotFound):
+			result.Message = "Not in this gallery anymore"
+		case errors.As(err, &quotaErr):
+			result.Message = "Over quota: " + quotaErr.Issue
+		default:
+			fmt.Println(err)
+			result.Message = "Something went wrong"
+		}
+		results = append(results, result)
+	}
+	g.renderEditResults(w, r, gallery, results)
+}
+
+// downloadImages responds with a zip archive of the original files of the images. Images that can't be read are left out
+// and listed in an errors.txt file inside the archive, as it is too late to report them once the archive is being sent.
+func (g Galleries) downloadImages(w http.ResponseWriter, gallery *models.Gallery, filenames []string) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="gallery-%d.zip"`, gallery.ID))
+
+	archive := zip.NewWriter(w)
+	var failures []string
+	for _, filename := range filenames {
+		err := g.addToArchive(archive, gallery.ID, filename)
+		if err != nil {
+			if !errors.Is(err, models.ErrNotFound) {
+				fmt.Println(err)
+			}
+			failures = append(failures, fmt.Sprintf("%v: couldn't be downloaded", filename))
+		}
+	}
+	if len(failures) > 0 {
+		f, err := archive.Create("errors.txt")
+		if err == nil {
+			io.WriteString(f, strings.Join(failures, "\n")+"\n")
+		}
+	}
+	err := archive.Close()
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func (g Galleries) addToArchive(archive *zip.Writer, galleryID int, filename string) error {
+	image, err := g.GalleryService.Image(galleryID, filename)
+	if err != nil {
+		return err
+	}
+	obj, err := g.GalleryService.OpenImage(image)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	f, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     image.Filename,
+		Method:   zip.Store, // images are already compressed
+		Modified: image.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, obj)
+	return err
+}
@@ -1,10 +1,17 @@
 package controllers
 
 import (
+	"bytes"
+	"encoding/base64"
 	"fmt"
+	"html/template"
+	"image/png"
+	"math"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/ayushthe1/lenspix/context"
 	"github.com/ayushthe1/lenspix/errors"
@@ -20,9 +27,34 @@ type Galleries struct {
 		Edit  Template
 		Index Template
 		Show  Template
+		// Duplicates template lists groups of images that might be copies of each other
+		Duplicates Template
+		// EditImage template is the crop, rotate and adjustments editor of a single image
+		EditImage Template
+		// Trash template lists the deleted galleries and images that can still be restored
+		Trash Template
 	}
 	// This will be used to process to that form
 	GalleryService *models.GalleryService
+
+	// CacheControl holds the Cache-Control header sent with images, keyed by the
+	// visibility of the gallery they belong to. Visibilities that aren't set use
+	// DefaultCacheControl.
+	CacheControl map[models.Visibility]string
+
+	// TrashRetention is how long deleted galleries and images stay in the
+	// trash. It is only used to tell users when they will be purged, the
+	// purging itself is up to the caller of GalleryService.PurgeTrash.
+	// models.DefaultTrashRetention is used if it isn't set.
+	TrashRetention time.Duration
+}
+
+// DefaultCacheControl is the Cache-Control policy used for images when none is configured.
+// Private images may only be kept by the browser and have to be revalidated, which is cheap thanks to ETags.
+var DefaultCacheControl = map[models.Visibility]string{
+	models.VisibilityPublic:   "public, max-age=86400",
+	models.VisibilityUnlisted: "public, max-age=3600",
+	models.VisibilityPrivate:  "private, no-cache",
 }
 
 func (g Galleries) New(w http.ResponseWriter, r *http.Request) {
@@ -66,19 +98,106 @@ func (g Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	g.renderEdit(w, r, gallery)
+}
+
+// renders the edit gallery page, along with any errors that should be shown to the user
+func (g Galleries) renderEdit(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, errs ...error) {
+	g.renderEditResults(w, r, gallery, nil, errs...)
+}
+
+// renders the edit gallery page along with the per image results of a bulk action
+func (g Galleries) renderEditResults(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, results []bulkResult, errs ...error) {
 	type Image struct {
 		GalleryID       int
 		Filename        string
 		FilenameEscaped string // same as filename but escaped & url friendly
+		Version         string // changes when the image is edited, so that caches pick up the edit
+		Caption         string
+		Visibility      models.Visibility // empty when it is the same as the gallery's
+		Width           int
+		Height          int
+		Placeholder     template.CSS
+	}
+	// Member is someone who was invited to the gallery
+	type Member struct {
+		UserID int
+		Name   string
+		Since  string
 	}
 
 	var data struct {
-		ID     int
-		Title  string
-		Images []Image
+		ID           int
+		Title        string
+		Slug         string
+		Visibility   models.Visibility
+		Visibilities []models.Visibility
+		Images       []Image
+		Watermark    struct {
+			Enabled  bool
+			Text     string
+			HasLogo  bool
+			Position models.WatermarkPosition
+			Opacity  int // percent
+			Scale    int // percent of the image width
+		}
+		WatermarkPositions []models.WatermarkPosition
+		// Targets are the other galleries of the user, that images can be moved or copied to
+		Targets []models.Gallery
+		Results []bulkResult
+		Members []Member
 	}
 	data.ID = gallery.ID
+	data.Results = results
 	data.Title = gallery.Title
+	data.Slug = gallery.Slug
+	data.Visibility = gallery.Visibility
+	data.Visibilities = models.Visibilities
+
+	// the watermark form is filled with the current settings, or sensible defaults
+	data.Watermark.Position = models.WatermarkBottomRight
+	data.Watermark.Opacity = 50
+	data.Watermark.Scale = 25
+	data.WatermarkPositions = models.WatermarkPositions
+	watermark, err := g.GalleryService.Watermark(gallery.ID)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if watermark != nil {
+		data.Watermark.Enabled = true
+		data.Watermark.Text = watermark.Text
+		data.Watermark.HasLogo = watermark.LogoKey != ""
+		data.Watermark.Position = watermark.Position
+		data.Watermark.Opacity = int(math.Round(watermark.Opacity * 100))
+		data.Watermark.Scale = int(math.Round(watermark.Scale * 100))
+	}
+
+	data.Targets, err = g.targetGalleries(gallery)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	members, err := g.GalleryService.Members(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, member := range members {
+		name := member.Email
+		if member.Username != "" {
+			name = fmt.Sprintf("%v (%v)", member.Username, member.Email)
+		}
+		data.Members = append(data.Members, Member{
+			UserID: member.UserID,
+			Name:   name,
+			Since:  member.CreatedAt.Format("January 2, 2006"),
+		})
+	}
 
 	// get all the images
 	images, err := g.GalleryService.Images(gallery.ID)
@@ -93,10 +212,16 @@ func (g Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 			GalleryID:       image.GalleryID,
 			Filename:        image.Filename,
 			FilenameEscaped: url.PathEscape(image.Filename),
+			Version:         image.Version(),
+			Caption:         image.Caption,
+			Visibility:      image.Visibility,
+			Width:           image.Width,
+			Height:          image.Height,
+			Placeholder:     placeholderStyle(image),
 		})
 	}
 
-	g.Templates.Edit.Execute(w, r, data)
+	g.Templates.Edit.Execute(w, r, data, errs...)
 
 }
 
@@ -109,10 +234,26 @@ func (g Galleries) Update(w http.ResponseWriter, r *http.Request) {
 	}
 
 	gallery.Title = r.FormValue("title") // title value from form
-	// update the gallery in db
-	err = g.GalleryService.Update(gallery)
+	gallery.Visibility, err = models.ParseVisibility(r.FormValue("visibility"))
 	if err != nil {
-		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		http.Error(w, "Invalid visibility", http.StatusBadRequest)
+		return
+	}
+	// update the gallery in db. An empty slug gets a new one from the title.
+	// Nothing is saved if the slug can't be used.
+	err = g.GalleryService.UpdateWithSlug(gallery, r.FormValue("slug"))
+	if err != nil {
+		var slugErr models.SlugError
+		switch {
+		case errors.Is(err, models.ErrSlugTaken):
+			msg := "Your changes weren't saved: another one of your galleries already uses that slug."
+			g.renderEdit(w, r, gallery, errors.Public(err, msg))
+		case errors.As(err, &slugErr):
+			g.renderEdit(w, r, gallery, errors.Public(err, fmt.Sprintf("Your changes weren't saved: %v.", slugErr.Issue)))
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
 		return
 	}
 	// after the gallery is updated, redirect the user to the edit page
@@ -125,12 +266,25 @@ func (g Galleries) Index(w http.ResponseWriter, r *http.Request) {
 	// take the current user ,look up at all of their galleries and then send them to the template to render them
 
 	type Gallery struct {
-		ID    int
-		Title string
+		ID     int
+		Title  string
+		Images int
+		Size   string
 	}
 
 	var data struct {
 		Galleries []Gallery
+		// Shared are the galleries of other users that the user is a member of
+		Shared []Gallery
+		// Usage is the storage meter of the user
+		Usage struct {
+			Images    int
+			MaxImages int
+			Size      string
+			MaxSize   string
+			// Percent is how much of the quota is used, for whichever limit is closest to being reached
+			Percent int
+		}
 	}
 
 	user := context.User(r.Context())
@@ -140,15 +294,57 @@ func (g Galleries) Index(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
+	usages, err := g.GalleryService.GalleryUsages(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
 
 	// convert the galleries returned from db into Gallery type which we can send to templates to render them
 	for _, gallery := range galleries {
 		data.Galleries = append(data.Galleries, Gallery{
+			ID:     gallery.ID,
+			Title:  gallery.Title,
+			Images: usages[gallery.ID].Images,
+			Size:   models.FormatBytes(usages[gallery.ID].Bytes),
+		})
+	}
+
+	shared, err := g.GalleryService.SharedWith(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, gallery := range shared {
+		data.Shared = append(data.Shared, Gallery{
 			ID:    gallery.ID,
 			Title: gallery.Title,
 		})
 	}
 
+	// the trash counts towards the quota too
+	var total models.Usage
+	for _, usage := range usages {
+		total.Images += usage.Images
+		total.Bytes += usage.Bytes
+	}
+	quota := g.GalleryService.UserQuota
+	data.Usage.Images = total.Images
+	data.Usage.MaxImages = quota.MaxImages
+	data.Usage.Size = models.FormatBytes(total.Bytes)
+	if quota.MaxBytes > 0 {
+		data.Usage.MaxSize = models.FormatBytes(quota.MaxBytes)
+		data.Usage.Percent = int(100 * total.Bytes / quota.MaxBytes)
+	}
+	if quota.MaxImages > 0 && 100*total.Images/quota.MaxImages > data.Usage.Percent {
+		data.Usage.Percent = 100 * total.Images / quota.MaxImages
+	}
+	if data.Usage.Percent > 100 {
+		data.Usage.Percent = 100
+	}
+
 	g.Templates.Index.Execute(w, r, data)
 
 }
@@ -173,7 +369,7 @@ func (g Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 // Handler for showing a gallery. Anyone with a link to a gallery will be able to view it as we'll not restrict access to this page like we have done with other gallery pages
 func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
 
-	gallery, err := g.galleryByID(w, r)
+	gallery, err := g.galleryByID(w, r, g.userCanViewGallery)
 	if err != nil {
 		return
 	}
@@ -182,6 +378,11 @@ func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
 		GalleryID       int
 		Filename        string
 		FilenameEscaped string
+		Version         string
+		Caption         string
+		Width           int
+		Height          int
+		Placeholder     template.CSS
 	}
 
 	var data struct {
@@ -208,11 +409,27 @@ func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	view, err := g.viewAs(r, *gallery)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	user := context.User(r.Context())
+	isOwner := user != nil && user.ID == gallery.UserID
 	for _, image := range images {
+		if !isOwner && !image.ListedIn(view) {
+			continue
+		}
 		data.Images = append(data.Images, Image{
 			GalleryID:       image.GalleryID,
 			Filename:        image.Filename,
 			FilenameEscaped: url.PathEscape(image.Filename),
+			Version:         image.Version(),
+			Caption:         image.Caption,
+			Width:           image.Width,
+			Height:          image.Height,
+			Placeholder:     placeholderStyle(image),
 		})
 	}
 
@@ -222,16 +439,31 @@ func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
 // handler function for showing image when requested. THis function takes in the gallery id and filename of the image from the url params to get the image
 func (g Galleries) Image(w http.ResponseWriter, r *http.Request) {
 
-	// get the gallery id and filename from the url params
-	filename := chi.URLParam(r, "filename")
-	galleryID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	gallery, err := g.galleryByID(w, r, g.userCanViewGallery)
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusNotFound)
 		return
 	}
+	// get the filename from the url params
+	filename := chi.URLParam(r, "filename")
 
 	// get the image
-	image, err := g.GalleryService.Image(galleryID, filename)
+	image, err := g.GalleryService.Image(gallery.ID, filename)
+	if errors.Is(err, models.ErrNotFound) {
+		// links to images that have been renamed since have to keep working
+		image, err = g.GalleryService.RenamedImage(gallery.ID, filename)
+		if err == nil && image.GalleryID == gallery.ID {
+			imagePath := fmt.Sprintf("/galleries/%d/images/%s", image.GalleryID, url.PathEscape(image.Filename))
+			if r.URL.RawQuery != "" {
+				imagePath += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, imagePath, http.StatusMovedPermanently)
+			return
+		}
+		if err == nil {
+			// moved to another gallery, which might not be visible to the viewer
+			err = models.ErrNotFound
+		}
+	}
 	if err != nil {
 		if errors.Is(err, models.ErrNotFound) {
 			http.Error(w, "image don't exist", http.StatusNotFound)
@@ -242,9 +474,69 @@ func (g Galleries) Image(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// render the requested image
-	http.ServeFile(w, r, image.Path)
+	view, err := g.viewAs(r, *gallery)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong while quering for the image", http.StatusInternalServerError)
+		return
+	}
+	user := context.User(r.Context())
+	isOwner := user != nil && user.ID == gallery.UserID
+	if image.VisibilityIn(view) == models.VisibilityPrivate && !isOwner {
+		http.Error(w, "image don't exist", http.StatusNotFound)
+		return
+	}
+	// images that members can see are still private, so they must not end up in a shared cache
+	visibility := image.VisibilityIn(*gallery)
+
+	cacheControl := g.cacheControl(visibility)
+	opts := models.RenditionOptions{Edits: image.Edits}
+	watermark, err := g.GalleryService.Watermark(gallery.ID)
+	switch {
+	case errors.Is(err, models.ErrNotFound):
+		// no watermark, everyone gets the same image
+	case err != nil:
+		fmt.Println(err)
+		http.Error(w, "Something went wrong while quering for the image", http.StatusInternalServerError)
+		return
+	default:
+		// the same URL serves different images depending on who is signed in
+		w.Header().Set("Vary", "Cookie")
+		if isOwner {
+			// owners get the clean image, which must not end up in a shared cache
+			cacheControl = "private, no-cache"
+		} else {
+			opts.Watermark = watermark
+		}
+	}
+
+	rendition, err := g.GalleryService.Rendition(image, opts)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "image don't exist", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong while opening the image", http.StatusInternalServerError)
+		return
+	}
+	defer rendition.Close()
+
+	// The ETag is derived from the checksum of the original and the options of the rendition, so it only changes when the contents do.
+	// ServeContent uses it to answer If-None-Match and If-Range, and handles Range requests for us.
+	w.Header().Set("ETag", rendition.ETag)
+	w.Header().Set("Content-Type", rendition.ContentType)
+	w.Header().Set("Cache-Control", cacheControl)
+	http.ServeContent(w, r, image.Filename, rendition.ModTime, rendition)
+
+}
 
+// returns the Cache-Control header to use for images in a gallery with the given visibility
+func (g Galleries) cacheControl(visibility models.Visibility) string {
+	if cc, ok := g.CacheControl[visibility]; ok {
+		return cc
+	}
+	return DefaultCacheControl[visibility]
 }
 
 // handler function for uploading a image
@@ -260,6 +552,8 @@ func (g Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
 	}
 	fileHeaders := r.MultipartForm.File["images"] // <input type="file" name="images" />
 
+	// files that can't be added are skipped, and reported once all of the others are processed
+	var uploadErrs []error
 	for _, fileHeader := range fileHeaders {
 		file, err := fileHeader.Open()
 		if err != nil {
@@ -268,22 +562,539 @@ func (g Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
 		}
 		defer file.Close()
 
-		err = g.GalleryService.CreateImage(gallery.ID, fileHeader.Filename, file)
+		_, err = g.GalleryService.CreateImage(gallery.ID, fileHeader.Filename, file)
+		if err != nil {
+			var fileErr models.FileError
+			var quotaErr models.QuotaError
+			switch {
+			case errors.Is(err, models.ErrDuplicateImage):
+				msg := fmt.Sprintf("Skipped %v: an identical image is already in this gallery.", fileHeader.Filename)
+				uploadErrs = append(uploadErrs, errors.Public(err, msg))
+			case errors.Is(err, models.ErrQuarantined):
+				msg := fmt.Sprintf("%v couldn't be scanned for viruses, it will be added once an administrator has reviewed it.", fileHeader.Filename)
+				uploadErrs = append(uploadErrs, errors.Public(err, msg))
+			case errors.As(err, &fileErr):
+				msg := fmt.Sprintf("Skipped %v: %v.", fileHeader.Filename, fileErr.Issue)
+				uploadErrs = append(uploadErrs, errors.Public(err, msg))
+			case errors.As(err, &quotaErr):
+				msg := fmt.Sprintf("Skipped %v: %v. Delete some images or empty the trash to make room.", fileHeader.Filename, quotaErr.Issue)
+				uploadErrs = append(uploadErrs, errors.Public(err, msg))
+			default:
+				fmt.Println(err)
+				http.Error(w, "Something went wrongg", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	if len(uploadErrs) > 0 {
+		// render the edit page so the user can see which files were skipped
+		g.renderEdit(w, r, gallery, uploadErrs...)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+
+}
+
+// handler to render the editor of a single image
+func (g Galleries) EditImage(w http.ResponseWriter, r *http.Request) {
+	image, ok := g.ownedImage(w, r)
+	if !ok {
+		return
+	}
+	g.renderEditImage(w, r, image)
+}
+
+func (g Galleries) renderEditImage(w http.ResponseWriter, r *http.Request, image models.Image, errs ...error) {
+	var data struct {
+		GalleryID       int
+		Filename        string
+		FilenameEscaped string
+		Version         string
+		Width           int
+		Height          int
+		Placeholder     template.CSS
+		History         []string // oldest first
+		Targets         []models.Gallery
+	}
+	gallery, err := g.GalleryService.ByID(image.GalleryID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Targets, err = g.targetGalleries(gallery)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.GalleryID = image.GalleryID
+	data.Filename = image.Filename
+	data.FilenameEscaped = url.PathEscape(image.Filename)
+	data.Version = image.Version()
+	data.Width = image.Width
+	data.Height = image.Height
+	data.Placeholder = placeholderStyle(image)
+	for _, edit := range image.Edits {
+		data.History = append(data.History, edit.String())
+	}
+	g.Templates.EditImage.Execute(w, r, data, errs...)
+}
+
+// handler to process the forms of the image editor. Every form adds a single edit to the edit history of the image.
+func (g Galleries) AddImageEdit(w http.ResponseWriter, r *http.Request) {
+	image, ok := g.ownedImage(w, r)
+	if !ok {
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	edit := models.Edit{Op: models.EditOp(r.FormValue("op"))}
+	switch edit.Op {
+	case models.EditCrop:
+		// the crop rectangle is sent in percents of the current image
+		var rect [4]float64
+		for i, name := range []string{"x", "y", "width", "height"} {
+			rect[i], err = strconv.ParseFloat(r.FormValue(name), 64)
+			if err != nil {
+				http.Error(w, "Invalid crop", http.StatusBadRequest)
+				return
+			}
+		}
+		edit.Crop = &models.CropRect{X: rect[0] / 100, Y: rect[1] / 100, Width: rect[2] / 100, Height: rect[3] / 100}
+		// rounding can make the rectangle stick out of the image by a hair
+		edit.Crop.Width = math.Min(edit.Crop.Width, 1-edit.Crop.X)
+		edit.Crop.Height = math.Min(edit.Crop.Height, 1-edit.Crop.Y)
+		if edit.Crop.X < 0 || edit.Crop.Y < 0 || edit.Crop.Width <= 0 || edit.Crop.Height <= 0 ||
+			edit.Crop.X+edit.Crop.Width > 1 || edit.Crop.Y+edit.Crop.Height > 1 {
+			err = fmt.Errorf("invalid crop %+v", *edit.Crop)
+			g.renderEditImage(w, r, image, errors.Public(err, "The crop area has to be inside the image."))
+			return
+		}
+	case models.EditRotate:
+		// the amount is checked by AddEdit
+		edit.Amount, err = strconv.ParseFloat(r.FormValue("amount"), 64)
+		if err != nil {
+			http.Error(w, "Invalid rotation", http.StatusBadRequest)
+			return
+		}
+	case models.EditBrightness, models.EditContrast:
+		edit.Amount, err = strconv.ParseFloat(r.FormValue("amount"), 64)
+		if err != nil || edit.Amount < -100 || edit.Amount > 100 {
+			http.Error(w, "Invalid amount", http.StatusBadRequest)
+			return
+		}
+		if edit.Amount == 0 {
+			// nothing to do
+			g.redirectToImageEditor(w, r, image)
+			return
+		}
+	default:
+		http.Error(w, "Invalid edit", http.StatusBadRequest)
+		return
+	}
+
+	image, err = g.GalleryService.AddEdit(image, edit)
+	if err != nil {
+		var editErr models.EditError
+		if errors.As(err, &editErr) {
+			http.Error(w, fmt.Sprintf("Invalid %v.", editErr.Issue), http.StatusBadRequest)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong while editing the image", http.StatusInternalServerError)
+		return
+	}
+	g.redirectToImageEditor(w, r, image)
+}
+
+// handler to undo the last edit of an image
+func (g Galleries) UndoImageEdit(w http.ResponseWriter, r *http.Request) {
+	image, ok := g.ownedImage(w, r)
+	if !ok {
+		return
+	}
+	image, err := g.GalleryService.UndoEdit(image)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong while editing the image", http.StatusInternalServerError)
+		return
+	}
+	g.redirectToImageEditor(w, r, image)
+}
+
+// handler to drop all the edits of an image and go back to the original
+func (g Galleries) RevertImage(w http.ResponseWriter, r *http.Request) {
+	image, ok := g.ownedImage(w, r)
+	if !ok {
+		return
+	}
+	image, err := g.GalleryService.RevertImage(image)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong while editing the image", http.StatusInternalServerError)
+		return
+	}
+	g.redirectToImageEditor(w, r, image)
+}
+
+func (g Galleries) redirectToImageEditor(w http.ResponseWriter, r *http.Request, image models.Image) {
+	editPath := fmt.Sprintf("/galleries/%d/images/%s/edit", image.GalleryID, url.PathEscape(image.Filename))
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// ownedImage looks up the image in the URL, which has to be in a gallery of the current user.
+// If it can't be found, an error has already been written to w and false is returned.
+func (g Galleries) ownedImage(w http.ResponseWriter, r *http.Request) (models.Image, bool) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return models.Image{}, false
+	}
+	filename := chi.URLParam(r, "filename")
+	image, err := g.GalleryService.Image(gallery.ID, filename)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "image don't exist", http.StatusNotFound)
+			return models.Image{}, false
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong while quering for the image", http.StatusInternalServerError)
+		return models.Image{}, false
+	}
+	return image, true
+}
+
+// handler for renaming a image
+func (g Galleries) RenameImage(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+	filename := chi.URLParam(r, "filename")
+	newFilename := strings.TrimSpace(r.FormValue("filename"))
+
+	_, err = g.GalleryService.RenameImage(gallery.ID, filename, newFilename)
+	if err != nil {
+		var fileErr models.FileError
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			http.Error(w, "image don't exist", http.StatusNotFound)
+		case errors.Is(err, models.ErrFilenameTaken):
+			msg := fmt.Sprintf("Couldn't rename %v: there already is an image called %v in this gallery.", filename, newFilename)
+			g.renderEdit(w, r, gallery, errors.Public(err, msg))
+		case errors.As(err, &fileErr):
+			msg := fmt.Sprintf("Couldn't rename %v: %v.", filename, fileErr.Issue)
+			g.renderEdit(w, r, gallery, errors.Public(err, msg))
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong while renaming the image", http.StatusInternalServerError)
+		}
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// handler to move the selected images of a gallery to another gallery of the user
+func (g Galleries) MoveImages(w http.ResponseWriter, r *http.Request) {
+	g.transferImages(w, r, false)
+}
+
+// handler to copy the selected images of a gallery to another gallery of the user
+func (g Galleries) CopyImages(w http.ResponseWriter, r *http.Request) {
+	g.transferImages(w, r, true)
+}
+
+// transferImages moves the images named by the filename form values to the gallery in the target form value,
+// or copies them there if keepOriginals is true
+func (g Galleries) transferImages(w http.ResponseWriter, r *http.Request, keepOriginals bool) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	filenames := r.PostForm["filename"]
+	if len(filenames) == 0 {
+		err = fmt.Errorf("no images selected")
+		g.renderEdit(w, r, gallery, errors.Public(err, "Please select at least one image."))
+		return
+	}
+	target, ok := g.targetGallery(w, r, gallery)
+	if !ok {
+		return
+	}
+
+	var images []models.Image
+	for _, filename := range filenames {
+		image, err := g.GalleryService.Image(gallery.ID, filename)
+		if err != nil {
+			if errors.Is(err, models.ErrNotFound) {
+				msg := fmt.Sprintf("%v isn't in this gallery anymore.", filename)
+				g.renderEdit(w, r, gallery, errors.Public(err, msg))
+				return
+			}
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		images = append(images, image)
+	}
+
+	if keepOriginals {
+		_, err = g.GalleryService.CopyImages(images, target.ID)
+	} else {
+		_, err = g.GalleryService.MoveImages(images, target.ID)
+	}
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			g.renderEdit(w, r, gallery, errors.Public(err, "Some of the images were changed in the meantime, nothing was moved or copied."))
+			return
+		}
+		var quotaErr models.QuotaError
+		if errors.As(err, &quotaErr) {
+			msg := fmt.Sprintf("Nothing was moved or copied: %v.", quotaErr.Issue)
+			g.renderEdit(w, r, gallery, errors.Public(err, msg))
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong while moving the images", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// targetGallery looks up the gallery in the target form value, which images of gallery are moved or copied to.
+// If it isn't another gallery of the current user, an error has already been written to w and false is returned.
+func (g Galleries) targetGallery(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) (*models.Gallery, bool) {
+	targetID, err := strconv.Atoi(r.FormValue("target"))
+	if err != nil {
+		http.Error(w, "Invalid gallery", http.StatusBadRequest)
+		return nil, false
+	}
+	target, err := g.GalleryService.ByID(targetID)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return nil, false
+	}
+	user := context.User(r.Context())
+	if target == nil || target.UserID != user.ID || target.ID == gallery.ID {
+		err = fmt.Errorf("invalid target gallery %d", targetID)
+		g.renderEdit(w, r, gallery, errors.Public(err, "Images can only be moved or copied to another one of your galleries."))
+		return nil, false
+	}
+	return target, true
+}
+
+// targetGalleries returns the galleries that images of gallery can be moved or copied to
+func (g Galleries) targetGalleries(gallery *models.Gallery) ([]models.Gallery, error) {
+	galleries, err := g.GalleryService.ByUserID(gallery.UserID)
+	if err != nil {
+		return nil, err
+	}
+	var targets []models.Gallery
+	for _, other := range galleries {
+		if other.ID != gallery.ID {
+			targets = append(targets, other)
+		}
+	}
+	return targets, nil
+}
+
+// handler to process the watermark settings form
+func (g Galleries) UpdateWatermark(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+	err = r.ParseMultipartForm(5 << 20) // 5mb
+	if err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	watermark := models.Watermark{
+		GalleryID: gallery.ID,
+		Text:      strings.TrimSpace(r.FormValue("text")),
+	}
+	watermark.Position, err = models.ParseWatermarkPosition(r.FormValue("position"))
+	if err != nil {
+		http.Error(w, "Invalid watermark position", http.StatusBadRequest)
+		return
+	}
+	opacity, err := strconv.Atoi(r.FormValue("opacity"))
+	if err != nil || opacity < 0 || opacity > 100 {
+		http.Error(w, "Invalid watermark opacity", http.StatusBadRequest)
+		return
+	}
+	scale, err := strconv.Atoi(r.FormValue("scale"))
+	if err != nil || scale < 1 || scale > 100 {
+		http.Error(w, "Invalid watermark scale", http.StatusBadRequest)
+		return
+	}
+	watermark.Opacity = float64(opacity) / 100
+	watermark.Scale = float64(scale) / 100
+
+	// keep the current logo unless a new one is uploaded or the owner asked to remove it
+	current, err := g.GalleryService.Watermark(gallery.ID)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if current != nil && r.FormValue("remove_logo") != "on" {
+		watermark.LogoKey = current.LogoKey
+	}
+	if fileHeaders := r.MultipartForm.File["logo"]; len(fileHeaders) > 0 {
+		file, err := fileHeaders[0].Open()
+		if err != nil {
+			http.Error(w, "Something went wrong while opening file", http.StatusInternalServerError)
+			return
+		}
+		defer file.Close()
+		watermark.LogoKey, err = g.GalleryService.CreateWatermarkLogo(gallery.ID, file)
 		if err != nil {
 			var fileErr models.FileError
 			if errors.As(err, &fileErr) {
-				msg := fmt.Sprintf("%v has an invalid content type or extension.", fileHeader.Filename)
-				http.Error(w, msg, http.StatusBadRequest)
+				msg := fmt.Sprintf("The watermark logo must be a PNG image: %v.", fileErr.Issue)
+				g.renderEdit(w, r, gallery, errors.Public(err, msg))
 				return
 			}
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+	}
 
-			http.Error(w, "Something went wrongg", http.StatusInternalServerError)
+	err = g.GalleryService.SetWatermark(&watermark)
+	if err != nil {
+		var wmErr models.WatermarkError
+		if errors.As(err, &wmErr) {
+			msg := fmt.Sprintf("Your watermark wasn't saved: %v.", wmErr.Issue)
+			g.renderEdit(w, r, gallery, errors.Public(err, msg))
 			return
 		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
 	}
 	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
 	http.Redirect(w, r, editPath, http.StatusFound)
+}
 
+// handler for removing the watermark of a gallery
+func (g Galleries) DeleteWatermark(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+	err = g.GalleryService.DeleteWatermark(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// handler for taking away the access of a member to a gallery
+func (g Galleries) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	err = g.GalleryService.RemoveMember(gallery.ID, userID)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Member not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// handler to render the possible duplicate images inside a single gallery
+func (g Galleries) GalleryDuplicates(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	groups, err := g.GalleryService.GalleryDuplicates(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	g.renderDuplicates(w, r, gallery.Title, groups)
+}
+
+// handler to render the possible duplicate images across all of the current user's galleries
+func (g Galleries) UserDuplicates(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	groups, err := g.GalleryService.UserDuplicates(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	g.renderDuplicates(w, r, "", groups)
+}
+
+func (g Galleries) renderDuplicates(w http.ResponseWriter, r *http.Request, galleryTitle string, groups []models.DuplicateGroup) {
+	type Image struct {
+		GalleryID       int
+		Filename        string
+		FilenameEscaped string
+		Size            int64
+	}
+	type Group struct {
+		Exact  bool
+		Images []Image
+	}
+
+	var data struct {
+		// GalleryTitle is empty when showing the duplicates across all galleries
+		GalleryTitle string
+		Groups       []Group
+	}
+	data.GalleryTitle = galleryTitle
+
+	for _, group := range groups {
+		dataGroup := Group{Exact: group.Exact}
+		for _, image := range group.Images {
+			dataGroup.Images = append(dataGroup.Images, Image{
+				GalleryID:       image.GalleryID,
+				Filename:        image.Filename,
+				FilenameEscaped: url.PathEscape(image.Filename),
+				Size:            image.Size,
+			})
+		}
+		data.Groups = append(data.Groups, dataGroup)
+	}
+
+	g.Templates.Duplicates.Execute(w, r, data)
 }
 
 // handler function for deleting a image
@@ -314,19 +1125,91 @@ func (g Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// placeholderStyle returns the inline CSS that shows a blurred preview of an image until it is loaded.
+// The BlurHash is rendered to a tiny PNG that the browser scales up, so no JavaScript is needed.
+func placeholderStyle(image models.Image) template.CSS {
+	if image.DominantColor == "" {
+		return ""
+	}
+	style := "background-color: " + image.DominantColor + ";"
+
+	if image.BlurHash != "" && image.Width > 0 && image.Height > 0 {
+		const width = 16
+		height := image.Height * width / image.Width
+		if height < 1 {
+			height = 1
+		}
+		if height > 4*width {
+			height = 4 * width
+		}
+		uri := placeholderURI(image.BlurHash, width, height)
+		if uri != "" {
+			style += " background-image: url(" + uri + "); background-size: cover;"
+		}
+	}
+	return template.CSS(style)
+}
+
+// maxPlaceholders is how many rendered placeholders are kept in memory. They
+// are a few hundred bytes each.
+const maxPlaceholders = 10000
+
+// placeholders caches the data URIs of rendered BlurHashes, as a page can
+// show hundreds of images and they hardly ever change
+var placeholders = newLRUCache(maxPlaceholders)
+
+// placeholderURI returns the BlurHash rendered at width x height as a PNG data
+// URI, or an empty string if the hash can't be decoded
+func placeholderURI(hash string, width, height int) string {
+	key := fmt.Sprintf("%dx%d:%s", width, height, hash)
+	uri, ok := placeholders.get(key)
+	if ok {
+		return uri
+	}
+
+	img, err := models.BlurHashImage(hash, width, height)
+	if err == nil {
+		var buf bytes.Buffer
+		err = png.Encode(&buf, img)
+		if err == nil {
+			uri = "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+		}
+	}
+
+	placeholders.add(key, uri)
+	return uri
+}
+
 type galleryOpt func(http.ResponseWriter, *http.Request, *models.Gallery) error
 
 // helper function to get the ID from the URL param, and then lookup the gallery.
 // returns the gallery and the error
 func (g Galleries) galleryByID(w http.ResponseWriter, r *http.Request, opts ...galleryOpt) (*models.Gallery, error) {
-	// get the gallery id from the url query parameter
-	id, err := strconv.Atoi(chi.URLParam(r, "id"))
-	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusNotFound)
-		return nil, err
+	var gallery *models.Gallery
+	var err error
+	username := chi.URLParam(r, "username")
+	// renamed is set when the gallery was found by one of its old slugs
+	renamed := false
+	if username != "" {
+		// vanity URLs like /u/{username}/{gallery}
+		ref := chi.URLParam(r, "gallery")
+		gallery, err = g.GalleryService.ByUsername(username, ref)
+		if errors.Is(err, models.ErrNotFound) {
+			// links with the old slug of a gallery have to keep working
+			gallery, err = g.GalleryService.RenamedGallery(username, ref)
+			renamed = err == nil
+		}
+	} else {
+		// get the gallery id from the url query parameter
+		var id int
+		id, err = strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusNotFound)
+			return nil, err
+		}
+		// query for the gallery with the valid id
+		gallery, err = g.GalleryService.ByID(id)
 	}
-	// query for the gallery with the valid id
-	gallery, err := g.GalleryService.ByID(id)
 	if err != nil {
 		if errors.Is(err, models.ErrNotFound) {
 			http.Error(w, "Gallery not found", http.StatusNotFound)
@@ -345,6 +1228,16 @@ func (g Galleries) galleryByID(w http.ResponseWriter, r *http.Request, opts ...g
 		}
 	}
 
+	// the options run first, so that the redirect doesn't give away private galleries
+	if renamed {
+		galleryPath := fmt.Sprintf("/u/%s/%s", url.PathEscape(username), gallery.Slug)
+		if r.URL.RawQuery != "" {
+			galleryPath += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, galleryPath, http.StatusMovedPermanently)
+		return nil, fmt.Errorf("gallery was renamed to %v", gallery.Slug)
+	}
+
 	return gallery, nil
 }
 
@@ -357,3 +1250,41 @@ func userMustOwnGallery(w http.ResponseWriter, r *http.Request, gallery *models.
 
 	return nil
 }
+
+// userCanViewGallery only lets the owner and members of a private gallery view it. Everyone else gets a 404 so that we don't leak which private galleries exist.
+func (g Galleries) userCanViewGallery(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+	if gallery.Visibility != models.VisibilityPrivate {
+		return nil
+	}
+	user := context.User(r.Context())
+	if user != nil && gallery.UserID == user.ID {
+		return nil
+	}
+	view, err := g.viewAs(r, *gallery)
+	if err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return err
+	}
+	if view.Visibility == models.VisibilityPrivate {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return fmt.Errorf("user doesn't have access to this private gallery")
+	}
+	return nil
+}
+
+// viewAs returns the gallery as the signed in user gets to see it. Members see a private gallery like an unlisted one,
+// so that they can view its images but not those that are private on their own.
+func (g Galleries) viewAs(r *http.Request, gallery models.Gallery) (models.Gallery, error) {
+	user := context.User(r.Context())
+	if gallery.Visibility != models.VisibilityPrivate || user == nil || user.ID == gallery.UserID {
+		return gallery, nil
+	}
+	isMember, err := g.GalleryService.IsMember(gallery.ID, user.ID)
+	if err != nil {
+		return gallery, err
+	}
+	if isMember {
+		gallery.Visibility = models.VisibilityUnlisted
+	}
+	return gallery, nil
+}
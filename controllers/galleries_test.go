@@ -0,0 +1,30 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ayushthe1/lenspix/models"
+)
+
+func TestPlaceholderStyle(t *testing.T) {
+	image := models.Image{
+		BlurHash:      "LEHV6nWB2yk8pyo0adR*.7kCMdnj",
+		DominantColor: "#a0b0c0",
+		Width:         400,
+		Height:        300,
+	}
+	style := string(placeholderStyle(image))
+	if !strings.HasPrefix(style, "background-color: #a0b0c0; background-image: url(data:image/png;base64,") {
+		t.Fatalf("style %q, want the colour and a PNG", style)
+	}
+	// the second time it comes from the cache
+	if again := string(placeholderStyle(image)); again != style {
+		t.Errorf("style %q, want %q", again, style)
+	}
+
+	image.BlurHash = "invalid"
+	if style := string(placeholderStyle(image)); style != "background-color: #a0b0c0;" {
+		t.Errorf("style %q with an invalid hash, want only the colour", style)
+	}
+}
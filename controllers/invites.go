@@ -0,0 +1,140 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/ayushthe1/lenspix/context"
+	"github.com/ayushthe1/lenspix/errors"
+	"github.com/ayushthe1/lenspix/models"
+	"github.com/go-chi/chi/v5"
+)
+
+type Invites struct {
+	Templates struct {
+		// Index template lists the invites of the signed in user and lets them create new ones
+		Index Template
+	}
+	InviteService  *models.InviteService
+	GalleryService *models.GalleryService
+}
+
+// handler to render the invites of the signed in user
+func (i Invites) Index(w http.ResponseWriter, r *http.Request) {
+	i.render(w, r, "")
+}
+
+// render renders the invites page. link is the sign up link of an invite that was just created, which can't be shown
+// again later because only the hash of its code is stored.
+func (i Invites) render(w http.ResponseWriter, r *http.Request, link string, errs ...error) {
+	type Gallery struct {
+		ID    int
+		Title string
+	}
+
+	var data struct {
+		Link    string
+		Invites []models.Invite
+		// Galleries are the galleries that invites can be made for
+		Galleries []Gallery
+	}
+	data.Link = link
+
+	user := context.User(r.Context())
+	invites, err := i.InviteService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Invites = invites
+	galleries, err := i.GalleryService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, gallery := range galleries {
+		data.Galleries = append(data.Galleries, Gallery{
+			ID:    gallery.ID,
+			Title: gallery.Title,
+		})
+	}
+	i.Templates.Index.Execute(w, r, data, errs...)
+}
+
+// handler to create an invite. The sign up link with its code is shown once on the invites page.
+func (i Invites) Create(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	invite := models.Invite{
+		CreatedBy: user.ID,
+	}
+	var err error
+	invite.MaxUses, err = strconv.Atoi(r.FormValue("max_uses"))
+	if err != nil {
+		err = errors.Public(err, "Please enter how many times the invite can be used.")
+		i.render(w, r, "", err)
+		return
+	}
+	// expires_in is the number of days the invite is valid for, invites without one don't expire
+	if days := r.FormValue("expires_in"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			err = errors.Public(err, "Please pick when the invite expires.")
+			i.render(w, r, "", err)
+			return
+		}
+		expiresAt := time.Now().Add(time.Duration(n) * 24 * time.Hour)
+		invite.ExpiresAt = &expiresAt
+	}
+	if galleryID := r.FormValue("gallery_id"); galleryID != "" {
+		id, err := strconv.Atoi(galleryID)
+		if err != nil {
+			http.Error(w, "Invalid gallery", http.StatusBadRequest)
+			return
+		}
+		invite.GalleryID = &id
+	}
+
+	err = i.InviteService.Create(&invite)
+	if err != nil {
+		var inviteErr models.InviteError
+		if errors.As(err, &inviteErr) {
+			err = errors.Public(err, fmt.Sprintf("The invite wasn't created: %v.", inviteErr.Issue))
+			i.render(w, r, "", err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	vals := url.Values{
+		"invite": {invite.Code},
+	}
+	i.render(w, r, "https://www.lenspix.com/signup?"+vals.Encode())
+}
+
+// handler to delete an invite of the signed in user
+func (i Invites) Delete(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	user := context.User(r.Context())
+	err = i.InviteService.Delete(user.ID, id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Invite not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me/invites", http.StatusFound)
+}
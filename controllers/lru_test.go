@@ -0,0 +1,31 @@
+package controllers
+
+import "testing"
+
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache(2)
+	c.add("a", "1")
+	c.add("b", "2")
+	if v, ok := c.get("a"); !ok || v != "1" {
+		t.Fatalf("get(a) = %q, %v, want 1, true", v, ok)
+	}
+	// b was used longest ago, so it makes room for c
+	c.add("c", "3")
+	if _, ok := c.get("b"); ok {
+		t.Error("b is still cached")
+	}
+	for key, want := range map[string]string{"a": "1", "c": "3"} {
+		if v, ok := c.get(key); !ok || v != want {
+			t.Errorf("get(%v) = %q, %v, want %v, true", key, v, ok, want)
+		}
+	}
+
+	// replacing a value doesn't take more room
+	c.add("a", "4")
+	if v, _ := c.get("a"); v != "4" {
+		t.Errorf("get(a) = %q, want 4", v)
+	}
+	if _, ok := c.get("c"); !ok {
+		t.Error("c was evicted when a was replaced")
+	}
+}
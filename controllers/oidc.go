@@ -0,0 +1,141 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/ayushthe1/lenspix/errors"
+	"github.com/ayushthe1/lenspix/models"
+	"github.com/ayushthe1/lenspix/oidc"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// CookieOIDCFlow keeps the secrets of a sign in with an identity provider until the provider sends the user back
+	CookieOIDCFlow = "oidc_flow"
+)
+
+// handler to start signing in with an identity provider. The user is sent to the provider, which sends them back to
+// OIDCCallback.
+func (u Users) OIDCSignIn(w http.ResponseWriter, r *http.Request) {
+	provider, ok := u.oidcProvider(w, r)
+	if !ok {
+		return
+	}
+	flow, err := oidc.NewAuthFlow()
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	authURL, err := provider.AuthCodeURL(r.Context(), flow)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	// the secrets are only needed until the user is back, which shouldn't take long
+	cookie := newCookie(CookieOIDCFlow, strings.Join([]string{provider.ID, flow.State, flow.Nonce, flow.Verifier}, "."))
+	cookie.MaxAge = 10 * 60
+	cookie.SameSite = http.SameSiteLaxMode
+	http.SetCookie(w, cookie)
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// handler for the identity provider sending the user back. The identity is linked to an account, which is created if
+// needed, and the user is signed in to it.
+func (u Users) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := u.oidcProvider(w, r)
+	if !ok {
+		return
+	}
+	// the flow can only be finished once
+	value, _ := readCookie(r, CookieOIDCFlow)
+	deleteCookie(w, CookieOIDCFlow)
+	parts := strings.Split(value, ".")
+	if len(parts) != 4 || parts[0] != provider.ID ||
+		subtle.ConstantTimeCompare([]byte(parts[1]), []byte(r.FormValue("state"))) != 1 {
+		err := fmt.Errorf("oidc callback: state doesn't match")
+		u.Templates.SignIn.Execute(w, r, u.signInData(""), errors.Public(err, "Your sign in has expired, please try again."))
+		return
+	}
+	flow := oidc.AuthFlow{State: parts[1], Nonce: parts[2], Verifier: parts[3]}
+	if code := r.FormValue("error"); code != "" {
+		err := fmt.Errorf("oidc callback: %v: %v", code, r.FormValue("error_description"))
+		msg := fmt.Sprintf("You weren't signed in with %v.", provider.Name)
+		u.Templates.SignIn.Execute(w, r, u.signInData(""), errors.Public(err, msg))
+		return
+	}
+
+	claims, err := provider.Exchange(r.Context(), r.FormValue("code"), flow)
+	if err != nil {
+		fmt.Println(err)
+		msg := fmt.Sprintf("Something went wrong while signing in with %v, please try again.", provider.Name)
+		u.Templates.SignIn.Execute(w, r, u.signInData(""), errors.Public(err, msg))
+		return
+	}
+	user, err := u.IdentityService.SignIn(provider.ID, claims.Subject, claims.Email, claims.EmailVerified)
+	if err != nil {
+		if errors.Is(err, models.ErrEmailUnverified) {
+			msg := fmt.Sprintf("%v didn't confirm your email address, so we can't sign you in with it.", provider.Name)
+			u.Templates.SignIn.Execute(w, r, u.signInData(""), errors.Public(err, msg))
+			return
+		}
+		if errors.Is(err, models.ErrSignUpClosed) {
+			msg := fmt.Sprintf("There is no account for your %v email address yet, and new ones can't be created with it.", provider.Name)
+			u.Templates.SignIn.Execute(w, r, u.signInData(""), errors.Public(err, msg))
+			return
+		}
+		if errors.Is(err, models.ErrAccountSuspended) {
+			err = errors.Public(err, "Your account has been suspended, please contact support.")
+			u.Templates.SignIn.Execute(w, r, u.signInData(""), err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	session, err := u.SessionService.Create(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	setCookie(w, CookieSession, session.Token)
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
+// signInData is what the sign in page is rendered with
+type signInData struct {
+	Email string
+	// Providers are the identity providers that users can sign in with, sorted by name
+	Providers []*oidc.Provider
+}
+
+func (u Users) signInData(email string) signInData {
+	data := signInData{
+		Email: email,
+	}
+	for _, provider := range u.OIDCProviders {
+		data.Providers = append(data.Providers, provider)
+	}
+	sort.Slice(data.Providers, func(i, j int) bool {
+		return data.Providers[i].Name < data.Providers[j].Name
+	})
+	return data
+}
+
+// oidcProvider looks up the identity provider from the URL, and writes a 404 if there is none
+func (u Users) oidcProvider(w http.ResponseWriter, r *http.Request) (*oidc.Provider, bool) {
+	provider, ok := u.OIDCProviders[chi.URLParam(r, "provider")]
+	if !ok {
+		http.Error(w, "Unknown identity provider", http.StatusNotFound)
+		return nil, false
+	}
+	return provider, true
+}
@@ -0,0 +1,186 @@
+package controllers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ayushthe1/lenspix/migrations"
+	"github.com/ayushthe1/lenspix/models"
+	"github.com/ayushthe1/lenspix/oidc"
+	"github.com/ayushthe1/lenspix/oidc/oidctest"
+	"github.com/go-chi/chi/v5"
+)
+
+// testTemplate records how it was executed
+type testTemplate struct {
+	executed bool
+	errs     []error
+}
+
+func (tpl *testTemplate) Execute(w http.ResponseWriter, r *http.Request, data interface{}, errs ...error) {
+	tpl.executed = true
+	tpl.errs = errs
+}
+
+// testDB opens the database named by LENSPIX_TEST_DB and migrates it. Tests
+// that need it are skipped when it isn't set.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("LENSPIX_TEST_DB")
+	if dsn == "" {
+		t.Skip("LENSPIX_TEST_DB isn't set to a Postgres connection string")
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = models.MigrateFS(db, migrations.FS, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// oidcTest is a sign in with a test identity provider
+type oidcTest struct {
+	server *oidctest.Server
+	users  Users
+	signIn *testTemplate
+	router chi.Router
+}
+
+func newOIDCTest(t *testing.T, db *sql.DB) *oidcTest {
+	t.Helper()
+	server, err := oidctest.NewServer("lenspix", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+
+	test := &oidcTest{
+		server: server,
+		signIn: &testTemplate{},
+	}
+	test.users.Templates.SignIn = test.signIn
+	test.users.SessionService = &models.SessionService{DB: db}
+	test.users.IdentityService = &models.IdentityService{DB: db}
+	test.users.OIDCProviders = map[string]*oidc.Provider{
+		"test": server.Provider("test", "https://lenspix.test/oauth/test/callback"),
+	}
+	test.router = chi.NewRouter()
+	test.router.Get("/oauth/{provider}/signin", test.users.OIDCSignIn)
+	test.router.Get("/oauth/{provider}/callback", test.users.OIDCCallback)
+	return test
+}
+
+// start starts a sign in and returns the flow cookie and the query that the provider sends the user back with
+func (test *oidcTest) start(t *testing.T) (*http.Cookie, url.Values) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	test.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/oauth/test/signin", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("sign in: status %v, want %v", rec.Code, http.StatusFound)
+	}
+	var flowCookie *http.Cookie
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == CookieOIDCFlow {
+			flowCookie = cookie
+		}
+	}
+	if flowCookie == nil {
+		t.Fatal("sign in: no flow cookie")
+	}
+
+	client := *test.server.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Get(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return flowCookie, back.Query()
+}
+
+// callback sends the user back from the provider
+func (test *oidcTest) callback(flowCookie *http.Cookie, query url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/oauth/test/callback?"+query.Encode(), nil)
+	req.AddCookie(flowCookie)
+	rec := httptest.NewRecorder()
+	test.router.ServeHTTP(rec, req)
+	return rec
+}
+
+func sessionCookie(rec *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == CookieSession && cookie.MaxAge >= 0 {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestOIDCCallbackStateMismatch(t *testing.T) {
+	// the state is checked before anything is looked up, so no database is needed
+	test := newOIDCTest(t, nil)
+	flowCookie, query := test.start(t)
+	query.Set("state", "forged")
+	rec := test.callback(flowCookie, query)
+	if !test.signIn.executed || len(test.signIn.errs) == 0 {
+		t.Fatal("the sign in page wasn't shown with an error")
+	}
+	if !strings.Contains(test.signIn.errs[0].Error(), "state doesn't match") {
+		t.Errorf("error %q, want one about the state", test.signIn.errs[0])
+	}
+	if sessionCookie(rec) != nil {
+		t.Error("a session was created")
+	}
+}
+
+func TestOIDCCallback(t *testing.T) {
+	db := testDB(t)
+	test := newOIDCTest(t, db)
+	// a new user on every run, so that the database can be reused
+	id := time.Now().UnixNano()
+	test.server.User.Subject = fmt.Sprint(id)
+	test.server.User.Email = fmt.Sprintf("oidc-%d@example.com", id)
+
+	flowCookie, query := test.start(t)
+	rec := test.callback(flowCookie, query)
+	if test.signIn.executed {
+		t.Fatalf("the sign in page was shown with %v", test.signIn.errs)
+	}
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/galleries" {
+		t.Fatalf("status %v to %q, want %v to /galleries", rec.Code, rec.Header().Get("Location"), http.StatusFound)
+	}
+	cookie := sessionCookie(rec)
+	if cookie == nil {
+		t.Fatal("no session cookie")
+	}
+	user, err := test.users.SessionService.User(cookie.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != test.server.User.Email {
+		t.Errorf("signed in as %v, want %v", user.Email, test.server.User.Email)
+	}
+
+	// the code can only be exchanged once
+	rec = test.callback(flowCookie, query)
+	if sessionCookie(rec) != nil {
+		t.Error("the code was exchanged twice")
+	}
+}
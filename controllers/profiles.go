@@ -0,0 +1,134 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/ayushthe1/lenspix/errors"
+	"github.com/ayushthe1/lenspix/models"
+	"github.com/go-chi/chi/v5"
+)
+
+type Profiles struct {
+	Templates struct {
+		// Show template is the public profile page of a user
+		Show Template
+	}
+	ProfileService *models.ProfileService
+	GalleryService *models.GalleryService
+}
+
+// handler to render the public profile of a user, with their public galleries
+func (p Profiles) Show(w http.ResponseWriter, r *http.Request) {
+	profile, ok := p.profileByUsername(w, r)
+	if !ok {
+		return
+	}
+
+	type Cover struct {
+		GalleryID       int
+		FilenameEscaped string
+		Version         string
+	}
+
+	type Gallery struct {
+		ID    int
+		Title string
+		Slug  string
+		// Cover is the first image of the gallery, if it has any that are listed
+		Cover *Cover
+	}
+
+	var data struct {
+		Username      string
+		Name          string
+		Bio           string
+		Website       string
+		HasAvatar     bool
+		AvatarVersion string
+		Galleries     []Gallery
+	}
+	data.Username = profile.Username
+	data.Name = profile.Name()
+	data.Bio = profile.Bio
+	data.Website = profile.Website
+	data.HasAvatar = profile.AvatarKey != ""
+	data.AvatarVersion = profile.AvatarVersion()
+
+	galleries, err := p.GalleryService.PublicByUserID(profile.UserID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, gallery := range galleries {
+		images, err := p.GalleryService.Images(gallery.ID)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		entry := Gallery{
+			ID:    gallery.ID,
+			Title: gallery.Title,
+			Slug:  gallery.Slug,
+		}
+		for _, image := range images {
+			if !image.ListedIn(gallery) {
+				continue
+			}
+			entry.Cover = &Cover{
+				GalleryID:       image.GalleryID,
+				FilenameEscaped: url.PathEscape(image.Filename),
+				Version:         image.Version(),
+			}
+			break
+		}
+		data.Galleries = append(data.Galleries, entry)
+	}
+
+	p.Templates.Show.Execute(w, r, data)
+}
+
+// handler to serve the avatar of a user. The URL carries the version of the avatar, so it can be cached for long.
+func (p Profiles) Avatar(w http.ResponseWriter, r *http.Request) {
+	profile, ok := p.profileByUsername(w, r)
+	if !ok {
+		return
+	}
+	obj, err := p.ProfileService.OpenAvatar(*profile)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Avatar not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	defer obj.Close()
+
+	if r.FormValue("v") == profile.AvatarVersion() {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "public, no-cache")
+	}
+	w.Header().Set("ETag", fmt.Sprintf("%q", profile.AvatarVersion()))
+	http.ServeContent(w, r, profile.AvatarKey, obj.ModTime, obj)
+}
+
+// profileByUsername looks up the profile from the username in the URL, and writes a 404 if there is none
+func (p Profiles) profileByUsername(w http.ResponseWriter, r *http.Request) (*models.Profile, bool) {
+	profile, err := p.ProfileService.ByUsername(chi.URLParam(r, "username"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return nil, false
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return nil, false
+	}
+	return profile, true
+}
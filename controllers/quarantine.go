@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/ayushthe1/lenspix/errors"
+	"github.com/ayushthe1/lenspix/models"
+	"github.com/go-chi/chi/v5"
+)
+
+// handler to list the uploads that couldn't be scanned, and that wait for an admin to release or delete them
+func (a Admin) Quarantine(w http.ResponseWriter, r *http.Request) {
+	a.renderQuarantine(w, r, "")
+}
+
+// renderQuarantine renders the quarantined uploads with an optional notice about a change that was made
+func (a Admin) renderQuarantine(w http.ResponseWriter, r *http.Request, notice string, errs ...error) {
+	type Upload struct {
+		ID        int
+		GalleryID int
+		Filename  string
+		Size      string
+		Reason    string
+		CreatedAt string
+	}
+	var data struct {
+		Notice  string
+		Uploads []Upload
+	}
+	data.Notice = notice
+	uploads, err := a.GalleryService.Quarantined()
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, upload := range uploads {
+		data.Uploads = append(data.Uploads, Upload{
+			ID:        upload.ID,
+			GalleryID: upload.GalleryID,
+			Filename:  upload.Filename,
+			Size:      models.FormatBytes(upload.Size),
+			Reason:    upload.Reason,
+			CreatedAt: upload.CreatedAt.Format("January 2, 2006 15:04"),
+		})
+	}
+	a.Templates.Quarantine.Execute(w, r, data, errs...)
+}
+
+// handler to download the file of a quarantined upload, so that an admin can inspect it. It is always sent as an
+// attachment and never as the content type it claims to be, as it might not be safe to open in the browser.
+func (a Admin) DownloadQuarantined(w http.ResponseWriter, r *http.Request) {
+	upload, ok := a.quarantined(w, r)
+	if !ok {
+		return
+	}
+	obj, err := a.GalleryService.OpenQuarantined(*upload)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	defer obj.Close()
+
+	// the filename was picked by the uploader, so it isn't used in the header
+	filename := fmt.Sprintf("quarantined-%d%s", upload.ID, path.Ext(upload.Key))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, no-store")
+	http.ServeContent(w, r, filename, obj.ModTime, obj)
+}
+
+// handler to add a quarantined upload to its gallery without scanning it again
+func (a Admin) ReleaseQuarantined(w http.ResponseWriter, r *http.Request) {
+	upload, ok := a.quarantined(w, r)
+	if !ok {
+		return
+	}
+	image, err := a.GalleryService.ReleaseQuarantined(upload.ID)
+	if err != nil {
+		var fileErr models.FileError
+		var quotaErr models.QuotaError
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			http.Error(w, "Upload not found", http.StatusNotFound)
+		case errors.Is(err, models.ErrDuplicateImage):
+			msg := fmt.Sprintf("%v wasn't released: an identical image is already in the gallery.", upload.Filename)
+			a.renderQuarantine(w, r, "", errors.Public(err, msg))
+		case errors.As(err, &fileErr):
+			msg := fmt.Sprintf("%v wasn't released: %v.", upload.Filename, fileErr.Issue)
+			a.renderQuarantine(w, r, "", errors.Public(err, msg))
+		case errors.As(err, &quotaErr):
+			msg := fmt.Sprintf("%v wasn't released: %v.", upload.Filename, quotaErr.Issue)
+			a.renderQuarantine(w, r, "", errors.Public(err, msg))
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	a.renderQuarantine(w, r, fmt.Sprintf("%v was added to gallery %d.", image.Filename, image.GalleryID))
+}
+
+// handler to delete a quarantined upload for good
+func (a Admin) DeleteQuarantined(w http.ResponseWriter, r *http.Request) {
+	upload, ok := a.quarantined(w, r)
+	if !ok {
+		return
+	}
+	err := a.GalleryService.DeleteQuarantined(upload.ID)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Upload not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	a.renderQuarantine(w, r, fmt.Sprintf("%v was deleted.", upload.Filename))
+}
+
+// quarantined looks up the quarantined upload from the URL, and writes a 404 if there is none
+func (a Admin) quarantined(w http.ResponseWriter, r *http.Request) (*models.QuarantinedUpload, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return nil, false
+	}
+	upload, err := a.GalleryService.QuarantinedByID(id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Upload not found", http.StatusNotFound)
+			return nil, false
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return nil, false
+	}
+	return upload, true
+}
@@ -0,0 +1,386 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ayushthe1/lenspix/context"
+	"github.com/ayushthe1/lenspix/errors"
+	"github.com/ayushthe1/lenspix/models"
+	"github.com/go-chi/chi/v5"
+)
+
+// handler to render the account settings page
+func (u Users) Settings(w http.ResponseWriter, r *http.Request) {
+	u.renderSettings(w, r, "")
+}
+
+// renderSettings renders the account settings page with an optional notice about a change that was made
+func (u Users) renderSettings(w http.ResponseWriter, r *http.Request, notice string, errs ...error) {
+	var data struct {
+		Email  string
+		Notice string
+		// HasPassword is false for users that only signed in with an identity provider so far. They have to set a
+		// password before they can change their email address or delete their account.
+		HasPassword bool
+		// DeleteAt is when the account will be deleted, if the user asked for it
+		DeleteAt *time.Time
+		// Export is the latest data export of the user, if there is one
+		Export *models.Export
+		// Profile is what is shown on the public profile page of the user
+		Profile *models.Profile
+	}
+	user := context.User(r.Context())
+	data.Email = user.Email
+	data.Notice = notice
+	data.HasPassword = user.HasPassword()
+	deleteAt, err := u.UserService.ScheduledDeletion(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.DeleteAt = deleteAt
+	data.Export, err = u.ExportService.Latest(user.ID)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Profile, err = u.ProfileService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	u.Templates.Settings.Execute(w, r, data, errs...)
+}
+
+// handler to update the public profile of the signed in user. The form is multipart so that a new avatar can be
+// uploaded along with the other fields.
+func (u Users) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	err := r.ParseMultipartForm(5 << 20) // 5mb
+	if err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	profile := models.Profile{
+		UserID:      user.ID,
+		Username:    r.FormValue("username"),
+		DisplayName: r.FormValue("display_name"),
+		Bio:         r.FormValue("bio"),
+		Website:     r.FormValue("website"),
+	}
+	err = u.ProfileService.Update(&profile)
+	if err != nil {
+		var profileErr models.ProfileError
+		switch {
+		case errors.Is(err, models.ErrUsernameTaken):
+			u.renderSettings(w, r, "", errors.Public(err, "That username is already taken."))
+		case errors.As(err, &profileErr):
+			u.renderSettings(w, r, "", errors.Public(err, fmt.Sprintf("Your profile wasn't saved: %v.", profileErr.Issue)))
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if r.FormValue("remove_avatar") != "" {
+		err = u.ProfileService.DeleteAvatar(user.ID)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+	} else if fileHeaders := r.MultipartForm.File["avatar"]; len(fileHeaders) > 0 {
+		file, err := fileHeaders[0].Open()
+		if err != nil {
+			http.Error(w, "Something went wrong while opening file", http.StatusInternalServerError)
+			return
+		}
+		defer file.Close()
+		err = u.ProfileService.SetAvatar(user.ID, file)
+		if err != nil {
+			var fileErr models.FileError
+			if errors.As(err, &fileErr) {
+				u.renderSettings(w, r, "", errors.Public(err, fmt.Sprintf("Your avatar wasn't changed: %v.", fileErr.Issue)))
+				return
+			}
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+	}
+	u.renderSettings(w, r, "Your profile was saved.")
+}
+
+// handler to change the password of the signed in user. The current password has to be given, and the user is
+// signed out on all of their other devices. Users without a password can set one without it, as they signed in with
+// an identity provider, but admins that are signed in as them can't.
+func (u Users) UpdatePassword(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	current := r.FormValue("current_password")
+	password := r.FormValue("password")
+
+	var err error
+	if user.HasPassword() {
+		_, err = u.UserService.Authenticate(user.Email, current)
+		if err != nil {
+			u.renderSettings(w, r, "", errors.Public(err, "Your current password is wrong."))
+			return
+		}
+	} else if user.ImpersonatorID != 0 {
+		err = fmt.Errorf("set password: impersonated by %d", user.ImpersonatorID)
+		u.renderSettings(w, r, "", errors.Public(err, "You can't set a password for a user you are signed in as."))
+		return
+	}
+	if password == "" {
+		err = fmt.Errorf("empty password")
+		u.renderSettings(w, r, "", errors.Public(err, "Please enter a new password."))
+		return
+	}
+
+	err = u.UserService.UpdatePassword(user.ID, password)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	token, _ := readCookie(r, CookieSession)
+	err = u.SessionService.DeleteOthers(user.ID, token)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	// the password is changed either way, so a failed notification isn't reported to the user
+	err = u.EmailService.PasswordChanged(user.Email)
+	if err != nil {
+		fmt.Println(err)
+	}
+	if !user.HasPassword() {
+		u.renderSettings(w, r, "Your password was set, and you were signed out on your other devices.")
+		return
+	}
+	u.renderSettings(w, r, "Your password was changed, and you were signed out on your other devices.")
+}
+
+// requirePassword renders the settings page with an error and returns false if the signed in user has no password to
+// confirm a change with
+func (u Users) requirePassword(w http.ResponseWriter, r *http.Request) bool {
+	user := context.User(r.Context())
+	if user.HasPassword() {
+		return true
+	}
+	err := fmt.Errorf("user %d has no password", user.ID)
+	u.renderSettings(w, r, "", errors.Public(err, "Please set a password first, so that we can make sure it is you."))
+	return false
+}
+
+// handler to start changing the email address of the signed in user. The new address only takes effect once it has
+// been verified with the link that is sent to it.
+func (u Users) UpdateEmail(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	email := strings.ToLower(strings.TrimSpace(r.FormValue("email")))
+	password := r.FormValue("password")
+
+	if !u.requirePassword(w, r) {
+		return
+	}
+	_, err := u.UserService.Authenticate(user.Email, password)
+	if err != nil {
+		u.renderSettings(w, r, "", errors.Public(err, "Your password is wrong."))
+		return
+	}
+	if email == "" || email == user.Email {
+		err = fmt.Errorf("email unchanged")
+		u.renderSettings(w, r, "", errors.Public(err, "Please enter a new email address."))
+		return
+	}
+
+	change, err := u.EmailChangeService.Create(user.ID, email)
+	if err != nil {
+		if errors.Is(err, models.ErrEmailTaken) {
+			u.renderSettings(w, r, "", errors.Public(err, "That email address is already associated with an account."))
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	vals := url.Values{
+		"token": {change.Token},
+	}
+	verifyURL := "https://www.lenspix.com/verify-email?" + vals.Encode()
+	err = u.EmailService.VerifyEmail(change.Email, verifyURL)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	notice := fmt.Sprintf("We sent a link to %v. Your email address will be changed once you have opened it.", change.Email)
+	u.renderSettings(w, r, notice)
+}
+
+// handler to render the form that confirms a new email address. Like the password reset form, the token is taken
+// from the URL so that opening the link alone doesn't change anything.
+func (u Users) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token string
+	}
+	data.Token = r.FormValue("token")
+	u.Templates.VerifyEmail.Execute(w, r, data)
+}
+
+// handler to process the form that confirms a new email address
+func (u Users) ProcessVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token string
+	}
+	data.Token = r.FormValue("token")
+
+	change, err := u.EmailChangeService.Consume(data.Token)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			u.Templates.VerifyEmail.Execute(w, r, data, errors.Public(err, "This link is invalid or has expired."))
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	user, err := u.UserService.ByID(change.UserID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = u.UserService.UpdateEmail(user.ID, change.Email)
+	if err != nil {
+		if errors.Is(err, models.ErrEmailTaken) {
+			err = errors.Public(err, "That email address is already associated with another account.")
+			u.Templates.VerifyEmail.Execute(w, r, data, err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	// keep the session the link was opened in, if it is one of the user's
+	token, _ := readCookie(r, CookieSession)
+	err = u.SessionService.DeleteOthers(user.ID, token)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = u.EmailService.EmailChanged(user.Email, change.Email)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	if current := context.User(r.Context()); current != nil && current.ID == user.ID {
+		http.Redirect(w, r, "/users/me/settings", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/signin?"+url.Values{"email": {change.Email}}.Encode(), http.StatusFound)
+}
+
+// handler to delete the account of the signed in user. The password has to be given, and the account is only deleted
+// once the grace period is over, so that the user can still cancel it.
+func (u Users) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if !u.requirePassword(w, r) {
+		return
+	}
+	_, err := u.UserService.Authenticate(user.Email, r.FormValue("password"))
+	if err != nil {
+		u.renderSettings(w, r, "", errors.Public(err, "Your password is wrong."))
+		return
+	}
+
+	deleteAt, err := u.UserService.ScheduleDeletion(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	token, _ := readCookie(r, CookieSession)
+	err = u.SessionService.DeleteOthers(user.ID, token)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = u.EmailService.AccountDeletionScheduled(user.Email, deleteAt)
+	if err != nil {
+		fmt.Println(err)
+	}
+	u.renderSettings(w, r, "Your account will be deleted. You can still cancel this until then.")
+}
+
+// handler to keep the account of the signed in user after all
+func (u Users) CancelAccountDeletion(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	err := u.UserService.CancelDeletion(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	u.renderSettings(w, r, "Your account won't be deleted.")
+}
+
+// handler to ask for an archive with all of the data of the signed in user. The archive is built in the background
+// and the user gets an email with a link to download it once it is ready.
+func (u Users) RequestExport(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	_, err := u.ExportService.Request(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	u.renderSettings(w, r, "We are putting together your data, you will get an email with a download link once it is ready.")
+}
+
+// handler to download the archive of a data export, with the token from the link in the email
+func (u Users) DownloadExport(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	export, err := u.ExportService.ByToken(user.ID, id, r.FormValue("token"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "This download link is invalid or has expired", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	obj, err := u.ExportService.Open(*export)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	defer obj.Close()
+
+	filename := fmt.Sprintf("lenspix-%s.zip", export.CreatedAt.Format("2006-01-02"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.Header().Set("Cache-Control", "private, no-store")
+	http.ServeContent(w, r, filename, obj.ModTime, obj)
+}
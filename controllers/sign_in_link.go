@@ -0,0 +1,89 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ayushthe1/lenspix/errors"
+	"github.com/ayushthe1/lenspix/models"
+)
+
+// handler to email a link that signs the user in without their password. The page is the same whether or not there
+// is an account with the address, so that it can't be used to find out who has one.
+func (u Users) SendSignInLink(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Email      string
+		SignInLink bool
+	}
+	data.Email = strings.TrimSpace(r.FormValue("email"))
+	data.SignInLink = true
+
+	link, err := u.SignInLinkService.Create(data.Email)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			u.Templates.CheckYourEmail.Execute(w, r, data)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	vals := url.Values{
+		"token": {link.Token},
+	}
+	signInURL := "https://www.lenspix.com/signin/link?" + vals.Encode()
+	err = u.EmailService.SignInLink(data.Email, signInURL)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	u.Templates.CheckYourEmail.Execute(w, r, data)
+}
+
+// handler to render the page that signs the user in with the link from their email. Like the password reset form,
+// the token is only used once the form is submitted, so that mail scanners opening the link don't use it up.
+func (u Users) SignInWithLink(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token string
+	}
+	data.Token = r.FormValue("token")
+	u.Templates.SignInLink.Execute(w, r, data)
+}
+
+// handler to sign the user in with the token of a sign in link
+func (u Users) ProcessSignInWithLink(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token string
+	}
+	data.Token = r.FormValue("token")
+
+	user, err := u.SignInLinkService.Consume(data.Token)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			err = errors.Public(err, "This link is invalid or has expired, please ask for a new one.")
+			u.Templates.SignIn.Execute(w, r, u.signInData(""), err)
+			return
+		}
+		if errors.Is(err, models.ErrAccountSuspended) {
+			err = errors.Public(err, "Your account has been suspended, please contact support.")
+			u.Templates.SignIn.Execute(w, r, u.signInData(""), err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	session, err := u.SessionService.Create(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	setCookie(w, CookieSession, session.Token)
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
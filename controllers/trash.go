@@ -0,0 +1,168 @@
+package controllers
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ayushthe1/lenspix/context"
+	"github.com/ayushthe1/lenspix/errors"
+	"github.com/ayushthe1/lenspix/models"
+	"github.com/go-chi/chi/v5"
+)
+
+// handler to show the galleries and images the user has moved to the trash
+func (g Galleries) Trash(w http.ResponseWriter, r *http.Request) {
+	type Gallery struct {
+		ID        int
+		Title     string
+		DeletedAt time.Time
+		PurgeAt   time.Time
+	}
+	type Image struct {
+		ID           int
+		Filename     string
+		GalleryTitle string
+		Placeholder  template.CSS
+		DeletedAt    time.Time
+		PurgeAt      time.Time
+	}
+	var data struct {
+		Galleries []Gallery
+		Images    []Image
+	}
+
+	user := context.User(r.Context())
+	galleries, err := g.GalleryService.TrashedGalleries(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, gallery := range galleries {
+		data.Galleries = append(data.Galleries, Gallery{
+			ID:        gallery.ID,
+			Title:     gallery.Title,
+			DeletedAt: *gallery.DeletedAt,
+			PurgeAt:   gallery.DeletedAt.Add(g.trashRetention()),
+		})
+	}
+
+	images, err := g.GalleryService.TrashedImages(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	// trashed images only ever belong to galleries that aren't in the trash
+	owned, err := g.GalleryService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	titles := make(map[int]string)
+	for _, gallery := range owned {
+		titles[gallery.ID] = gallery.Title
+	}
+	for _, image := range images {
+		data.Images = append(data.Images, Image{
+			ID:           image.ID,
+			Filename:     image.Filename,
+			GalleryTitle: titles[image.GalleryID],
+			Placeholder:  placeholderStyle(image),
+			DeletedAt:    *image.DeletedAt,
+			PurgeAt:      image.DeletedAt.Add(g.trashRetention()),
+		})
+	}
+
+	g.Templates.Trash.Execute(w, r, data)
+}
+
+// handler to take a gallery out of the trash
+func (g Galleries) RestoreTrashedGallery(w http.ResponseWriter, r *http.Request) {
+	id, ok := trashID(w, r)
+	if !ok {
+		return
+	}
+	user := context.User(r.Context())
+	err := g.GalleryService.RestoreGallery(user.ID, id)
+	if err != nil {
+		trashError(w, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%d/edit", id), http.StatusFound)
+}
+
+// handler to delete a gallery in the trash for good
+func (g Galleries) PurgeTrashedGallery(w http.ResponseWriter, r *http.Request) {
+	id, ok := trashID(w, r)
+	if !ok {
+		return
+	}
+	user := context.User(r.Context())
+	err := g.GalleryService.PurgeGallery(user.ID, id)
+	if err != nil {
+		trashError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/galleries/trash", http.StatusFound)
+}
+
+// handler to take an image out of the trash and put it back into its gallery
+func (g Galleries) RestoreTrashedImage(w http.ResponseWriter, r *http.Request) {
+	id, ok := trashID(w, r)
+	if !ok {
+		return
+	}
+	user := context.User(r.Context())
+	image, err := g.GalleryService.RestoreImage(user.ID, id)
+	if err != nil {
+		trashError(w, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%d/edit", image.GalleryID), http.StatusFound)
+}
+
+// handler to delete an image in the trash for good
+func (g Galleries) PurgeTrashedImage(w http.ResponseWriter, r *http.Request) {
+	id, ok := trashID(w, r)
+	if !ok {
+		return
+	}
+	user := context.User(r.Context())
+	err := g.GalleryService.PurgeImage(user.ID, id)
+	if err != nil {
+		trashError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/galleries/trash", http.StatusFound)
+}
+
+func (g Galleries) trashRetention() time.Duration {
+	if g.TrashRetention > 0 {
+		return g.TrashRetention
+	}
+	return models.DefaultTrashRetention
+}
+
+// trashID returns the id url parameter of a trash route
+func trashID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return 0, false
+	}
+	return id, true
+}
+
+func trashError(w http.ResponseWriter, err error) {
+	if errors.Is(err, models.ErrNotFound) {
+		http.Error(w, "Not in your trash", http.StatusNotFound)
+		return
+	}
+	fmt.Println(err)
+	http.Error(w, "Something went wrong", http.StatusInternalServerError)
+}
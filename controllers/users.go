@@ -5,10 +5,12 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/ayushthe1/lenspix/context"
 	"github.com/ayushthe1/lenspix/errors"
 	"github.com/ayushthe1/lenspix/models"
+	"github.com/ayushthe1/lenspix/oidc"
 )
 
 type Users struct {
@@ -19,11 +21,27 @@ type Users struct {
 		ForgotPassword Template
 		CheckYourEmail Template
 		ResetPassword  Template
+		// Settings template is the page to change the email address and password of the signed in user
+		Settings Template
+		// VerifyEmail template confirms a new email address
+		VerifyEmail Template
+		// SignInLink template confirms signing in with a link from an email
+		SignInLink Template
 	}
 	UserService          *models.UserService
 	SessionService       *models.SessionService
 	PasswordResetService *models.PasswordResetService
+	SignInLinkService    *models.SignInLinkService
+	EmailChangeService   *models.EmailChangeService
+	ExportService        *models.ExportService
+	ProfileService       *models.ProfileService
+	IdentityService      *models.IdentityService
+	InviteService        *models.InviteService
 	EmailService         *models.EmailService
+	// Registration decides who can sign up
+	Registration models.RegistrationMode
+	// OIDCProviders are the identity providers that users can sign in with, keyed by their ID
+	OIDCProviders map[string]*oidc.Provider
 }
 
 // handler function for signup route
@@ -31,9 +49,14 @@ func (u Users) New(w http.ResponseWriter, r *http.Request) {
 	var data struct {
 		Email string
 		// CSRFField template.HTML
+		// Invite is the invite code, which is filled in when following an invite link
+		Invite       string
+		Registration models.RegistrationMode
 	}
 	// New will be used in get request ,so FormValue will return the "email" value from query string and not from body parameters
 	data.Email = r.FormValue("email")
+	data.Invite = r.FormValue("invite")
+	data.Registration = u.Registration
 
 	// // give us the HTML for a hidden <input> tag that has the CSRF token for the incoming request.
 	// data.CSRFField = csrf.TemplateField(r)
@@ -55,17 +78,38 @@ func (u Users) Create(w http.ResponseWriter, r *http.Request) {
 	// For GET requests, the server processes the data in the URL's query parameters. For POST requests, the server retrieves the encoded data from the request's body.
 
 	var data struct {
-		Email    string
-		Password string
+		Email        string
+		Password     string
+		Invite       string
+		Registration models.RegistrationMode
 	}
 
 	data.Email = r.FormValue("email")
 	data.Password = r.FormValue("password")
-	user, err := u.UserService.Create(data.Email, data.Password)
+	data.Invite = strings.TrimSpace(r.FormValue("invite"))
+	data.Registration = u.Registration
+
+	var user *models.User
+	var invite *models.Invite
+	var err error
+	switch {
+	case u.Registration == models.RegistrationClosed:
+		err = errors.Public(models.ErrSignUpClosed, "Sign ups are closed at the moment.")
+	case u.Registration == models.RegistrationInvite && data.Invite == "":
+		err = errors.Public(models.ErrInviteInvalid, "You need an invite code to sign up.")
+	case data.Invite != "":
+		// invites can also be used while registration is open, to join the gallery they were made for
+		user, invite, err = u.InviteService.SignUp(data.Invite, data.Email, data.Password)
+	default:
+		user, err = u.UserService.Create(data.Email, data.Password)
+	}
 	if err != nil {
 		if errors.Is(err, models.ErrEmailTaken) {
 			err = errors.Public(err, "That email address is already associated with an account.")
 		}
+		if errors.Is(err, models.ErrInviteInvalid) && data.Invite != "" {
+			err = errors.Public(err, "That invite code is invalid, used up or has expired.")
+		}
 		//  execute the signup template ,and render it with passed in data
 		u.Templates.New.Execute(w, r, data, err)
 		return
@@ -82,17 +126,18 @@ func (u Users) Create(w http.ResponseWriter, r *http.Request) {
 
 	// set a cookie
 	setCookie(w, CookieSession, session.Token)
+	if invite != nil && invite.GalleryID != nil {
+		// take the user straight to the gallery they were invited to
+		http.Redirect(w, r, fmt.Sprintf("/galleries/%d", *invite.GalleryID), http.StatusFound)
+		return
+	}
 	http.Redirect(w, r, "/galleries", http.StatusFound)
 
 }
 
 func (u Users) SignIn(w http.ResponseWriter, r *http.Request) {
-	var data struct {
-		Email string
-	}
-	data.Email = r.FormValue("email")
-
 	// if the emailid is present as url query parameter, the signin page will have the email field filled with the emailid
+	data := u.signInData(r.FormValue("email"))
 
 	u.Templates.SignIn.Execute(w, r, data)
 }
@@ -106,6 +151,11 @@ func (u Users) ProcessSignIn(w http.ResponseWriter, r *http.Request) {
 	data.Email = r.FormValue("email")
 	data.Password = r.FormValue("password")
 	user, err := u.UserService.Authenticate(data.Email, data.Password)
+	if errors.Is(err, models.ErrAccountSuspended) {
+		err = errors.Public(err, "Your account has been suspended, please contact support.")
+		u.Templates.SignIn.Execute(w, r, u.signInData(data.Email), err)
+		return
+	}
 	if err != nil {
 		fmt.Println(err)
 		// http.Error(w, "Something went wrong", http.StatusInternalServerError)
@@ -200,7 +250,8 @@ func (u Users) ForgotPassword(w http.ResponseWriter, r *http.Request) {
 // handler for processing the forgot password form
 func (u Users) ProcessForgotPassword(w http.ResponseWriter, r *http.Request) {
 	var data struct {
-		Email string
+		Email      string
+		SignInLink bool
 	}
 
 	data.Email = r.FormValue("email") // get the email from form post request
@@ -264,6 +315,13 @@ func (u Users) ProcessResetPassword(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Something went wromg", http.StatusInternalServerError)
 		return
 	}
+	// sign the user out everywhere, as whoever knew the old password might be signed in
+	err = u.SessionService.DeleteOthers(user.ID, "")
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
 
 	// Sign the user in now that they have reset their password.
 	// Any errors from this point onward should redirect to the sign in page.
@@ -330,3 +388,20 @@ func (umw UserMiddleware) RequireUser(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// middleware that only lets admins through. Everyone else gets a 404, so that the admin area doesn't give itself away.
+// This middleware assumes that we have already run our SetUser middleware
+func (umw UserMiddleware) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if user == nil {
+			http.Redirect(w, r, "/signin", http.StatusFound)
+			return
+		}
+		if !user.IsAdmin {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,28 @@
+-- +goose Up
+-- Images that were uploaded before this migration only exist as files, so
+-- they don't show up in their galleries until `lenspix-fsck --repair` has
+-- added them to this table. See "Upgrading" in README.MD.
+-- +goose StatementBegin
+CREATE TABLE images (
+    id SERIAL PRIMARY KEY,
+    gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+    filename TEXT NOT NULL,
+    storage_key TEXT UNIQUE NOT NULL,
+    checksum TEXT NOT NULL,
+    size BIGINT NOT NULL,
+    content_type TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (gallery_id, filename)
+);
+
+ALTER TABLE galleries
+ADD COLUMN visibility TEXT NOT NULL DEFAULT 'unlisted';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries
+DROP COLUMN visibility;
+
+DROP TABLE images;
+-- +goose StatementEnd
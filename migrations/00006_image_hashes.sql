@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE images
+ADD COLUMN dhash BIGINT;
+
+CREATE INDEX images_checksum_idx ON images (checksum);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX images_checksum_idx;
+
+ALTER TABLE images
+DROP COLUMN dhash;
+-- +goose StatementEnd
@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE images
+ADD COLUMN width INT NOT NULL DEFAULT 0,
+ADD COLUMN height INT NOT NULL DEFAULT 0,
+ADD COLUMN blurhash TEXT NOT NULL DEFAULT '',
+ADD COLUMN dominant_color TEXT NOT NULL DEFAULT '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE images
+DROP COLUMN width,
+DROP COLUMN height,
+DROP COLUMN blurhash,
+DROP COLUMN dominant_color;
+-- +goose StatementEnd
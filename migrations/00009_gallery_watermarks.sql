@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE gallery_watermarks (
+    gallery_id INT PRIMARY KEY REFERENCES galleries (id) ON DELETE CASCADE,
+    text TEXT NOT NULL DEFAULT '',
+    logo_key TEXT NOT NULL DEFAULT '',
+    position TEXT NOT NULL,
+    opacity DOUBLE PRECISION NOT NULL,
+    scale DOUBLE PRECISION NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE gallery_watermarks;
+-- +goose StatementEnd
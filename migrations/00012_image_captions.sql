@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE images
+ADD COLUMN caption TEXT NOT NULL DEFAULT '',
+-- an empty visibility means the image has the visibility of its gallery
+ADD COLUMN visibility TEXT NOT NULL DEFAULT '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE images
+DROP COLUMN caption,
+DROP COLUMN visibility;
+-- +goose StatementEnd
@@ -0,0 +1,31 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE galleries
+ADD COLUMN deleted_at TIMESTAMPTZ;
+
+ALTER TABLE images
+ADD COLUMN deleted_at TIMESTAMPTZ;
+
+-- images in the trash don't hold on to their filename
+ALTER TABLE images
+DROP CONSTRAINT images_gallery_id_filename_key;
+CREATE UNIQUE INDEX images_gallery_id_filename_key ON images (gallery_id, filename)
+WHERE deleted_at IS NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX images_gallery_id_filename_key;
+DELETE FROM images
+WHERE deleted_at IS NOT NULL;
+ALTER TABLE images
+ADD CONSTRAINT images_gallery_id_filename_key UNIQUE (gallery_id, filename);
+
+ALTER TABLE images
+DROP COLUMN deleted_at;
+
+DELETE FROM galleries
+WHERE deleted_at IS NOT NULL;
+ALTER TABLE galleries
+DROP COLUMN deleted_at;
+-- +goose StatementEnd
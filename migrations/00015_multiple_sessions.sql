@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+-- users can be signed in on more than one device at a time
+ALTER TABLE sessions
+DROP CONSTRAINT sessions_user_id_key;
+CREATE INDEX sessions_user_id_idx ON sessions (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX sessions_user_id_idx;
+DELETE FROM sessions
+WHERE id NOT IN (SELECT MAX(id) FROM sessions GROUP BY user_id);
+ALTER TABLE sessions
+ADD CONSTRAINT sessions_user_id_key UNIQUE (user_id);
+-- +goose StatementEnd
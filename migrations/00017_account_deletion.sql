@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users
+ADD COLUMN delete_at TIMESTAMPTZ;
+
+-- the galleries of a user are purged through the GalleryService before the
+-- user is deleted, the cascade makes sure nothing is left behind if not
+ALTER TABLE galleries
+DROP CONSTRAINT galleries_user_id_fkey;
+ALTER TABLE galleries
+ADD CONSTRAINT galleries_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries
+DROP CONSTRAINT galleries_user_id_fkey;
+ALTER TABLE galleries
+ADD CONSTRAINT galleries_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id);
+
+ALTER TABLE users
+DROP COLUMN delete_at;
+-- +goose StatementEnd
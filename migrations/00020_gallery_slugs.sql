@@ -0,0 +1,30 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE galleries
+ADD COLUMN slug TEXT;
+
+-- existing galleries get a slug from their title, with their id to keep it unique
+UPDATE galleries
+SET slug = COALESCE(NULLIF(TRIM(BOTH '-' FROM LOWER(REGEXP_REPLACE(title, '[^a-zA-Z0-9]+', '-', 'g'))), ''), 'gallery')
+    || '-' || id;
+
+ALTER TABLE galleries
+ALTER COLUMN slug SET NOT NULL,
+ADD CONSTRAINT galleries_user_id_slug_key UNIQUE (user_id, slug);
+
+CREATE TABLE gallery_redirects (
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    slug TEXT NOT NULL,
+    gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, slug)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE gallery_redirects;
+
+ALTER TABLE galleries
+DROP COLUMN slug;
+-- +goose StatementEnd
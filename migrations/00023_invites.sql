@@ -0,0 +1,30 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE invites (
+  id SERIAL PRIMARY KEY,
+  created_by INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  code_hash TEXT UNIQUE NOT NULL,
+  max_uses INT NOT NULL,
+  uses INT NOT NULL DEFAULT 0,
+  -- invites without an expiry can be used until they are used up or deleted
+  expires_at TIMESTAMPTZ,
+  gallery_id INT REFERENCES galleries (id) ON DELETE SET NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX invites_created_by_idx ON invites (created_by);
+
+-- members can view a gallery even when it is private
+CREATE TABLE gallery_members (
+  gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+  user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (gallery_id, user_id)
+);
+CREATE INDEX gallery_members_user_id_idx ON gallery_members (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE gallery_members;
+DROP TABLE invites;
+-- +goose StatementEnd
@@ -0,0 +1,36 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users
+ADD COLUMN is_admin BOOLEAN NOT NULL DEFAULT false,
+ADD COLUMN suspended_at TIMESTAMPTZ;
+
+-- sessions of admins that are signed in as another user for support
+ALTER TABLE sessions
+ADD COLUMN impersonator_id INT REFERENCES users (id) ON DELETE CASCADE;
+
+-- the log outlives the users it is about, so it keeps their email addresses
+CREATE TABLE admin_audit_log (
+  id SERIAL PRIMARY KEY,
+  admin_id INT REFERENCES users (id) ON DELETE SET NULL,
+  admin_email TEXT NOT NULL,
+  user_id INT REFERENCES users (id) ON DELETE SET NULL,
+  user_email TEXT NOT NULL,
+  action TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX admin_audit_log_user_id_idx ON admin_audit_log (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE admin_audit_log;
+
+DELETE FROM sessions
+WHERE impersonator_id IS NOT NULL;
+ALTER TABLE sessions
+DROP COLUMN impersonator_id;
+
+ALTER TABLE users
+DROP COLUMN suspended_at,
+DROP COLUMN is_admin;
+-- +goose StatementEnd
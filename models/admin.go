@@ -0,0 +1,260 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Account is a user as admins see it
+type Account struct {
+	ID       int
+	Email    string
+	Username string
+	IsAdmin  bool
+	// SuspendedAt is when an admin suspended the account, if they did
+	SuspendedAt *time.Time
+	// DeleteAt is when the account will be deleted, if its user asked for it
+	DeleteAt *time.Time
+}
+
+// The actions of admins that are written to the audit log
+const (
+	AuditSuspend            = "suspend"
+	AuditUnsuspend          = "unsuspend"
+	AuditForcePasswordReset = "force password reset"
+	AuditImpersonate        = "impersonate"
+	AuditStopImpersonating  = "stop impersonating"
+)
+
+// AuditEntry is something an admin did to the account of a user
+type AuditEntry struct {
+	ID         int
+	AdminID    int
+	AdminEmail string
+	UserID     int
+	UserEmail  string
+	Action     string
+	CreatedAt  time.Time
+}
+
+// AdminError is returned when an admin isn't allowed to do something to an account.
+type AdminError struct {
+	Issue string
+}
+
+func (ae AdminError) Error() string {
+	return fmt.Sprintf("admin: %v", ae.Issue)
+}
+
+const (
+	// MaxAccounts is the most accounts that AdminService.Accounts returns
+	MaxAccounts = 100
+	// MaxAuditEntries is the most entries that AdminService.AuditLog returns
+	MaxAuditEntries = 200
+)
+
+// AdminService lets admins manage the accounts of other users. Everything
+// that changes an account is written to the audit log.
+type AdminService struct {
+	DB *sql.DB
+	// SessionService creates the sessions for impersonating users
+	SessionService *SessionService
+}
+
+// Accounts returns the accounts whose email address or username contains
+// query, or all of them if query is empty, up to MaxAccounts ordered by id.
+func (service *AdminService) Accounts(query string) ([]Account, error) {
+	// % and _ are wildcards in LIKE patterns
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(strings.ToLower(query)) + "%"
+	rows, err := service.DB.Query(`
+	SELECT id, email, COALESCE(username, ''), is_admin, suspended_at, delete_at
+	FROM users
+	WHERE email LIKE $1 OR username LIKE $1
+	ORDER BY id
+	LIMIT $2;`, pattern, MaxAccounts)
+	if err != nil {
+		return nil, fmt.Errorf("query accounts: %w", err)
+	}
+	defer rows.Close()
+
+	var accounts []Account
+	for rows.Next() {
+		var account Account
+		err = rows.Scan(&account.ID, &account.Email, &account.Username, &account.IsAdmin, &account.SuspendedAt, &account.DeleteAt)
+		if err != nil {
+			return nil, fmt.Errorf("query accounts: %w", err)
+		}
+		accounts = append(accounts, account)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("query accounts: %w", rows.Err())
+	}
+	return accounts, nil
+}
+
+// Account returns the account of the user with the given id, or ErrNotFound
+// if there is none.
+func (service *AdminService) Account(userID int) (*Account, error) {
+	account := Account{
+		ID: userID,
+	}
+	row := service.DB.QueryRow(`
+	SELECT email, COALESCE(username, ''), is_admin, suspended_at, delete_at
+	FROM users WHERE id = $1;`, userID)
+	err := row.Scan(&account.Email, &account.Username, &account.IsAdmin, &account.SuspendedAt, &account.DeleteAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query account: %w", err)
+	}
+	return &account, nil
+}
+
+// Suspend signs the user out everywhere and keeps them from signing in
+// again until the account is unsuspended. Their galleries stay as they are.
+func (service *AdminService) Suspend(adminID, userID int) error {
+	if adminID == userID {
+		return AdminError{Issue: "admins can't suspend themselves"}
+	}
+	return service.change(adminID, userID, AuditSuspend, `
+	UPDATE users SET suspended_at = COALESCE(suspended_at, now())
+	WHERE id = $1;`, `
+	DELETE FROM sessions
+	WHERE user_id = $1 AND impersonator_id IS NULL;`)
+}
+
+// Unsuspend lets a suspended user sign in again.
+func (service *AdminService) Unsuspend(adminID, userID int) error {
+	return service.change(adminID, userID, AuditUnsuspend, `
+	UPDATE users SET suspended_at = NULL
+	WHERE id = $1;`)
+}
+
+// ForcePasswordReset removes the password of the user and signs them out
+// everywhere, so that they have to pick a new password with a password
+// reset before they can sign in with one again.
+func (service *AdminService) ForcePasswordReset(adminID, userID int) error {
+	// an empty password hash never matches a password
+	return service.change(adminID, userID, AuditForcePasswordReset, `
+	UPDATE users SET password_hash = ''
+	WHERE id = $1;`, `
+	DELETE FROM sessions
+	WHERE user_id = $1 AND impersonator_id IS NULL;`)
+}
+
+// Impersonate creates a session that signs the admin in as the user, for
+// support. Other admins can't be impersonated.
+func (service *AdminService) Impersonate(adminID, userID int) (*Session, error) {
+	account, err := service.Account(userID)
+	if err != nil {
+		return nil, fmt.Errorf("impersonate: %w", err)
+	}
+	if account.IsAdmin {
+		return nil, AdminError{Issue: "admins can't be impersonated"}
+	}
+	// the entry is written first, so that there is no impersonation without one
+	err = service.log(service.DB, adminID, userID, AuditImpersonate)
+	if err != nil {
+		return nil, fmt.Errorf("impersonate: %w", err)
+	}
+	session, err := service.SessionService.Impersonate(adminID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("impersonate: %w", err)
+	}
+	return session, nil
+}
+
+// StopImpersonating records that the admin is done with impersonating the
+// user. The session itself is deleted with SessionService.Delete.
+func (service *AdminService) StopImpersonating(adminID, userID int) error {
+	err := service.log(service.DB, adminID, userID, AuditStopImpersonating)
+	if err != nil {
+		return fmt.Errorf("stop impersonating: %w", err)
+	}
+	return nil
+}
+
+// AuditLog returns the newest entries of the audit log, up to
+// MaxAuditEntries. If userID isn't 0, only entries about that user are
+// returned.
+func (service *AdminService) AuditLog(userID int) ([]AuditEntry, error) {
+	rows, err := service.DB.Query(`
+	SELECT id, COALESCE(admin_id, 0), admin_email, COALESCE(user_id, 0), user_email, action, created_at
+	FROM admin_audit_log
+	WHERE $1 = 0 OR user_id = $1
+	ORDER BY created_at DESC, id DESC
+	LIMIT $2;`, userID, MaxAuditEntries)
+	if err != nil {
+		return nil, fmt.Errorf("query audit log: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var entry AuditEntry
+		err = rows.Scan(&entry.ID, &entry.AdminID, &entry.AdminEmail, &entry.UserID, &entry.UserEmail, &entry.Action, &entry.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("query audit log: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("query audit log: %w", rows.Err())
+	}
+	return entries, nil
+}
+
+// change runs the statements for the user, which is passed as $1, and logs
+// the action in the same transaction. ErrNotFound is returned if there is no
+// such user.
+func (service *AdminService) change(adminID, userID int, action string, statements ...string) error {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("%v: %w", action, err)
+	}
+	defer tx.Rollback()
+
+	// also makes sure that the user exists
+	err = service.log(tx, adminID, userID, action)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("%v: %w", action, err)
+	}
+	for _, statement := range statements {
+		_, err = tx.Exec(statement, userID)
+		if err != nil {
+			return fmt.Errorf("%v: %w", action, err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("%v: %w", action, err)
+	}
+	return nil
+}
+
+// log writes an entry to the audit log. ErrNotFound is returned if the admin
+// or the user doesn't exist.
+func (service *AdminService) log(q queryRower, adminID, userID int, action string) error {
+	var id int
+	row := q.QueryRow(`
+	INSERT INTO admin_audit_log (admin_id, admin_email, user_id, user_email, action)
+	SELECT admins.id, admins.email, users.id, users.email, $3
+	FROM users AS admins, users
+	WHERE admins.id = $1 AND users.id = $2
+	RETURNING id;`, adminID, userID, action)
+	err := row.Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("audit log: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package models
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+)
+
+// The BlurHash algorithm (https://blurha.sh) encodes a very blurry version
+// of an image as a short string, by storing only the first few components
+// of its discrete cosine transform.
+
+const (
+	// the number of horizontal and vertical BlurHash components we use
+	blurHashX = 4
+	blurHashY = 3
+
+	// images are shrunk to this many samples on their longest side before
+	// being encoded, as there is no detail left to lose
+	blurHashSamples = 64
+
+	base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+)
+
+// blurHash encodes img as a BlurHash string
+func blurHash(img image.Image) string {
+	pixels, w, h := sampleLinear(img, blurHashSamples)
+
+	var factors [blurHashY][blurHashX][3]float64
+	for j := 0; j < blurHashY; j++ {
+		for i := 0; i < blurHashX; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var r, g, b float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(w)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(h))
+					p := pixels[y*w+x]
+					r += basis * p[0]
+					g += basis * p[1]
+					b += basis * p[2]
+				}
+			}
+			scale := normalisation / float64(w*h)
+			factors[j][i] = [3]float64{r * scale, g * scale, b * scale}
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(encode83((blurHashX-1)+(blurHashY-1)*9, 1))
+
+	// the AC components are quantised relative to the largest of them
+	maximum := 0.0
+	for j := 0; j < blurHashY; j++ {
+		for i := 0; i < blurHashX; i++ {
+			if i == 0 && j == 0 {
+				continue
+			}
+			for _, v := range factors[j][i] {
+				maximum = math.Max(maximum, math.Abs(v))
+			}
+		}
+	}
+	quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(maximum*166-0.5))))
+	maximumValue := float64(quantisedMaximum+1) / 166
+	sb.WriteString(encode83(quantisedMaximum, 1))
+
+	dc := factors[0][0]
+	sb.WriteString(encode83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+
+	for j := 0; j < blurHashY; j++ {
+		for i := 0; i < blurHashX; i++ {
+			if i == 0 && j == 0 {
+				continue
+			}
+			var quant [3]int
+			for c, v := range factors[j][i] {
+				quant[c] = int(math.Max(0, math.Min(18, math.Floor(signPow(v/maximumValue, 0.5)*9+9.5))))
+			}
+			sb.WriteString(encode83(quant[0]*19*19+quant[1]*19+quant[2], 2))
+		}
+	}
+	return sb.String()
+}
+
+// BlurHashImage decodes a BlurHash string into a width x height image.
+func BlurHashImage(hash string, width, height int) (image.Image, error) {
+	if len(hash) < 6 {
+		return nil, fmt.Errorf("blurhash: too short")
+	}
+	sizeFlag, err := decode83(hash[:1])
+	if err != nil {
+		return nil, fmt.Errorf("blurhash: %w", err)
+	}
+	numX, numY := sizeFlag%9+1, sizeFlag/9+1
+	if len(hash) != 4+2*numX*numY {
+		return nil, fmt.Errorf("blurhash: invalid length %d", len(hash))
+	}
+	quantisedMaximum, err := decode83(hash[1:2])
+	if err != nil {
+		return nil, fmt.Errorf("blurhash: %w", err)
+	}
+	maximumValue := float64(quantisedMaximum+1) / 166
+
+	colors := make([][3]float64, numX*numY)
+	dc, err := decode83(hash[2:6])
+	if err != nil {
+		return nil, fmt.Errorf("blurhash: %w", err)
+	}
+	colors[0] = [3]float64{sRGBToLinear(dc >> 16), sRGBToLinear(dc >> 8 & 255), sRGBToLinear(dc & 255)}
+	for i := 1; i < len(colors); i++ {
+		ac, err := decode83(hash[4+i*2 : 6+i*2])
+		if err != nil {
+			return nil, fmt.Errorf("blurhash: %w", err)
+		}
+		for c, q := range [3]int{ac / (19 * 19), ac / 19 % 19, ac % 19} {
+			colors[i][c] = signPow((float64(q)-9)/9, 2) * maximumValue
+		}
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var r, g, b float64
+			for j := 0; j < numY; j++ {
+				for i := 0; i < numX; i++ {
+					basis := math.Cos(math.Pi*float64(x)*float64(i)/float64(width)) *
+						math.Cos(math.Pi*float64(y)*float64(j)/float64(height))
+					c := colors[i+j*numX]
+					r += c[0] * basis
+					g += c[1] * basis
+					b += c[2] * basis
+				}
+			}
+			img.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(linearToSRGB(r)), G: uint8(linearToSRGB(g)), B: uint8(linearToSRGB(b)), A: 255,
+			})
+		}
+	}
+	return img, nil
+}
+
+// dominantColor returns the most common colour of img as a CSS hex colour
+// like "#a0b1c2". Similar colours are bucketed together and the average of
+// the biggest bucket is returned.
+func dominantColor(img image.Image) string {
+	type bucket struct {
+		r, g, b uint64
+		n       uint64
+	}
+	buckets := make(map[uint32]*bucket)
+	var best *bucket
+
+	bounds := img.Bounds()
+	stepX := max(1, bounds.Dx()/blurHashSamples)
+	stepY := max(1, bounds.Dy()/blurHashSamples)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += stepY {
+		for x := bounds.Min.X; x < bounds.Max.X; x += stepX {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A < 128 {
+				// mostly transparent pixels don't count
+				continue
+			}
+			// 4 bits per channel
+			key := uint32(c.R>>4)<<8 | uint32(c.G>>4)<<4 | uint32(c.B>>4)
+			bk, ok := buckets[key]
+			if !ok {
+				bk = &bucket{}
+				buckets[key] = bk
+			}
+			bk.r += uint64(c.R)
+			bk.g += uint64(c.G)
+			bk.b += uint64(c.B)
+			bk.n++
+			if best == nil || bk.n > best.n {
+				best = bk
+			}
+		}
+	}
+	if best == nil {
+		return "#ffffff"
+	}
+	return fmt.Sprintf("#%02x%02x%02x", best.r/best.n, best.g/best.n, best.b/best.n)
+}
+
+// sampleLinear shrinks img to at most size samples on its longest side and
+// returns the pixels in linear RGB, row by row, along with the new size.
+func sampleLinear(img image.Image, size int) ([][3]float64, int, int) {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, max(1, h*size/bounds.Dx())
+		} else {
+			w, h = max(1, w*size/bounds.Dy()), size
+		}
+	}
+
+	pixels := make([][3]float64, 0, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			px := bounds.Min.X + x*bounds.Dx()/w
+			py := bounds.Min.Y + y*bounds.Dy()/h
+			c := color.NRGBAModel.Convert(img.At(px, py)).(color.NRGBA)
+			pixels = append(pixels, [3]float64{
+				sRGBToLinear(int(c.R)), sRGBToLinear(int(c.G)), sRGBToLinear(int(c.B)),
+			})
+		}
+	}
+	return pixels, w, h
+}
+
+func sRGBToLinear(v int) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+func encode83(value, length int) string {
+	b := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		b[i] = base83Chars[value%83]
+		value /= 83
+	}
+	return string(b)
+}
+
+func decode83(s string) (int, error) {
+	value := 0
+	for _, c := range s {
+		i := strings.IndexRune(base83Chars, c)
+		if i < 0 {
+			return 0, fmt.Errorf("invalid base83 character %q", c)
+		}
+		value = value*83 + i
+	}
+	return value, nil
+}
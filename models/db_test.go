@@ -0,0 +1,29 @@
+package models
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/ayushthe1/lenspix/migrations"
+)
+
+// testDB opens the database named by LENSPIX_TEST_DB and migrates it. Tests
+// that need it are skipped when it isn't set.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("LENSPIX_TEST_DB")
+	if dsn == "" {
+		t.Skip("LENSPIX_TEST_DB isn't set to a Postgres connection string")
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = MigrateFS(db, migrations.FS, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
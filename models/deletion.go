@@ -0,0 +1,183 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Files can't take part in a database transaction, so they are never removed
+// in the same step as the rows that point at them. Instead, the rows are
+// deleted together with an insert into storage_deletions, and the files are
+// removed after the transaction has been committed. If that fails, or the
+// process dies before it gets to it, the deletion is still recorded and
+// CleanStorage retries it until it succeeds. Removing a file that is already
+// gone is not an error, so running a deletion twice is harmless.
+
+// The kinds of storage deletions
+const (
+	// deleteObject removes the object with the key
+	deleteObject = "object"
+	// deleteTree removes every object under the key
+	deleteTree = "tree"
+	// deleteMatching removes the objects next to the key whose name starts with the last element of the key
+	deleteMatching = "matching"
+)
+
+// storageDeletion is a pending removal of objects from the storage
+type storageDeletion struct {
+	ID       int
+	Kind     string
+	Key      string
+	Attempts int
+}
+
+// enqueueDeletion records that objects have to be removed from the storage
+// and returns the id of the record. It is meant to be called in the
+// transaction that deletes the rows pointing at the objects.
+func enqueueDeletion(q queryRower, kind, key string) (int, error) {
+	var id int
+	row := q.QueryRow(`
+	INSERT INTO storage_deletions (kind, storage_key)
+	VALUES ($1, $2) RETURNING id;`, kind, key)
+	err := row.Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("enqueue deletion of %v: %w", key, err)
+	}
+	return id, nil
+}
+
+// CleanStorage performs the storage deletions that are due, and returns how
+// many of them succeeded. Deletions that fail are retried by a later call,
+// with a growing delay between the attempts. It is safe to call from several
+// processes at the same time.
+func (service *GalleryService) CleanStorage() (int, error) {
+	rows, err := service.DB.Query(`
+	SELECT id FROM storage_deletions
+	WHERE next_attempt_at <= now()
+	ORDER BY id;`)
+	if err != nil {
+		return 0, fmt.Errorf("clean storage: %w", err)
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			return 0, fmt.Errorf("clean storage: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if rows.Err() != nil {
+		return 0, fmt.Errorf("clean storage: %w", rows.Err())
+	}
+
+	done := 0
+	for _, id := range ids {
+		ok, err := service.runDeletion(id)
+		if err != nil {
+			return done, fmt.Errorf("clean storage: %w", err)
+		}
+		if ok {
+			done++
+		}
+	}
+	return done, nil
+}
+
+// runDeletions tries to perform the storage deletions with the given ids
+// right away. Failures are left to CleanStorage.
+func (service *GalleryService) runDeletions(ids []int) {
+	for _, id := range ids {
+		service.runDeletion(id)
+	}
+}
+
+// runDeletion performs a single storage deletion and reports whether it
+// succeeded. A deletion that is being performed by someone else, or that has
+// already been done, is skipped. The returned error is only about the
+// bookkeeping; a failure to remove the objects is recorded for the next attempt.
+func (service *GalleryService) runDeletion(id int) (bool, error) {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return false, fmt.Errorf("run deletion: %w", err)
+	}
+	defer tx.Rollback()
+
+	var deletion storageDeletion
+	row := tx.QueryRow(`
+	SELECT id, kind, storage_key, attempts FROM storage_deletions
+	WHERE id = $1
+	FOR UPDATE SKIP LOCKED;`, id)
+	err = row.Scan(&deletion.ID, &deletion.Kind, &deletion.Key, &deletion.Attempts)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, fmt.Errorf("run deletion: %w", err)
+	}
+
+	removeErr := service.removeObjects(deletion.Kind, deletion.Key)
+	if removeErr != nil {
+		// wait 1, 2, 4, ... minutes for the next attempt, but at most an hour
+		_, err = tx.Exec(`
+		UPDATE storage_deletions
+		SET attempts = attempts + 1, last_error = $2,
+			next_attempt_at = now() + LEAST(interval '1 minute' * power(2, attempts), interval '1 hour')
+		WHERE id = $1;`, deletion.ID, removeErr.Error())
+	} else {
+		_, err = tx.Exec(`
+		DELETE FROM storage_deletions
+		WHERE id = $1;`, deletion.ID)
+	}
+	if err != nil {
+		return false, fmt.Errorf("run deletion: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return false, fmt.Errorf("run deletion: %w", err)
+	}
+	return removeErr == nil, nil
+}
+
+func (service *GalleryService) removeObjects(kind, key string) error {
+	switch kind {
+	case deleteObject:
+		return service.storage().Remove(key)
+	case deleteTree:
+		return service.storage().RemoveAll(key)
+	case deleteMatching:
+		keys, err := service.storage().List(path.Dir(key))
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if strings.HasPrefix(path.Base(k), path.Base(key)) {
+				err = service.storage().Remove(k)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown kind of deletion %q", kind)
+	}
+}
+
+// enqueueImageDeletion records the removal of the file and renditions of an
+// image and returns the ids of the records.
+func enqueueImageDeletion(q queryRower, image Image) ([]int, error) {
+	fileID, err := enqueueDeletion(q, deleteObject, image.Key)
+	if err != nil {
+		return nil, err
+	}
+	renditionsID, err := enqueueDeletion(q, deleteMatching, renditionsKeyPrefix(image))
+	if err != nil {
+		return nil, err
+	}
+	return []int{fileID, renditionsID}, nil
+}
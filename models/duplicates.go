@@ -0,0 +1,252 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"image"
+	_ "image/gif" // register the decoders for the image types we accept
+	_ "image/jpeg"
+	_ "image/png"
+	"math/bits"
+	"sort"
+)
+
+// DefaultDuplicateDistance is the largest number of differing dHash bits for
+// two images to be considered possible duplicates. Resized, recompressed or
+// slightly edited copies of a photo usually stay well below it.
+const DefaultDuplicateDistance = 10
+
+// DuplicateGroup is a set of images that look like copies of each other.
+type DuplicateGroup struct {
+	Images []Image
+	// Exact is true when every image in the group has the same contents.
+	Exact bool
+}
+
+// GalleryDuplicates returns the groups of possible duplicate images inside a gallery.
+func (service *GalleryService) GalleryDuplicates(galleryID int) ([]DuplicateGroup, error) {
+	images, err := service.queryImages(`
+	WHERE images.gallery_id = $1 AND images.deleted_at IS NULL
+	ORDER BY images.filename;`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("gallery duplicates: %w", err)
+	}
+	return groupDuplicates(images, service.duplicateDistance()), nil
+}
+
+// UserDuplicates returns the groups of possible duplicate images across all of a user's galleries.
+func (service *GalleryService) UserDuplicates(userID int) ([]DuplicateGroup, error) {
+	images, err := service.queryImages(`
+	JOIN galleries ON galleries.id = images.gallery_id
+	WHERE galleries.user_id = $1 AND galleries.deleted_at IS NULL AND images.deleted_at IS NULL
+	ORDER BY images.gallery_id, images.filename;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("user duplicates: %w", err)
+	}
+	return groupDuplicates(images, service.duplicateDistance()), nil
+}
+
+func (service *GalleryService) duplicateDistance() int {
+	if service.DuplicateDistance > 0 {
+		return service.DuplicateDistance
+	}
+	return DefaultDuplicateDistance
+}
+
+// groupDuplicates puts images with the same checksum, or with dHashes that
+// are at most maxDistance bits apart, into the same group. Images without
+// any duplicates are left out.
+func groupDuplicates(images []Image, maxDistance int) []DuplicateGroup {
+	// union-find over the indexes of images
+	parent := make([]int, len(images))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	union := func(i, j int) {
+		parent[find(i)] = find(j)
+	}
+
+	// exact copies have the same checksum
+	byChecksum := make(map[string]int)
+	for i, img := range images {
+		if j, ok := byChecksum[img.Checksum]; ok {
+			union(i, j)
+			continue
+		}
+		byChecksum[img.Checksum] = i
+	}
+
+	// Similar images are looked up in a BK-tree of the distinct dHashes, so
+	// that not every pair of images has to be compared. Images with the same
+	// dHash are grouped right away and share a node.
+	var tree *bkNode
+	for i, img := range images {
+		if img.DHash == nil {
+			continue
+		}
+		if tree == nil {
+			tree = &bkNode{hash: *img.DHash, index: i}
+			continue
+		}
+		tree.search(*img.DHash, maxDistance, func(j int) {
+			union(i, j)
+		})
+		tree.insert(*img.DHash, i)
+	}
+
+	byRoot := make(map[int]*DuplicateGroup)
+	var roots []int
+	for i, img := range images {
+		root := find(i)
+		group, ok := byRoot[root]
+		if !ok {
+			group = &DuplicateGroup{Exact: true}
+			byRoot[root] = group
+			roots = append(roots, root)
+		}
+		if len(group.Images) > 0 && group.Images[0].Checksum != img.Checksum {
+			group.Exact = false
+		}
+		group.Images = append(group.Images, img)
+	}
+
+	var groups []DuplicateGroup
+	for _, root := range roots {
+		if len(byRoot[root].Images) > 1 {
+			groups = append(groups, *byRoot[root])
+		}
+	}
+	// show the exact copies first, as those are the safest to clean up
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].Exact && !groups[j].Exact
+	})
+	return groups
+}
+
+// bkNode is a node of a BK-tree, which indexes dHashes by their Hamming
+// distance. Every child is exactly as far from its parent as the key it is
+// stored under, so a search only has to descend into the children that are
+// within maxDistance of how far the searched hash is from the node.
+type bkNode struct {
+	hash     uint64
+	index    int // of the first image with the hash
+	children map[int]*bkNode
+}
+
+// insert adds hash to the tree, unless it is already in it
+func (node *bkNode) insert(hash uint64, index int) {
+	for {
+		d := hammingDistance(node.hash, hash)
+		if d == 0 {
+			return
+		}
+		child, ok := node.children[d]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[int]*bkNode)
+			}
+			node.children[d] = &bkNode{hash: hash, index: index}
+			return
+		}
+		node = child
+	}
+}
+
+// search calls found with the index of every node that is at most maxDistance bits away from hash
+func (node *bkNode) search(hash uint64, maxDistance int, found func(index int)) {
+	d := hammingDistance(node.hash, hash)
+	if d <= maxDistance {
+		found(node.index)
+	}
+	for childDistance, child := range node.children {
+		if childDistance >= d-maxDistance && childDistance <= d+maxDistance {
+			child.search(hash, maxDistance, found)
+		}
+	}
+}
+
+// dHash computes the difference hash of img. The image is shrunk down to 9x8
+// grayscale cells and every bit of the hash tells if a cell is brighter than
+// its right neighbour, so similar looking images end up with similar hashes.
+func dHash(img image.Image) uint64 {
+	const w, h = 9, 8
+	b := img.Bounds()
+	if b.Dx() < 1 || b.Dy() < 1 {
+		return 0
+	}
+
+	var cells [h][w]float64
+	for cy := 0; cy < h; cy++ {
+		y0, y1 := span(b.Min.Y, b.Dy(), cy, h)
+		for cx := 0; cx < w; cx++ {
+			x0, x1 := span(b.Min.X, b.Dx(), cx, w)
+			// sample at most 16x16 pixels per cell to keep large photos fast
+			stepX, stepY := max(1, (x1-x0)/16), max(1, (y1-y0)/16)
+			var sum float64
+			var n int
+			for y := y0; y < y1; y += stepY {
+				for x := x0; x < x1; x += stepX {
+					r, g, b, _ := img.At(x, y).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+					n++
+				}
+			}
+			cells[cy][cx] = sum / float64(n)
+		}
+	}
+
+	var hash uint64
+	for cy := 0; cy < h; cy++ {
+		for cx := 0; cx < w-1; cx++ {
+			hash <<= 1
+			if cells[cy][cx] > cells[cy][cx+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// span returns the pixel range [start, end) covered by cell i of n cells laid over length pixels starting at min.
+func span(min, length, i, n int) (int, int) {
+	start := min + i*length/n
+	end := min + (i+1)*length/n
+	if end <= start {
+		end = start + 1
+	}
+	return start, end
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func hammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// Postgres doesn't have unsigned integers, so dHashes are stored as the int64 with the same bits.
+func dHashToDB(hash *uint64) sql.NullInt64 {
+	if hash == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: int64(*hash), Valid: true}
+}
+
+func dHashFromDB(v sql.NullInt64) *uint64 {
+	if !v.Valid {
+		return nil
+	}
+	hash := uint64(v.Int64)
+	return &hash
+}
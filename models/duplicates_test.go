@@ -0,0 +1,125 @@
+package models
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// pairwiseDuplicates groups images by comparing every pair, which is what
+// groupDuplicates has to agree with
+func pairwiseDuplicates(images []Image, maxDistance int) [][]string {
+	group := make([]int, len(images))
+	for i := range group {
+		group[i] = i
+	}
+	merge := func(from, to int) {
+		for k := range group {
+			if group[k] == from {
+				group[k] = to
+			}
+		}
+	}
+	for i := range images {
+		for j := i + 1; j < len(images); j++ {
+			a, b := images[i], images[j]
+			if a.Checksum == b.Checksum ||
+				a.DHash != nil && b.DHash != nil && hammingDistance(*a.DHash, *b.DHash) <= maxDistance {
+				merge(group[j], group[i])
+			}
+		}
+	}
+	members := make(map[int][]string)
+	var order []int
+	for i, img := range images {
+		if _, ok := members[group[i]]; !ok {
+			order = append(order, group[i])
+		}
+		members[group[i]] = append(members[group[i]], img.Filename)
+	}
+	var groups [][]string
+	for _, g := range order {
+		if len(members[g]) > 1 {
+			groups = append(groups, members[g])
+		}
+	}
+	return groups
+}
+
+func filenames(groups []DuplicateGroup) [][]string {
+	var names [][]string
+	for _, group := range groups {
+		var n []string
+		for _, img := range group.Images {
+			n = append(n, img.Filename)
+		}
+		names = append(names, n)
+	}
+	return names
+}
+
+func TestGroupDuplicates(t *testing.T) {
+	hash := func(h uint64) *uint64 { return &h }
+	images := []Image{
+		{Filename: "a.jpg", Checksum: "1", DHash: hash(0xff00)},
+		{Filename: "b.jpg", Checksum: "2", DHash: hash(0xff01)},
+		{Filename: "c.jpg", Checksum: "3", DHash: hash(0x00ff00ff00ff00ff)},
+		{Filename: "d.jpg", Checksum: "3"},
+		{Filename: "e.jpg", Checksum: "4", DHash: hash(0xf0f0f0f0f0f0f0f0)},
+	}
+	groups := groupDuplicates(images, 2)
+	want := [][]string{{"c.jpg", "d.jpg"}, {"a.jpg", "b.jpg"}}
+	if got := filenames(groups); !reflect.DeepEqual(got, want) {
+		t.Fatalf("groups %v, want %v", got, want)
+	}
+	if !groups[0].Exact || groups[1].Exact {
+		t.Errorf("exact %v and %v, want true and false", groups[0].Exact, groups[1].Exact)
+	}
+}
+
+func TestGroupDuplicatesMatchesPairwise(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	// a few base hashes with variations of them, so that there are groups
+	// that are chained together through images in the middle
+	var images []Image
+	for i := 0; i < 500; i++ {
+		img := Image{
+			Filename: fmt.Sprintf("%03d.jpg", i),
+			Checksum: fmt.Sprint(rng.Intn(400)),
+		}
+		if rng.Intn(10) > 0 {
+			h := uint64(rng.Intn(20)) * 0x0123456789abcdef
+			for flips := rng.Intn(14); flips > 0; flips-- {
+				h ^= 1 << rng.Intn(64)
+			}
+			img.DHash = &h
+		}
+		images = append(images, img)
+	}
+
+	for _, maxDistance := range []int{0, 3, DefaultDuplicateDistance} {
+		got := filenames(groupDuplicates(images, maxDistance))
+		want := pairwiseDuplicates(images, maxDistance)
+		// groupDuplicates shows exact copies first, so only the sets of groups are compared
+		if !sameGroups(got, want) {
+			t.Errorf("distance %d: got %d groups, want %d: %v, want %v", maxDistance, len(got), len(want), got, want)
+		}
+	}
+}
+
+func sameGroups(a, b [][]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]bool)
+	for _, group := range a {
+		seen[fmt.Sprint(group)] = true
+	}
+	for _, group := range b {
+		if !seen[fmt.Sprint(group)] {
+			return false
+		}
+	}
+	return true
+}
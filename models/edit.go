@@ -0,0 +1,320 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"time"
+)
+
+// EditOp is a kind of edit that can be made to an image
+type EditOp string
+
+const (
+	EditCrop       EditOp = "crop"
+	EditRotate     EditOp = "rotate"
+	EditBrightness EditOp = "brightness"
+	EditContrast   EditOp = "contrast"
+)
+
+// Edit is a single step in the edit history of an image. Edits are never
+// applied to the stored file; they are replayed on top of the original
+// whenever a rendition of the image is generated.
+type Edit struct {
+	Op EditOp `json:"op"`
+	// Amount is the clockwise angle in degrees for EditRotate, which is
+	// stored as 0, 90, 180 or 270, and between -100 and 100 for
+	// EditBrightness and EditContrast.
+	Amount float64 `json:"amount,omitempty"`
+	// Crop is the part of the image that is kept by EditCrop
+	Crop      *CropRect `json:"crop,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CropRect is a rectangle in fractions (0 to 1) of the width and height of
+// the image it is applied to, so that it doesn't depend on the size of the
+// preview it was selected on.
+type CropRect struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// EditError is returned when an edit can't be added because it isn't valid.
+type EditError struct {
+	Issue string
+}
+
+func (ee EditError) Error() string {
+	return fmt.Sprintf("invalid edit: %v", ee.Issue)
+}
+
+func (edit Edit) validate() error {
+	switch edit.Op {
+	case EditCrop:
+		c := edit.Crop
+		if c == nil || c.X < 0 || c.Y < 0 || c.Width <= 0 || c.Height <= 0 || c.X+c.Width > 1 || c.Y+c.Height > 1 {
+			return EditError{Issue: fmt.Sprintf("crop %+v", c)}
+		}
+	case EditRotate:
+		if math.Mod(edit.Amount, 90) != 0 || math.Abs(edit.Amount) >= 360 {
+			return EditError{Issue: fmt.Sprintf("rotation %v, it has to be a multiple of 90 below 360", edit.Amount)}
+		}
+	case EditBrightness, EditContrast:
+		if edit.Amount < -100 || edit.Amount > 100 {
+			return EditError{Issue: fmt.Sprintf("%v %v", edit.Op, edit.Amount)}
+		}
+	default:
+		return EditError{Issue: fmt.Sprintf("unknown edit %q", edit.Op)}
+	}
+	return nil
+}
+
+// String describes the edit for the edit history
+func (edit Edit) String() string {
+	switch edit.Op {
+	case EditCrop:
+		return fmt.Sprintf("Crop to %.0f%% × %.0f%%", edit.Crop.Width*100, edit.Crop.Height*100)
+	case EditRotate:
+		return fmt.Sprintf("Rotate %+.0f°", edit.Amount)
+	case EditBrightness:
+		return fmt.Sprintf("Brightness %+.0f", edit.Amount)
+	case EditContrast:
+		return fmt.Sprintf("Contrast %+.0f", edit.Amount)
+	}
+	return string(edit.Op)
+}
+
+// editsFingerprint changes whenever the result of applying edits changes. It is empty when there are no edits.
+func editsFingerprint(edits []Edit) string {
+	if len(edits) == 0 {
+		return ""
+	}
+	h := sha256.New()
+	for _, edit := range edits {
+		fmt.Fprintf(h, "%v|%v|%+v;", edit.Op, edit.Amount, edit.Crop)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// Version identifies the current edit of the image. It is empty for an
+// unedited image and can be added to image URLs so that caches pick up edits.
+func (image Image) Version() string {
+	return editsFingerprint(image.Edits)
+}
+
+// AddEdit appends edit to the edit history of image and returns the updated image.
+func (service *GalleryService) AddEdit(image Image, edit Edit) (Image, error) {
+	err := edit.validate()
+	if err != nil {
+		return Image{}, fmt.Errorf("add edit: %w", err)
+	}
+	if edit.Op == EditRotate {
+		// -90 and 270 are the same rotation, so they are stored the same way
+		edit.Amount = math.Mod(math.Mod(edit.Amount, 360)+360, 360)
+	}
+	edit.CreatedAt = time.Now()
+	edits := append(append([]Edit(nil), image.Edits...), edit)
+	err = service.setEdits(&image, edits)
+	if err != nil {
+		return Image{}, fmt.Errorf("add edit: %w", err)
+	}
+	return image, nil
+}
+
+// UndoEdit removes the last edit from the edit history of image and returns the updated image.
+func (service *GalleryService) UndoEdit(image Image) (Image, error) {
+	if len(image.Edits) == 0 {
+		return image, nil
+	}
+	err := service.setEdits(&image, image.Edits[:len(image.Edits)-1])
+	if err != nil {
+		return Image{}, fmt.Errorf("undo edit: %w", err)
+	}
+	return image, nil
+}
+
+// RevertImage drops the whole edit history of image, so that the original is served again.
+func (service *GalleryService) RevertImage(image Image) (Image, error) {
+	if len(image.Edits) == 0 {
+		return image, nil
+	}
+	err := service.setEdits(&image, nil)
+	if err != nil {
+		return Image{}, fmt.Errorf("revert image: %w", err)
+	}
+	return image, nil
+}
+
+// setEdits replaces the edit history of image. The size and placeholders are
+// recomputed from the edited image, as that is the one being shown.
+func (service *GalleryService) setEdits(target *Image, edits []Edit) error {
+	obj, err := service.OpenImage(*target)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	img, _, err := image.Decode(obj)
+	if err != nil {
+		return fmt.Errorf("decoding %v: %w", target.Filename, err)
+	}
+	edited := applyEdits(img, edits)
+
+	if edits == nil {
+		edits = []Edit{}
+	}
+	newEdits, err := editsToDB(edits)
+	if err != nil {
+		return err
+	}
+	oldEdits, err := editsToDB(target.Edits)
+	if err != nil {
+		return err
+	}
+	updated := *target
+	updated.Edits = edits
+	updated.Width = edited.Bounds().Dx()
+	updated.Height = edited.Bounds().Dy()
+	updated.BlurHash = blurHash(edited)
+	updated.DominantColor = dominantColor(edited)
+
+	// only update the image if nobody else has changed its history in the meantime
+	res, err := service.DB.Exec(`
+	UPDATE images
+	SET edits = $2::jsonb, width = $3, height = $4, blurhash = $5, dominant_color = $6
+	WHERE id = $1 AND edits = $7::jsonb;`, target.ID, newEdits, updated.Width,
+		updated.Height, updated.BlurHash, updated.DominantColor, oldEdits)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%v was edited by another request", target.Filename)
+	}
+
+	// renditions of the old edits won't be served again
+	err = service.removeRenditions(*target)
+	if err != nil {
+		return err
+	}
+	*target = updated
+	return nil
+}
+
+// applyEdits replays edits on top of img and returns the result
+func applyEdits(img image.Image, edits []Edit) image.Image {
+	if len(edits) == 0 {
+		return img
+	}
+	bounds := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+
+	for _, edit := range edits {
+		switch edit.Op {
+		case EditCrop:
+			dst = crop(dst, *edit.Crop)
+		case EditRotate:
+			dst = rotate(dst, int(edit.Amount))
+		case EditBrightness:
+			offset := edit.Amount / 100 * 255
+			adjust(dst, func(v float64) float64 { return v + offset })
+		case EditContrast:
+			// the usual contrast correction factor, with the amount scaled to -255..255
+			c := edit.Amount * 2.55
+			factor := 259 * (c + 255) / (255 * (259 - c))
+			adjust(dst, func(v float64) float64 { return factor*(v-128) + 128 })
+		}
+	}
+	return dst
+}
+
+func crop(img *image.NRGBA, rect CropRect) *image.NRGBA {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	r := image.Rect(
+		int(math.Round(rect.X*float64(w))),
+		int(math.Round(rect.Y*float64(h))),
+		int(math.Round((rect.X+rect.Width)*float64(w))),
+		int(math.Round((rect.Y+rect.Height)*float64(h))),
+	).Intersect(img.Bounds())
+	// always keep at least a single pixel
+	if r.Min.X > w-1 {
+		r.Min.X = w - 1
+	}
+	if r.Min.Y > h-1 {
+		r.Min.Y = h - 1
+	}
+	if r.Max.X <= r.Min.X {
+		r.Max.X = r.Min.X + 1
+	}
+	if r.Max.Y <= r.Min.Y {
+		r.Max.Y = r.Min.Y + 1
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, r.Min, draw.Src)
+	return dst
+}
+
+// rotate turns img clockwise by degrees, which must be a multiple of 90
+func rotate(img *image.NRGBA, degrees int) *image.NRGBA {
+	degrees = (degrees%360 + 360) % 360
+	if degrees == 0 {
+		return img
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	var dst *image.NRGBA
+	if degrees == 180 {
+		dst = image.NewNRGBA(image.Rect(0, 0, w, h))
+	} else {
+		dst = image.NewNRGBA(image.Rect(0, 0, h, w))
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := img.NRGBAAt(x, y)
+			switch degrees {
+			case 90:
+				dst.SetNRGBA(h-1-y, x, c)
+			case 180:
+				dst.SetNRGBA(w-1-x, h-1-y, c)
+			case 270:
+				dst.SetNRGBA(y, w-1-x, c)
+			}
+		}
+	}
+	return dst
+}
+
+// adjust maps every colour channel of img through f, leaving alpha alone
+func adjust(img *image.NRGBA, f func(float64) float64) {
+	var lookup [256]uint8
+	for v := range lookup {
+		lookup[v] = uint8(math.Max(0, math.Min(255, math.Round(f(float64(v))))))
+	}
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		for x := 0; x < img.Bounds().Dx(); x++ {
+			c := img.NRGBAAt(x, y)
+			img.SetNRGBA(x, y, color.NRGBA{R: lookup[c.R], G: lookup[c.G], B: lookup[c.B], A: c.A})
+		}
+	}
+}
+
+// editsToDB encodes edits as the JSON array stored in the images table
+func editsToDB(edits []Edit) (string, error) {
+	if edits == nil {
+		edits = []Edit{}
+	}
+	b, err := json.Marshal(edits)
+	if err != nil {
+		return "", fmt.Errorf("encoding edits: %w", err)
+	}
+	return string(b), nil
+}
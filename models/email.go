@@ -2,6 +2,8 @@ package models
 
 import (
 	"fmt"
+	"html"
+	"time"
 
 	"github.com/go-mail/mail/v2"
 )
@@ -93,3 +95,133 @@ func (es *EmailService) ForgotPassword(to, resetURL string) error {
 	}
 	return nil
 }
+
+// SignInLink sends a user a link to sign in without their password
+func (es *EmailService) SignInLink(to, signInURL string) error {
+	email := Email{
+		Subject:   "Your sign in link",
+		To:        to,
+		Plaintext: "To sign in to LensPix, please visit the following link. It can only be used once and only works for a few minutes: " + signInURL,
+		HTML:      `<p>To sign in to LensPix, please visit the following link. It can only be used once and only works for a few minutes: <a href="` + signInURL + `">` + signInURL + `</a></p>`,
+	}
+
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("sign in link email: %w", err)
+	}
+	return nil
+}
+
+// VerifyEmail asks a user to confirm a new email address for their account
+func (es *EmailService) VerifyEmail(to, verifyURL string) error {
+	email := Email{
+		Subject:   "Confirm your new email address",
+		To:        to,
+		Plaintext: "To use this email address for your LensPix account, please visit the following link: " + verifyURL,
+		HTML:      `<p>To use this email address for your LensPix account, please visit the following link: <a href="` + verifyURL + `">` + verifyURL + `</a></p>`,
+	}
+
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("verify email: %w", err)
+	}
+	return nil
+}
+
+// EmailChanged lets a user know at their old address that the email address of their account was changed
+func (es *EmailService) EmailChanged(to, newEmail string) error {
+	email := Email{
+		Subject:   "Your email address was changed",
+		To:        to,
+		Plaintext: "The email address of your LensPix account was changed to " + newEmail + ". If you didn't do this, please contact us right away.",
+		HTML:      `<p>The email address of your LensPix account was changed to ` + html.EscapeString(newEmail) + `. If you didn't do this, please contact us right away.</p>`,
+	}
+
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("email changed email: %w", err)
+	}
+	return nil
+}
+
+// PasswordChanged lets a user know that the password of their account was changed
+func (es *EmailService) PasswordChanged(to string) error {
+	email := Email{
+		Subject:   "Your password was changed",
+		To:        to,
+		Plaintext: "The password of your LensPix account was changed and you were signed out on your other devices. If you didn't do this, please reset your password right away.",
+		HTML:      `<p>The password of your LensPix account was changed and you were signed out on your other devices. If you didn't do this, please reset your password right away.</p>`,
+	}
+
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("password changed email: %w", err)
+	}
+	return nil
+}
+
+// AccountDeletionScheduled lets a user know when their account will be deleted, and how to keep it
+func (es *EmailService) AccountDeletionScheduled(to string, deleteAt time.Time) error {
+	date := deleteAt.Format("January 2, 2006")
+	email := Email{
+		Subject:   "Your account will be deleted",
+		To:        to,
+		Plaintext: "Your LensPix account and all of your galleries will be deleted on " + date + ". If you changed your mind, sign in and cancel the deletion in your account settings before then.",
+		HTML:      `<p>Your LensPix account and all of your galleries will be deleted on ` + date + `. If you changed your mind, sign in and cancel the deletion in your account settings before then.</p>`,
+	}
+
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("account deletion scheduled email: %w", err)
+	}
+	return nil
+}
+
+// AccountDeleted confirms to a user that their account and all of its data have been deleted
+func (es *EmailService) AccountDeleted(to string) error {
+	email := Email{
+		Subject:   "Your account was deleted",
+		To:        to,
+		Plaintext: "Your LensPix account, your galleries and all of your images have been deleted. Thank you for using LensPix.",
+		HTML:      `<p>Your LensPix account, your galleries and all of your images have been deleted. Thank you for using LensPix.</p>`,
+	}
+
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("account deleted email: %w", err)
+	}
+	return nil
+}
+
+// DataExportReady sends a user the link to download the archive with their data
+func (es *EmailService) DataExportReady(to, downloadURL string, expiresAt time.Time) error {
+	date := expiresAt.Format("January 2, 2006")
+	email := Email{
+		Subject:   "Your data is ready to download",
+		To:        to,
+		Plaintext: "The archive with your LensPix data is ready. You can download it until " + date + " at the following link: " + downloadURL,
+		HTML:      `<p>The archive with your LensPix data is ready. You can download it until ` + date + ` at the following link: <a href="` + downloadURL + `">` + downloadURL + `</a></p>`,
+	}
+
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("data export ready email: %w", err)
+	}
+	return nil
+}
+
+// DataExportFailed lets a user know that the archive with their data couldn't be built
+func (es *EmailService) DataExportFailed(to string) error {
+	email := Email{
+		Subject:   "Your data couldn't be exported",
+		To:        to,
+		Plaintext: "Something went wrong while putting together the archive with your LensPix data. Please ask for it again in your account settings.",
+		HTML:      `<p>Something went wrong while putting together the archive with your LensPix data. Please ask for it again in your account settings.</p>`,
+	}
+
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("data export failed email: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ayushthe1/lenspix/rand"
+)
+
+// EmailChange is a request of a user to change their email address. It only
+// takes effect once the new address has been verified with the token.
+type EmailChange struct {
+	ID     int
+	UserID int
+	// Email is the new email address
+	Email string
+	// Token is only set when an EmailChange is created
+	Token     string
+	Tokenhash string
+	ExpiresAt time.Time
+}
+
+const (
+	// DefaultEmailChangeDuration is the default time that an EmailChange is
+	// valid for.
+	DefaultEmailChangeDuration = 24 * time.Hour
+)
+
+type EmailChangeService struct {
+	DB *sql.DB
+	// BytesPerToken is used to determine how many bytes to use when generating
+	// each verification token. If this value is not set or is less than the
+	// MinBytesPerToken const it will be ignored and MinBytesPerToken will be
+	// used.
+	BytesPerToken int
+	// Duration is the amount of time that an EmailChange is valid for.
+	// Defaults to DefaultEmailChangeDuration
+	Duration time.Duration
+}
+
+// Create starts changing the email address of a user. A user only has one
+// pending change at a time, so any earlier one stops working. ErrEmailTaken
+// is returned if another user already has the new address.
+func (service *EmailChangeService) Create(userID int, email string) (*EmailChange, error) {
+	email = strings.ToLower(email)
+	var taken bool
+	row := service.DB.QueryRow(`
+	SELECT EXISTS (SELECT 1 FROM users WHERE email = $1);`, email)
+	err := row.Scan(&taken)
+	if err != nil {
+		return nil, fmt.Errorf("create email change: %w", err)
+	}
+	if taken {
+		return nil, ErrEmailTaken
+	}
+
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create email change: %w", err)
+	}
+	duration := service.Duration
+	if duration == 0 {
+		duration = DefaultEmailChangeDuration
+	}
+
+	change := EmailChange{
+		UserID:    userID,
+		Email:     email,
+		Token:     token,
+		Tokenhash: service.hash(token),
+		ExpiresAt: time.Now().Add(duration),
+	}
+	row = service.DB.QueryRow(`
+	INSERT INTO email_changes (user_id, email, token_hash, expires_at)
+	VALUES ($1, $2, $3, $4) ON CONFLICT (user_id) DO
+	UPDATE
+	SET email = $2, token_hash = $3, expires_at = $4
+	RETURNING id;`, change.UserID, change.Email, change.Tokenhash, change.ExpiresAt)
+	err = row.Scan(&change.ID)
+	if err != nil {
+		return nil, fmt.Errorf("create email change: %w", err)
+	}
+	return &change, nil
+}
+
+// Consume looks up the email change of a verification token and deletes it,
+// so that the token can only be used once. ErrNotFound is returned if the
+// token isn't valid (anymore).
+func (service *EmailChangeService) Consume(token string) (*EmailChange, error) {
+	change := EmailChange{
+		Tokenhash: service.hash(token),
+	}
+	row := service.DB.QueryRow(`
+	DELETE FROM email_changes
+	WHERE token_hash = $1
+	RETURNING id, user_id, email, expires_at;`, change.Tokenhash)
+	err := row.Scan(&change.ID, &change.UserID, &change.Email, &change.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("consume email change: %w", err)
+	}
+	if time.Now().After(change.ExpiresAt) {
+		return nil, fmt.Errorf("consume email change: token expired: %w", ErrNotFound)
+	}
+	return &change, nil
+}
+
+// DeleteExpired deletes the email changes that have expired, and returns how many
+// there were.
+func (service *EmailChangeService) DeleteExpired() (int, error) {
+	result, err := service.DB.Exec(`
+	DELETE FROM email_changes
+	WHERE expires_at < now();`)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired email changes: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete expired email changes: %w", err)
+	}
+	return int(n), nil
+}
+
+// function for hashing the token
+func (service *EmailChangeService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
@@ -12,6 +12,24 @@ import (
 var (
 	ErrEmailTaken = errors.New("models: email address is already in use")
 	ErrNotFound   = errors.New("models: resource could not be found")
+	// ErrDuplicateImage is returned when an exact copy of an image already exists in the gallery
+	ErrDuplicateImage = errors.New("models: image already exists in the gallery")
+	// ErrQuarantined is returned when an upload couldn't be scanned and was put aside for an admin to review
+	ErrQuarantined = errors.New("models: upload was quarantined")
+	// ErrFilenameTaken is returned when renaming an image to the name of another image in the same gallery
+	ErrFilenameTaken = errors.New("models: filename is already in use")
+	// ErrUsernameTaken is returned when a user picks a username that another user already has
+	ErrUsernameTaken = errors.New("models: username is already in use")
+	// ErrSlugTaken is returned when giving a gallery the slug of another gallery of the same user
+	ErrSlugTaken = errors.New("models: slug is already in use")
+	// ErrEmailUnverified is returned when an identity provider doesn't vouch for the email address of a new user
+	ErrEmailUnverified = errors.New("models: email address isn't verified by the identity provider")
+	// ErrInviteInvalid is returned when signing up with an invite code that doesn't exist, is used up or has expired
+	ErrInviteInvalid = errors.New("models: invite code is invalid")
+	// ErrSignUpClosed is returned when an account would have to be created while registration isn't open
+	ErrSignUpClosed = errors.New("models: registration is closed")
+	// ErrAccountSuspended is returned when signing in to an account that an admin has suspended
+	ErrAccountSuspended = errors.New("models: account is suspended")
 )
 
 // custome error type which implements the error interface
@@ -23,29 +41,33 @@ func (fe FileError) Error() string {
 	return fmt.Sprintf("invalid file: %v", fe.Issue)
 }
 
-func checkContentType(r io.ReadSeeker, allowedTypes []string) error {
+// checkContentType sniffs the content type of r and returns it if it is one of the allowedTypes
+func checkContentType(r io.ReadSeeker, allowedTypes []string) (string, error) {
 	//  io.ReadSeeker so that we can reset the file after reading some of it.
 	// we only need to check the first 512 bytes from the file
 	testBytes := make([]byte, 512)
 	_, err := r.Read(testBytes) // read the first 512 bytes
+	if err == io.EOF {
+		return "", FileError{Issue: "the file is empty"}
+	}
 	if err != nil {
 		// fmt.Errorf calls the .Error() method on err to obtain the string representation of the error.
-		return fmt.Errorf("checking content type: %w", err)
+		return "", fmt.Errorf("checking content type: %w", err)
 	}
 
 	// reset the file
 	_, err = r.Seek(0, 0)
 	if err != nil {
-		return fmt.Errorf("checking content type: %w", err)
+		return "", fmt.Errorf("checking content type: %w", err)
 	}
 
 	contentType := http.DetectContentType(testBytes)
 	for _, t := range allowedTypes {
 		if contentType == t {
-			return nil
+			return contentType, nil
 		}
 	}
-	return FileError{
+	return "", FileError{
 		Issue: fmt.Sprintf("invalid content type: %v", contentType),
 	}
 
@@ -0,0 +1,483 @@
+package models
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/ayushthe1/lenspix/rand"
+)
+
+// The states of an Export
+const (
+	ExportPending = "pending"
+	ExportRunning = "running"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+const (
+	// DefaultExportDuration is the default time that the archive of an
+	// Export can be downloaded for.
+	DefaultExportDuration = 7 * 24 * time.Hour
+	// exportTimeout is how long an export can be running before it is
+	// assumed that the process building it died, and it is started over.
+	exportTimeout = time.Hour
+)
+
+// Export is an archive with all of the data of a user, along with the
+// original files of their images.
+type Export struct {
+	ID     int
+	UserID int
+	Status string
+	// Error is why the export failed
+	Error string
+	// Token is only set when the archive has just been built
+	Token     string
+	Key       string
+	Size      int64
+	CreatedAt time.Time
+	ExpiresAt *time.Time
+}
+
+type ExportService struct {
+	DB *sql.DB
+	// GalleryService is used to read the galleries and images of users
+	GalleryService *GalleryService
+	// BytesPerToken is used to determine how many bytes to use when generating
+	// each download token. If this value is not set or is less than the
+	// MinBytesPerToken const it will be ignored and MinBytesPerToken will be
+	// used.
+	BytesPerToken int
+	// Duration is the amount of time that the archive of an export can be
+	// downloaded for. Defaults to DefaultExportDuration
+	Duration time.Duration
+}
+
+// Request asks for the data of a user to be exported. The archive is built in
+// the background by RunNext. If an export of the user is already waiting to
+// be built, that export is returned instead.
+func (service *ExportService) Request(userID int) (*Export, error) {
+	exports, err := service.queryExports(`
+	WHERE user_id = $1 AND status IN ($2, $3);`, userID, ExportPending, ExportRunning)
+	if err != nil {
+		return nil, fmt.Errorf("request export: %w", err)
+	}
+	if len(exports) > 0 {
+		return &exports[0], nil
+	}
+
+	export := Export{
+		UserID: userID,
+		Status: ExportPending,
+	}
+	row := service.DB.QueryRow(`
+	INSERT INTO data_exports (user_id, status)
+	VALUES ($1, $2)
+	RETURNING id, created_at;`, userID, export.Status)
+	err = row.Scan(&export.ID, &export.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("request export: %w", err)
+	}
+	return &export, nil
+}
+
+// Latest returns the most recent export of a user, or ErrNotFound if they never asked for one.
+func (service *ExportService) Latest(userID int) (*Export, error) {
+	exports, err := service.queryExports(`
+	WHERE user_id = $1
+	ORDER BY id DESC
+	LIMIT 1;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("latest export: %w", err)
+	}
+	if len(exports) == 0 {
+		return nil, ErrNotFound
+	}
+	return &exports[0], nil
+}
+
+// RunNext builds the archive of the oldest export that is waiting, and returns
+// the export with its download Token set. Exports that fail are returned with
+// the ExportFailed status. nil is returned if there is nothing to do.
+func (service *ExportService) RunNext() (*Export, error) {
+	// claim the export in a single statement, so that no two processes build the same one
+	var export Export
+	row := service.DB.QueryRow(`
+	UPDATE data_exports
+	SET status = $1, started_at = now()
+	WHERE id = (
+		SELECT id FROM data_exports
+		WHERE status = $2 OR (status = $1 AND started_at < $3)
+		ORDER BY id
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING id, user_id, status, created_at;`, ExportRunning, ExportPending, time.Now().Add(-exportTimeout))
+	err := row.Scan(&export.ID, &export.UserID, &export.Status, &export.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("run export: %w", err)
+	}
+
+	buildErr := service.build(&export)
+	if buildErr != nil {
+		export.Status = ExportFailed
+		export.Error = buildErr.Error()
+		_, err = service.DB.Exec(`
+		UPDATE data_exports
+		SET status = $2, error = $3
+		WHERE id = $1;`, export.ID, export.Status, export.Error)
+		if err != nil {
+			return nil, fmt.Errorf("run export: %w", err)
+		}
+		return &export, nil
+	}
+
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+	export.Token, err = rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("run export: %w", err)
+	}
+	duration := service.Duration
+	if duration == 0 {
+		duration = DefaultExportDuration
+	}
+	expiresAt := time.Now().Add(duration)
+	export.ExpiresAt = &expiresAt
+	export.Status = ExportReady
+	_, err = service.DB.Exec(`
+	UPDATE data_exports
+	SET status = $2, storage_key = $3, size = $4, token_hash = $5, expires_at = $6
+	WHERE id = $1;`, export.ID, export.Status, export.Key, export.Size, service.hash(export.Token), export.ExpiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("run export: %w", err)
+	}
+	return &export, nil
+}
+
+// ByToken returns a ready export of a user by its id and download token.
+// ErrNotFound is returned if there is no such export or it has expired.
+func (service *ExportService) ByToken(userID, id int, token string) (*Export, error) {
+	exports, err := service.queryExports(`
+	WHERE id = $1 AND user_id = $2 AND status = $3 AND token_hash = $4 AND expires_at > now();`,
+		id, userID, ExportReady, service.hash(token))
+	if err != nil {
+		return nil, fmt.Errorf("export by token: %w", err)
+	}
+	if len(exports) == 0 {
+		return nil, ErrNotFound
+	}
+	return &exports[0], nil
+}
+
+// Open opens the archive of a ready export. Callers must close it.
+func (service *ExportService) Open(export Export) (*Object, error) {
+	obj, err := service.GalleryService.storage().Open(export.Key)
+	if err != nil {
+		return nil, fmt.Errorf("open export: %w", err)
+	}
+	return obj, nil
+}
+
+// PurgeExpired deletes the exports whose archives have expired, and returns how many there were.
+func (service *ExportService) PurgeExpired() (int, error) {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("purge expired exports: %w", err)
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(`
+	DELETE FROM data_exports
+	WHERE expires_at < now() OR (status = $1 AND created_at < now() - interval '30 days')
+	RETURNING storage_key;`, ExportFailed)
+	if err != nil {
+		return 0, fmt.Errorf("purge expired exports: %w", err)
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		err = rows.Scan(&key)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("purge expired exports: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return 0, fmt.Errorf("purge expired exports: %w", rows.Err())
+	}
+
+	var deletionIDs []int
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		id, err := enqueueDeletion(tx, deleteObject, key)
+		if err != nil {
+			return 0, fmt.Errorf("purge expired exports: %w", err)
+		}
+		deletionIDs = append(deletionIDs, id)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("purge expired exports: %w", err)
+	}
+	service.GalleryService.runDeletions(deletionIDs)
+	return len(keys), nil
+}
+
+// exportsPrefix is where the export archives of a user are kept
+func exportsPrefix(userID int) string {
+	return fmt.Sprintf("exports/user-%d", userID)
+}
+
+// exportManifest is the manifest.json at the root of an export archive
+type exportManifest struct {
+	ExportedAt time.Time         `json:"exported_at"`
+	Profile    exportProfile     `json:"profile"`
+	Galleries  []exportedGallery `json:"galleries"`
+}
+
+type exportProfile struct {
+	ID          int    `json:"id"`
+	Email       string `json:"email"`
+	Username    string `json:"username,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+	Bio         string `json:"bio,omitempty"`
+	Website     string `json:"website,omitempty"`
+	// Avatar is the path of the avatar inside the archive, empty if there is none
+	Avatar string `json:"avatar,omitempty"`
+}
+
+type exportedGallery struct {
+	ID         int             `json:"id"`
+	Title      string          `json:"title"`
+	Slug       string          `json:"slug"`
+	Visibility Visibility      `json:"visibility"`
+	DeletedAt  *time.Time      `json:"deleted_at,omitempty"`
+	Images     []exportedImage `json:"images"`
+}
+
+type exportedImage struct {
+	ID       int    `json:"id"`
+	Filename string `json:"filename"`
+	// File is the path of the original file inside the archive, empty if it couldn't be read
+	File        string     `json:"file,omitempty"`
+	Checksum    string     `json:"checksum"`
+	Size        int64      `json:"size"`
+	ContentType string     `json:"content_type"`
+	Width       int        `json:"width"`
+	Height      int        `json:"height"`
+	Caption     string     `json:"caption,omitempty"`
+	Visibility  Visibility `json:"visibility,omitempty"`
+	Edits       []Edit     `json:"edits,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+}
+
+// build writes the archive of an export to the storage and sets its Key and Size
+func (service *ExportService) build(export *Export) error {
+	manifest := exportManifest{
+		ExportedAt: time.Now(),
+		Profile: exportProfile{
+			ID: export.UserID,
+		},
+	}
+	var avatarKey string
+	row := service.DB.QueryRow(`
+	SELECT email, COALESCE(username, ''), display_name, bio, website, avatar_key
+	FROM users WHERE id = $1;`, export.UserID)
+	err := row.Scan(&manifest.Profile.Email, &manifest.Profile.Username, &manifest.Profile.DisplayName,
+		&manifest.Profile.Bio, &manifest.Profile.Website, &avatarKey)
+	if err != nil {
+		return fmt.Errorf("build export: %w", err)
+	}
+
+	// the archive can be large, so it is put together on disk rather than in memory
+	tmp, err := os.CreateTemp("", "lenspix-export-*.zip")
+	if err != nil {
+		return fmt.Errorf("build export: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	archive := zip.NewWriter(tmp)
+	if avatarKey != "" {
+		manifest.Profile.Avatar = "avatar" + path.Ext(avatarKey)
+		err = service.addFile(archive, manifest.Profile.Avatar, avatarKey, manifest.ExportedAt)
+		if errors.Is(err, ErrNotFound) {
+			manifest.Profile.Avatar = ""
+		} else if err != nil {
+			return fmt.Errorf("build export: %w", err)
+		}
+	}
+	galleries, err := service.userGalleries(export.UserID)
+	if err != nil {
+		return fmt.Errorf("build export: %w", err)
+	}
+	for _, gallery := range galleries {
+		exported := exportedGallery{
+			ID:         gallery.ID,
+			Title:      gallery.Title,
+			Slug:       gallery.Slug,
+			Visibility: gallery.Visibility,
+			DeletedAt:  gallery.DeletedAt,
+		}
+		images, err := service.GalleryService.queryImages(`
+		WHERE images.gallery_id = $1
+		ORDER BY images.id;`, gallery.ID)
+		if err != nil {
+			return fmt.Errorf("build export: %w", err)
+		}
+		for _, image := range images {
+			file := path.Join("images", galleryPrefix(gallery.ID), fmt.Sprintf("%d-%s", image.ID, image.Filename))
+			err = service.addFile(archive, file, image.Key, image.CreatedAt)
+			if errors.Is(err, ErrNotFound) {
+				// the manifest still describes the image, fsck reports the missing file
+				file = ""
+			} else if err != nil {
+				return fmt.Errorf("build export: %w", err)
+			}
+			exported.Images = append(exported.Images, exportedImage{
+				ID:          image.ID,
+				Filename:    image.Filename,
+				File:        file,
+				Checksum:    image.Checksum,
+				Size:        image.Size,
+				ContentType: image.ContentType,
+				Width:       image.Width,
+				Height:      image.Height,
+				Caption:     image.Caption,
+				Visibility:  image.Visibility,
+				Edits:       image.Edits,
+				CreatedAt:   image.CreatedAt,
+				DeletedAt:   image.DeletedAt,
+			})
+		}
+		manifest.Galleries = append(manifest.Galleries, exported)
+	}
+
+	f, err := archive.Create("manifest.json")
+	if err != nil {
+		return fmt.Errorf("build export: %w", err)
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(manifest)
+	if err != nil {
+		return fmt.Errorf("build export: %w", err)
+	}
+	err = archive.Close()
+	if err != nil {
+		return fmt.Errorf("build export: %w", err)
+	}
+
+	export.Size, err = tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("build export: %w", err)
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("build export: %w", err)
+	}
+	b, err := rand.Bytes(16)
+	if err != nil {
+		return fmt.Errorf("build export: %w", err)
+	}
+	export.Key = path.Join(exportsPrefix(export.UserID), hex.EncodeToString(b)+".zip")
+	err = service.GalleryService.storage().Create(export.Key, tmp)
+	if err != nil {
+		return fmt.Errorf("build export: %w", err)
+	}
+	return nil
+}
+
+// userGalleries returns every gallery of a user, including the ones in the trash
+func (service *ExportService) userGalleries(userID int) ([]Gallery, error) {
+	rows, err := service.DB.Query(`
+	SELECT id, title, slug, visibility, deleted_at
+	FROM galleries
+	WHERE user_id = $1
+	ORDER BY id;`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var galleries []Gallery
+	for rows.Next() {
+		gallery := Gallery{
+			UserID: userID,
+		}
+		err = rows.Scan(&gallery.ID, &gallery.Title, &gallery.Slug, &gallery.Visibility, &gallery.DeletedAt)
+		if err != nil {
+			return nil, err
+		}
+		galleries = append(galleries, gallery)
+	}
+	return galleries, rows.Err()
+}
+
+// addFile adds a file from the storage, like the original file of an image, to the archive
+func (service *ExportService) addFile(archive *zip.Writer, name, key string, modified time.Time) error {
+	obj, err := service.GalleryService.storage().Open(key)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	f, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store, // images are already compressed
+		Modified: modified,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, obj)
+	return err
+}
+
+// queryExports returns the exports matching the given WHERE (and ORDER BY) clause
+func (service *ExportService) queryExports(where string, args ...interface{}) ([]Export, error) {
+	rows, err := service.DB.Query(`
+	SELECT id, user_id, status, error, storage_key, size, created_at, expires_at
+	FROM data_exports
+	`+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var exports []Export
+	for rows.Next() {
+		var export Export
+		err = rows.Scan(&export.ID, &export.UserID, &export.Status, &export.Error, &export.Key,
+			&export.Size, &export.CreatedAt, &export.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		exports = append(exports, export)
+	}
+	return exports, rows.Err()
+}
+
+// function for hashing the token
+func (service *ExportService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
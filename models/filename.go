@@ -0,0 +1,93 @@
+package models
+
+import (
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ayushthe1/lenspix/rand"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	// MaxFilenameBytes is the longest filename we keep for an image. Most
+	// filesystems and browsers are fine with 255 bytes, but we leave some room
+	// for the " (2)" style suffixes added when names collide.
+	MaxFilenameBytes = 200
+
+	// the name used when nothing is left of a filename after sanitizing it
+	defaultFilename = "image"
+)
+
+// SanitizeFilename turns a client supplied filename into one that is safe to
+// show and to use in URLs. Any directories are dropped, control and reserved
+// characters are replaced, unicode is normalized and the name is shortened
+// to MaxFilenameBytes while keeping its extension.
+func SanitizeFilename(filename string) string {
+	// browsers on windows may send the full path, so drop everything up to the last separator of either kind
+	if i := strings.LastIndexAny(filename, `/\`); i >= 0 {
+		filename = filename[i+1:]
+	}
+	filename = norm.NFC.String(strings.ToValidUTF8(filename, ""))
+
+	filename = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r), unicode.Is(unicode.Cf, r):
+			return -1
+		case strings.ContainsRune(`<>:"|?*`, r):
+			return '_'
+		case unicode.IsSpace(r):
+			return ' '
+		}
+		return r
+	}, filename)
+
+	// leading dots would make hidden files or "..", and trailing dots and spaces are dropped by windows
+	filename = strings.TrimLeft(filename, ". ")
+	filename = strings.TrimRight(filename, ". ")
+
+	ext := path.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	if len(ext) > 16 {
+		// not a real extension, so treat it as part of the name
+		base, ext = filename, ""
+	}
+	if base == "" {
+		base = defaultFilename
+	}
+	return truncateUTF8(base, MaxFilenameBytes-len(ext)) + ext
+}
+
+// withSuffix adds a " (n)" suffix before the extension of filename, eg "cat (2).png"
+func withSuffix(filename string, n int) string {
+	ext := path.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	suffix := fmt.Sprintf(" (%d)", n)
+	return truncateUTF8(base, MaxFilenameBytes-len(ext)-len(suffix)) + suffix + ext
+}
+
+// truncateUTF8 shortens s to at most n bytes without cutting a character in half.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// newImageKey generates a random storage key for an image in a gallery. The
+// extension of the original filename is kept so that the stored files are
+// still easy to work with.
+func newImageKey(galleryID int, filename string) (string, error) {
+	b, err := rand.Bytes(16)
+	if err != nil {
+		return "", fmt.Errorf("new image key: %w", err)
+	}
+	ext := strings.ToLower(path.Ext(filename))
+	return path.Join(galleryPrefix(galleryID), hex.EncodeToString(b)+ext), nil
+}
@@ -0,0 +1,404 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// untrackedFileAge is how old a file without an image has to be before it is
+// reported as untracked. Uploads, copies and moves store their files before
+// the rows that point at them are committed, so younger files might just be
+// on their way into a gallery.
+const untrackedFileAge = time.Hour
+
+// The kinds of problems found by Check
+const (
+	// ProblemOrphanedGallery is a gallery-{id} prefix in the storage without a gallery in the database
+	ProblemOrphanedGallery = "orphaned gallery"
+	// ProblemMissingFile is an image whose file isn't in the storage
+	ProblemMissingFile = "missing file"
+	// ProblemChecksumMismatch is an image whose file doesn't match the checksum in the database
+	ProblemChecksumMismatch = "checksum mismatch"
+	// ProblemInvalidContent is an image whose file isn't one of the image types we accept
+	ProblemInvalidContent = "invalid content type"
+	// ProblemUntrackedFile is a file of a gallery without an image in the database, like the ones that were uploaded
+	// before images were stored in the database
+	ProblemUntrackedFile = "untracked file"
+)
+
+// Problem is an inconsistency between the database and the storage.
+type Problem struct {
+	Kind string
+	// Key is the storage key (or prefix) the problem is about
+	Key       string
+	GalleryID int
+	// ImageID is 0 for problems that aren't about a single image
+	ImageID int
+	Detail  string
+}
+
+func (p Problem) String() string {
+	if p.Detail == "" {
+		return fmt.Sprintf("%v: %v", p.Kind, p.Key)
+	}
+	return fmt.Sprintf("%v: %v: %v", p.Kind, p.Key, p.Detail)
+}
+
+var galleryPrefixRegexp = regexp.MustCompile(`^gallery-(\d+)$`)
+
+// Check compares the storage with the database and returns every problem it
+// finds. The file of every image is read in full, so this can take a while.
+// Nothing is changed; see Repair.
+func (service *GalleryService) Check() ([]Problem, error) {
+	problems, err := service.checkGalleries()
+	if err != nil {
+		return nil, fmt.Errorf("check: %w", err)
+	}
+	untracked, err := service.checkUntracked()
+	if err != nil {
+		return nil, fmt.Errorf("check: %w", err)
+	}
+	problems = append(problems, untracked...)
+
+	// images in the trash still have their files, so they are checked too
+	images, err := service.queryImages(`ORDER BY images.id;`)
+	if err != nil {
+		return nil, fmt.Errorf("check: %w", err)
+	}
+	for _, image := range images {
+		problem, err := service.checkImage(image)
+		if err != nil {
+			return nil, fmt.Errorf("check: %w", err)
+		}
+		if problem != nil {
+			problems = append(problems, *problem)
+		}
+	}
+	return problems, nil
+}
+
+// checkGalleries looks for gallery prefixes in the storage that no gallery
+// owns. Prefixes that are already waiting to be deleted are left out.
+func (service *GalleryService) checkGalleries() ([]Problem, error) {
+	prefixes, err := service.storage().Prefixes("")
+	if err != nil {
+		return nil, err
+	}
+	var problems []Problem
+	for _, prefix := range prefixes {
+		match := galleryPrefixRegexp.FindStringSubmatch(prefix)
+		if match == nil {
+			continue
+		}
+		id, err := strconv.Atoi(match[1])
+		if err != nil {
+			continue
+		}
+		var owned bool
+		row := service.DB.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM galleries WHERE id = $1)
+			OR EXISTS (SELECT 1 FROM storage_deletions WHERE kind = $2 AND storage_key = $3);`,
+			id, deleteTree, prefix)
+		err = row.Scan(&owned)
+		if err != nil {
+			return nil, err
+		}
+		if !owned {
+			problems = append(problems, Problem{
+				Kind:      ProblemOrphanedGallery,
+				Key:       prefix,
+				GalleryID: id,
+			})
+		}
+	}
+	return problems, nil
+}
+
+// checkUntracked looks for files in the storage of the galleries that no
+// image points at. Renditions and quarantined uploads are kept under their own
+// prefixes, so they aren't listed. Files that are waiting to be deleted, like
+// the ones of purged or moved images, are left out, as their rows are gone
+// before the files are, and so are files younger than untrackedFileAge.
+func (service *GalleryService) checkUntracked() ([]Problem, error) {
+	rows, err := service.DB.Query(`
+	SELECT id FROM galleries
+	ORDER BY id;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var galleryIDs []int
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		galleryIDs = append(galleryIDs, id)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	var problems []Problem
+	for _, galleryID := range galleryIDs {
+		keys, err := service.storage().List(galleryPrefix(galleryID))
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			untracked, err := service.untracked(galleryID, key)
+			if err != nil {
+				return nil, err
+			}
+			if untracked {
+				untracked, err = service.oldEnough(key)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if untracked {
+				problems = append(problems, Problem{
+					Kind:      ProblemUntrackedFile,
+					Key:       key,
+					GalleryID: galleryID,
+				})
+			}
+		}
+	}
+	return problems, nil
+}
+
+// checkImage returns the problem with the file of an image, or nil if there is none
+func (service *GalleryService) checkImage(image Image) (*Problem, error) {
+	problem := Problem{
+		Key:       image.Key,
+		GalleryID: image.GalleryID,
+		ImageID:   image.ID,
+	}
+	obj, err := service.storage().Open(image.Key)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			problem.Kind = ProblemMissingFile
+			return &problem, nil
+		}
+		return nil, err
+	}
+	defer obj.Close()
+
+	contentType, err := checkContentType(obj, service.imageContentTypes())
+	if err != nil {
+		var fileErr FileError
+		if errors.As(err, &fileErr) {
+			problem.Kind = ProblemInvalidContent
+			problem.Detail = fileErr.Issue
+			return &problem, nil
+		}
+		return nil, err
+	}
+	if contentType != image.ContentType {
+		problem.Kind = ProblemInvalidContent
+		problem.Detail = fmt.Sprintf("the file is %v but the database says %v", contentType, image.ContentType)
+		return &problem, nil
+	}
+
+	checksum, _, err := hashContents(obj)
+	if err != nil {
+		return nil, err
+	}
+	if checksum != image.Checksum {
+		problem.Kind = ProblemChecksumMismatch
+		problem.Detail = fmt.Sprintf("the file has checksum %v but the database says %v", checksum, image.Checksum)
+		return &problem, nil
+	}
+	return nil, nil
+}
+
+// Repair fixes a problem found by Check:
+//
+//   - orphaned galleries are removed from the storage
+//   - images with a missing file are deleted from the database, as there is nothing left to show
+//   - images with a checksum mismatch or invalid content are quarantined, so that an admin can
+//     decide whether to release or delete them
+//   - untracked files are added to their gallery like an upload, see adoptFile
+func (service *GalleryService) Repair(problem Problem) error {
+	switch problem.Kind {
+	case ProblemOrphanedGallery:
+		id, err := enqueueDeletion(service.DB, deleteTree, problem.Key)
+		if err != nil {
+			return fmt.Errorf("repair: %w", err)
+		}
+		ok, err := service.runDeletion(id)
+		if err != nil {
+			return fmt.Errorf("repair: %w", err)
+		}
+		if !ok {
+			return fmt.Errorf("repair: removing %v failed, it will be retried", problem.Key)
+		}
+		return nil
+	case ProblemMissingFile:
+		images, err := service.queryImages(`WHERE images.id = $1;`, problem.ImageID)
+		if err != nil {
+			return fmt.Errorf("repair: %w", err)
+		}
+		if len(images) == 0 {
+			return nil
+		}
+		err = service.purgeImage(images[0])
+		if err != nil {
+			return fmt.Errorf("repair: %w", err)
+		}
+		return nil
+	case ProblemChecksumMismatch, ProblemInvalidContent:
+		err := service.quarantineImage(problem.ImageID, fmt.Sprintf("%v: %v", problem.Kind, problem.Detail))
+		if err != nil {
+			return fmt.Errorf("repair: %w", err)
+		}
+		return nil
+	case ProblemUntrackedFile:
+		err := service.adoptFile(problem.GalleryID, problem.Key)
+		if err != nil {
+			return fmt.Errorf("repair: %w", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("repair: unknown kind of problem %q", problem.Kind)
+	}
+}
+
+// quarantineImage takes an image out of its gallery and quarantines its file
+func (service *GalleryService) quarantineImage(imageID int, reason string) error {
+	images, err := service.queryImages(`WHERE images.id = $1;`, imageID)
+	if err != nil {
+		return fmt.Errorf("quarantine image: %w", err)
+	}
+	if len(images) == 0 {
+		return nil
+	}
+	image := images[0]
+
+	obj, err := service.storage().Open(image.Key)
+	if err != nil {
+		return fmt.Errorf("quarantine image: %w", err)
+	}
+	defer obj.Close()
+	checksum, size, err := hashContents(obj)
+	if err != nil {
+		return fmt.Errorf("quarantine image: %w", err)
+	}
+	err = service.quarantine(image.GalleryID, image.Filename, obj, checksum, size, image.ContentType, reason)
+	if err != nil {
+		return fmt.Errorf("quarantine image: %w", err)
+	}
+	err = service.purgeImage(image)
+	if err != nil {
+		return fmt.Errorf("quarantine image: %w", err)
+	}
+	return nil
+}
+
+// untracked reports whether no image points at the file with the key, and it
+// isn't waiting to be deleted either
+func (service *GalleryService) untracked(galleryID int, key string) (bool, error) {
+	var tracked bool
+	row := service.DB.QueryRow(`
+	SELECT EXISTS (SELECT 1 FROM images WHERE storage_key = $1)
+		OR EXISTS (SELECT 1 FROM storage_deletions
+			WHERE (kind = $2 AND storage_key = $1) OR (kind = $3 AND storage_key = $4));`,
+		key, deleteObject, deleteTree, galleryPrefix(galleryID))
+	err := row.Scan(&tracked)
+	if err != nil {
+		return false, err
+	}
+	return !tracked, nil
+}
+
+// oldEnough reports whether the file with the key was stored at least
+// untrackedFileAge ago. It is false if the file is gone.
+func (service *GalleryService) oldEnough(key string) (bool, error) {
+	obj, err := service.storage().Open(key)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	obj.Close()
+	return time.Since(obj.ModTime) >= untrackedFileAge, nil
+}
+
+// adoptFile adds an untracked file to its gallery the same way as an upload,
+// so it is checked against the image limits and quotas and scanned, and is
+// stored under a new key. Files that aren't images we accept, or that would
+// take the gallery or its user over their quota, are quarantined instead, so
+// that an admin can see them. The untracked file is removed afterwards.
+func (service *GalleryService) adoptFile(galleryID int, key string) error {
+	// the file might have been purged or moved since it was found
+	untracked, err := service.untracked(galleryID, key)
+	if err != nil {
+		return fmt.Errorf("adopt file: %w", err)
+	}
+	if !untracked {
+		return nil
+	}
+	obj, err := service.storage().Open(key)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			// removed since it was found
+			return nil
+		}
+		return fmt.Errorf("adopt file: %w", err)
+	}
+	defer obj.Close()
+	if time.Since(obj.ModTime) < untrackedFileAge {
+		// replaced since it was found, maybe by an upload that is still being committed
+		return nil
+	}
+
+	_, err = service.createImage(galleryID, path.Base(key), obj, true)
+	var fileErr FileError
+	var quotaErr QuotaError
+	var issue string
+	switch {
+	case err == nil, errors.Is(err, ErrDuplicateImage), errors.Is(err, ErrQuarantined):
+		// the gallery has the image (or the quarantine has the file), so the untracked file isn't needed anymore
+	case errors.As(err, &fileErr):
+		issue = fileErr.Issue
+	case errors.As(err, &quotaErr):
+		issue = quotaErr.Error()
+	default:
+		return fmt.Errorf("adopt file: %w", err)
+	}
+	if issue != "" {
+		err = rewind(obj)
+		if err != nil {
+			return fmt.Errorf("adopt file: %w", err)
+		}
+		checksum, size, err := hashContents(obj)
+		if err != nil {
+			return fmt.Errorf("adopt file: %w", err)
+		}
+		err = service.quarantine(galleryID, path.Base(key), obj, checksum, size, "application/octet-stream",
+			fmt.Sprintf("%v: %v", ProblemUntrackedFile, issue))
+		if err != nil {
+			return fmt.Errorf("adopt file: %w", err)
+		}
+	}
+
+	id, err := enqueueDeletion(service.DB, deleteObject, key)
+	if err != nil {
+		return fmt.Errorf("adopt file: %w", err)
+	}
+	ok, err := service.runDeletion(id)
+	if err != nil {
+		return fmt.Errorf("adopt file: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("adopt file: removing %v failed, it will be retried", key)
+	}
+	return nil
+}
@@ -1,26 +1,105 @@
 package models
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	stdimage "image"
 	"io"
-	"io/fs"
-	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Image struct {
+	ID        int
 	GalleryID int
-	Path      string
 	Filename  string
+	// Key is where the image lives in the GalleryService's Storage
+	Key      string
+	Checksum string // hex encoded SHA-256 of the file contents
+	// DHash is the perceptual difference hash of the image, used to find near
+	// duplicates. It is nil if the image couldn't be decoded.
+	DHash *uint64
+	// Width and Height of the image in pixels, after its edits have been
+	// applied. They are 0 if the image couldn't be decoded.
+	Width  int
+	Height int
+	// BlurHash and DominantColor are used as placeholders while the image loads.
+	BlurHash      string
+	DominantColor string
+	Size          int64
+	ContentType   string
+	Caption       string
+	// DeletedAt is set when the image is in the trash
+	DeletedAt *time.Time
+	// Visibility of the image. It is empty when the image has the same
+	// visibility as its gallery; use VisibilityIn to get the one that applies.
+	Visibility Visibility
+	// Edits is the edit history of the image, oldest first
+	Edits     []Edit
+	CreatedAt time.Time
+}
+
+// Visibility decides who is able to view a gallery
+type Visibility string
+
+const (
+	// VisibilityPublic galleries can be viewed by anyone.
+	VisibilityPublic Visibility = "public"
+	// VisibilityUnlisted galleries can be viewed by anyone with a link to them.
+	VisibilityUnlisted Visibility = "unlisted"
+	// VisibilityPrivate galleries can only be viewed by their owner.
+	VisibilityPrivate Visibility = "private"
+)
+
+// Visibilities lists every valid Visibility, in the order they should be presented to users.
+var Visibilities = []Visibility{VisibilityPublic, VisibilityUnlisted, VisibilityPrivate}
+
+// ParseVisibility converts s into a Visibility, returning an error if it isn't a valid one.
+func ParseVisibility(s string) (Visibility, error) {
+	for _, v := range Visibilities {
+		if string(v) == s {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("invalid visibility: %q", s)
+}
+
+// VisibilityIn returns the visibility that applies to the image when it is in gallery
+func (image Image) VisibilityIn(gallery Gallery) Visibility {
+	if image.Visibility != "" {
+		return image.Visibility
+	}
+	return gallery.Visibility
+}
+
+// ListedIn reports whether the image is shown to visitors of gallery. Images
+// that are more restricted than the gallery itself are only shown to its
+// owner, but unlisted ones can still be viewed through their URL.
+func (image Image) ListedIn(gallery Gallery) bool {
+	switch image.VisibilityIn(gallery) {
+	case VisibilityPublic:
+		return true
+	case VisibilityUnlisted:
+		return gallery.Visibility != VisibilityPublic
+	}
+	return false
 }
 
 type Gallery struct {
 	ID     int
 	UserID int
 	Title  string
+	// Slug addresses the gallery in /u/{username}/{slug} URLs. It is unique among the galleries of the user.
+	Slug       string
+	Visibility Visibility
+	// DeletedAt is set when the gallery is in the trash
+	DeletedAt *time.Time
 }
 
 type GalleryService struct {
@@ -28,28 +107,65 @@ type GalleryService struct {
 
 	// ImagesDir is used to tell the GalleryService where to store and locate
 	// images. If not set the GalleryService will default to using the "images"
-	// directory.
+	// directory. It is ignored when Storage is set.
 	ImagesDir string
+
+	// Storage is used to store the image files. If not set the GalleryService
+	// will default to a FileStorage inside ImagesDir.
+	Storage Storage
+
+	// Scanner is used to scan every upload for malware before it is stored.
+	// Uploads aren't scanned if it isn't set.
+	Scanner Scanner
+
+	// ImageLimits bounds the dimensions and frame count of uploaded images.
+	// Limits that aren't set use DefaultImageLimits.
+	ImageLimits ImageLimits
+
+	// DuplicateDistance is the largest dHash distance at which two images are
+	// reported as possible duplicates. Defaults to DefaultDuplicateDistance.
+	DuplicateDistance int
+
+	// UserQuota limits what all of the galleries of a user can store together,
+	// and GalleryQuota what a single gallery can store. They aren't enforced
+	// if they aren't set.
+	UserQuota    Quota
+	GalleryQuota Quota
 }
 
 // service to create a gallery
 func (service *GalleryService) Create(title string, userID int) (*Gallery, error) {
 	// define the gallery object
 	gallery := Gallery{
-		Title:  title,
-		UserID: userID,
+		Title:      title,
+		UserID:     userID,
+		Visibility: VisibilityUnlisted,
 	}
-	row := service.DB.QueryRow(`
-	INSERT INTO galleries (title, user_id)
-	VALUES ($1, $2) RETURNING id;`, gallery.Title, gallery.UserID)
-
-	err := row.Scan(&gallery.ID)
-	if err != nil {
-		return nil, fmt.Errorf("create gallery: %w", err)
+	// another gallery of the user can take the slug between looking for a
+	// free one and inserting, in which case the next free one is tried
+	for attempt := 0; attempt < 10; attempt++ {
+		slug, err := uniqueSlug(service.DB, userID, Slugify(title))
+		if err != nil {
+			return nil, fmt.Errorf("create gallery: %w", err)
+		}
+		gallery.Slug = slug
+		row := service.DB.QueryRow(`
+		INSERT INTO galleries (title, user_id, slug, visibility)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, slug) DO NOTHING
+		RETURNING id;`, gallery.Title, gallery.UserID, gallery.Slug, gallery.Visibility)
+
+		err = row.Scan(&gallery.ID)
+		if errors.Is(err, sql.ErrNoRows) {
+			// the slug is taken
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("create gallery: %w", err)
+		}
+		return &gallery, nil
 	}
-
-	return &gallery, nil
-
+	return nil, fmt.Errorf("create gallery: no free slug for %q", title)
 }
 
 // service to query gallery by id
@@ -59,11 +175,11 @@ func (service *GalleryService) ByID(id int) (*Gallery, error) {
 	}
 
 	row := service.DB.QueryRow(`
-	SELECT title, user_id
+	SELECT title, user_id, slug, visibility
 	FROM galleries
-	WHERE id = $1;`, gallery.ID)
+	WHERE id = $1 AND deleted_at IS NULL;`, gallery.ID)
 
-	err := row.Scan(&gallery.Title, &gallery.UserID)
+	err := row.Scan(&gallery.Title, &gallery.UserID, &gallery.Slug, &gallery.Visibility)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, ErrNotFound //  users of the models package don’t need to know about sql being used
@@ -79,20 +195,21 @@ func (service *GalleryService) ByID(id int) (*Gallery, error) {
 // service to query all galleries associated with a user
 func (service *GalleryService) ByUserID(userID int) ([]Gallery, error) {
 	rows, err := service.DB.Query(`
-	SELECT id, title
+	SELECT id, title, slug, visibility
 	FROM galleries
-	WHERE user_id = $1;`, userID)
+	WHERE user_id = $1 AND deleted_at IS NULL;`, userID)
 
 	if err != nil {
 		return nil, fmt.Errorf("query galleries by user: %w", err)
 	}
+	defer rows.Close()
 
 	var galleries []Gallery
 	for rows.Next() {
 		gallery := Gallery{
 			UserID: userID,
 		}
-		err = rows.Scan(&gallery.ID, &gallery.Title)
+		err = rows.Scan(&gallery.ID, &gallery.Title, &gallery.Slug, &gallery.Visibility)
 		if err != nil {
 			return nil, fmt.Errorf("query galleries by user: %w", err)
 		}
@@ -101,19 +218,89 @@ func (service *GalleryService) ByUserID(userID int) ([]Gallery, error) {
 	}
 
 	if rows.Err() != nil {
-		return nil, fmt.Errorf("query galleries by user: %w", err)
+		return nil, fmt.Errorf("query galleries by user: %w", rows.Err())
 	}
 	return galleries, nil
 }
 
+// All returns the galleries of every user, except the ones in the trash,
+// ordered by id.
+func (service *GalleryService) All() ([]Gallery, error) {
+	rows, err := service.DB.Query(`
+	SELECT id, user_id, title, slug, visibility
+	FROM galleries
+	WHERE deleted_at IS NULL
+	ORDER BY id;`)
+	if err != nil {
+		return nil, fmt.Errorf("query all galleries: %w", err)
+	}
+	defer rows.Close()
+
+	var galleries []Gallery
+	for rows.Next() {
+		var gallery Gallery
+		err = rows.Scan(&gallery.ID, &gallery.UserID, &gallery.Title, &gallery.Slug, &gallery.Visibility)
+		if err != nil {
+			return nil, fmt.Errorf("query all galleries: %w", err)
+		}
+		galleries = append(galleries, gallery)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("query all galleries: %w", rows.Err())
+	}
+	return galleries, nil
+}
+
+// ByUsername returns a gallery of the user with the given username, as
+// addressed in /u/{username}/{ref} URLs. ref is either the slug or the id of
+// the gallery. ErrNotFound is returned if the user has no such gallery; old
+// slugs are resolved with RenamedGallery.
+func (service *GalleryService) ByUsername(username, ref string) (*Gallery, error) {
+	// slugs are never only digits, so refs that are can only be ids
+	id, err := strconv.Atoi(ref)
+	if err != nil {
+		id = 0
+	}
+	var gallery Gallery
+	row := service.DB.QueryRow(`
+	SELECT galleries.id, galleries.title, galleries.user_id, galleries.slug, galleries.visibility
+	FROM galleries
+	JOIN users ON users.id = galleries.user_id
+	WHERE (galleries.slug = $1 OR galleries.id = $2) AND users.username = $3 AND galleries.deleted_at IS NULL;`,
+		strings.ToLower(ref), id, strings.ToLower(username))
+	err = row.Scan(&gallery.ID, &gallery.Title, &gallery.UserID, &gallery.Slug, &gallery.Visibility)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query gallery by username: %w", err)
+	}
+	return &gallery, nil
+}
+
+// PublicByUserID returns the public galleries of a user, as listed on their profile
+func (service *GalleryService) PublicByUserID(userID int) ([]Gallery, error) {
+	galleries, err := service.ByUserID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("query public galleries by user: %w", err)
+	}
+	var public []Gallery
+	for _, gallery := range galleries {
+		if gallery.Visibility == VisibilityPublic {
+			public = append(public, gallery)
+		}
+	}
+	return public, nil
+}
+
 func (service *GalleryService) Update(gallery *Gallery) error {
 	// we're using exec instead of Query as we son't care about the return values
-	// update the title of the gallery
+	// update the title and visibility of the gallery
 	_, err := service.DB.Exec(`
 	UPDATE galleries
-	SET title = $2
+	SET title = $2, visibility = $3
 	WHERE id = $1;
-	`, gallery.ID, gallery.Title)
+	`, gallery.ID, gallery.Title, gallery.Visibility)
 	if err != nil {
 		return fmt.Errorf("update gallery: %w", err)
 	}
@@ -121,130 +308,378 @@ func (service *GalleryService) Update(gallery *Gallery) error {
 
 }
 
-// service to delete a gallery
-func (service *GalleryService) Delete(id int) error {
+// UpdateWithSlug saves the title and visibility of a gallery together with
+// a new slug, so that either all of them are changed or none are. An empty
+// slug gets a new one from the title. ErrSlugTaken or a
+// SlugError is returned if the slug can't be used.
+func (service *GalleryService) UpdateWithSlug(gallery *Gallery, slug string) error {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("update gallery: %w", err)
+	}
+	defer tx.Rollback()
+
+	slug = strings.ToLower(strings.TrimSpace(slug))
+	if slug == "" {
+		slug = Slugify(gallery.Title)
+		if slug != gallery.Slug {
+			slug, err = uniqueSlug(tx, gallery.UserID, slug)
+			if err != nil {
+				return fmt.Errorf("update gallery: %w", err)
+			}
+		}
+	}
+	if slug != gallery.Slug {
+		err = checkSlug(slug)
+		if err != nil {
+			return fmt.Errorf("update gallery: %w", err)
+		}
+		err = setSlug(tx, gallery, slug)
+		if err != nil {
+			return fmt.Errorf("update gallery: %w", err)
+		}
+	}
+	_, err = tx.Exec(`
+	UPDATE galleries
+	SET title = $2, visibility = $3
+	WHERE id = $1;`, gallery.ID, gallery.Title, gallery.Visibility)
+	if err != nil {
+		return fmt.Errorf("update gallery: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("update gallery: %w", err)
+	}
+
+	gallery.Slug = slug
+	return nil
+}
 
+// service to delete a gallery. The gallery is moved to the trash of its owner, where it can be restored until it is purged.
+func (service *GalleryService) Delete(id int) error {
 	_, err := service.DB.Exec(`
-	DELETE FROM galleries
-	WHERE id = $1 ;`, id)
+	UPDATE galleries
+	SET deleted_at = now()
+	WHERE id = $1 AND deleted_at IS NULL;`, id)
 	if err != nil {
 		return fmt.Errorf("delete gallery: %w", err)
 	}
-	// delete the images
-	err = os.RemoveAll(service.galleryDir(id))
+	return nil
+}
+
+// Transfer gives a gallery, with its images, to another user. The gallery
+// keeps its slug unless the new owner already has a gallery with it. Redirects
+// from its old slugs and invites for it are dropped, as they belong to the
+// old owner. Quotas aren't checked. ErrNotFound is returned if there is no
+// such gallery.
+func (service *GalleryService) Transfer(galleryID, userID int) (*Gallery, error) {
+	tx, err := service.DB.Begin()
 	if err != nil {
-		return fmt.Errorf("delete gallery images: %w", err)
+		return nil, fmt.Errorf("transfer gallery: %w", err)
 	}
-	return nil
+	defer tx.Rollback()
+
+	gallery := Gallery{
+		ID: galleryID,
+	}
+	row := tx.QueryRow(`
+	SELECT title, user_id, slug, visibility
+	FROM galleries
+	WHERE id = $1
+	FOR UPDATE;`, galleryID)
+	err = row.Scan(&gallery.Title, &gallery.UserID, &gallery.Slug, &gallery.Visibility)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("transfer gallery: %w", err)
+	}
+	if gallery.UserID == userID {
+		return &gallery, nil
+	}
+
+	gallery.Slug, err = uniqueSlug(tx, userID, gallery.Slug)
+	if err != nil {
+		return nil, fmt.Errorf("transfer gallery: %w", err)
+	}
+	gallery.UserID = userID
+	_, err = tx.Exec(`
+	UPDATE galleries
+	SET user_id = $2, slug = $3
+	WHERE id = $1;`, gallery.ID, gallery.UserID, gallery.Slug)
+	if err != nil {
+		return nil, fmt.Errorf("transfer gallery: %w", err)
+	}
+	_, err = tx.Exec(`
+	DELETE FROM gallery_redirects
+	WHERE gallery_id = $1;`, gallery.ID)
+	if err != nil {
+		return nil, fmt.Errorf("transfer gallery: %w", err)
+	}
+	_, err = tx.Exec(`
+	UPDATE invites SET gallery_id = NULL
+	WHERE gallery_id = $1;`, gallery.ID)
+	if err != nil {
+		return nil, fmt.Errorf("transfer gallery: %w", err)
+	}
+	// owners can view their galleries anyway
+	_, err = tx.Exec(`
+	DELETE FROM gallery_members
+	WHERE gallery_id = $1 AND user_id = $2;`, gallery.ID, gallery.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("transfer gallery: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("transfer gallery: %w", err)
+	}
+	return &gallery, nil
 }
 
-// takes a gallery id and returns the path 'images/gallery-{id}'
-func (service *GalleryService) galleryDir(id int) string {
+// returns the Storage that images are kept in
+func (service *GalleryService) storage() Storage {
+	if service.Storage != nil {
+		return service.Storage
+	}
 	imagesDir := service.ImagesDir
 	if imagesDir == "" {
 		imagesDir = "images"
 	}
-	return filepath.Join(imagesDir, fmt.Sprintf("gallery-%d", id))
+	return FileStorage{Dir: imagesDir}
 }
 
-// service to get all the image files from a directory for a particular gallery id.
-func (service *GalleryService) Images(galleryID int) ([]Image, error) {
-	globPattern := filepath.Join(service.galleryDir(galleryID), "*") // images/gallery-2/*
+// takes a gallery id and returns the storage prefix 'gallery-{id}'
+func galleryPrefix(id int) string {
+	return fmt.Sprintf("gallery-%d", id)
+}
 
-	// get all files that matches the glob pattern
-	allFiles, err := filepath.Glob(globPattern)
+// service to get all the images for a particular gallery id.
+func (service *GalleryService) Images(galleryID int) ([]Image, error) {
+	images, err := service.queryImages(`
+	WHERE images.gallery_id = $1 AND images.deleted_at IS NULL
+	ORDER BY images.filename;`, galleryID)
 	if err != nil {
 		return nil, fmt.Errorf("retrieving gallery images: %w", err)
 	}
-
-	var images []Image
-	for _, file := range allFiles {
-		if hasExtension(file, []string{".png", ".jpg", ".jpeg", ".gif"}) {
-			images = append(images, Image{
-				Path:      file,
-				Filename:  filepath.Base(file),
-				GalleryID: galleryID})
-		}
-	}
 	return images, nil
 
 }
 
-// service to query for a single image file
+// service to query for a single image
 func (service *GalleryService) Image(galleryID int, filename string) (Image, error) {
-	imagePath := filepath.Join(service.galleryDir(galleryID), filename)
-
-	// check if the image exists
-	_, err := os.Stat(imagePath)
+	images, err := service.queryImages(`
+	WHERE images.gallery_id = $1 AND images.filename = $2 AND images.deleted_at IS NULL;`, galleryID, filename)
 	if err != nil {
-		if errors.Is(err, fs.ErrNotExist) {
-			return Image{}, ErrNotFound
-		}
 		return Image{}, fmt.Errorf("quering for image: %w", err)
 	}
+	if len(images) == 0 {
+		return Image{}, ErrNotFound
+	}
 
-	return Image{
-		Filename:  filename,
-		GalleryID: galleryID,
-		Path:      imagePath,
-	}, nil
+	return images[0], nil
+}
+
+// OpenImage opens the stored file of an image. Callers must close it.
+func (service *GalleryService) OpenImage(image Image) (*Object, error) {
+	obj, err := service.storage().Open(image.Key)
+	if err != nil {
+		return nil, fmt.Errorf("opening image: %w", err)
+	}
+	return obj, nil
 }
 
-// service for adding a image to gallery
-func (service *GalleryService) CreateImage(galleryID int, filename string, contents io.ReadSeeker) error {
+// service for adding a image to gallery. The filename supplied by the client is only kept as metadata; the file is stored under a
+// generated key, and if the gallery already has an image with the same name a " (n)" suffix is added instead of overwriting it.
+func (service *GalleryService) CreateImage(galleryID int, filename string, contents io.ReadSeeker) (Image, error) {
+	return service.createImage(galleryID, filename, contents, true)
+}
+
+// createImage adds an image to a gallery, only running it through the Scanner if scan is true
+func (service *GalleryService) createImage(galleryID int, filename string, contents io.ReadSeeker, scan bool) (Image, error) {
 	// io.ReadSeeker as argument as we need to pass it to checkcontenttype func
+	filename = SanitizeFilename(filename)
 
 	// check if the content type is valid
-	err := checkContentType(contents, service.imageContentTypes())
+	contentType, err := checkContentType(contents, service.imageContentTypes())
 	if err != nil {
-		return fmt.Errorf("creating image %v: %w", filename, err)
+		return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
 	}
 
 	// check if the file extension is valid
 	err = checkExtension(filename, service.extensions())
 	if err != nil {
-		return fmt.Errorf("creating image ,has invalid extension %v: %w", filename, err)
+		return Image{}, fmt.Errorf("creating image ,has invalid extension %v: %w", filename, err)
 	}
 
-	galleryDir := service.galleryDir(galleryID)
+	// make sure the image is well formed and isn't too big to process
+	img, err := checkImage(contents, service.ImageLimits)
+	if err != nil {
+		return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
+	}
 
-	// check if the gallery folder exists. If not ,then make it.
-	err = os.MkdirAll(galleryDir, 0755)
+	checksum, size, err := hashContents(contents)
 	if err != nil {
-		return fmt.Errorf("creating gallery-%d images directory: %w", galleryID, err)
+		return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
 	}
-	imagePath := filepath.Join(galleryDir, filename)
-	// create the file
-	dst, err := os.Create(imagePath)
 
+	// don't store the exact same file twice in a gallery
+	var duplicate string
+	row := service.DB.QueryRow(`
+	SELECT filename FROM images
+	WHERE gallery_id = $1 AND checksum = $2 AND deleted_at IS NULL
+	LIMIT 1;`, galleryID, checksum)
+	err = row.Scan(&duplicate)
+	if err == nil {
+		return Image{}, fmt.Errorf("creating image %v is a copy of %v: %w", filename, duplicate, ErrDuplicateImage)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+
+	if scan && service.Scanner != nil {
+		result, scanErr := service.Scanner.Scan(contents)
+		err = rewind(contents)
+		if err != nil {
+			return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
+		}
+		if scanErr != nil {
+			// we can't tell if the file is safe, so hold on to it until an admin has had a look
+			err = service.quarantine(galleryID, filename, contents, checksum, size, contentType, scanErr.Error())
+			if err != nil {
+				return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
+			}
+			return Image{}, fmt.Errorf("creating image %v: %v: %w", filename, scanErr, ErrQuarantined)
+		}
+		if result.Infected {
+			err = FileError{Issue: fmt.Sprintf("the file is infected with %v", result.Signature)}
+			return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
+		}
+	}
+
+	key, err := newImageKey(galleryID, filename)
 	if err != nil {
-		return fmt.Errorf("creating image file: %w", err)
+		return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	image := Image{
+		GalleryID:   galleryID,
+		Filename:    filename,
+		Key:         key,
+		Checksum:    checksum,
+		Size:        size,
+		ContentType: contentType,
 	}
-	// defer the file closing until end pf function
-	defer dst.Close()
+	setImageDetails(&image, img)
 
-	// copy data from contents into the file
-	_, err = io.Copy(dst, contents)
+	err = service.storage().Create(image.Key, contents)
 	if err != nil {
-		return fmt.Errorf("copying contents to image: %w", err)
+		return Image{}, fmt.Errorf("creating image file: %w", err)
 	}
-	return nil
+
+	// the quota is checked in the transaction that adds the image, so that
+	// concurrent uploads can't go over it together
+	err = service.insertWithinQuota(&image)
+	if err != nil {
+		// don't leave a file behind that nothing points to
+		service.storage().Remove(image.Key)
+		return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	return image, nil
 }
 
-// service to delete a single image
+// insertWithinQuota stores a new image in the database, unless it would take
+// its gallery or user over their quota
+func (service *GalleryService) insertWithinQuota(image *Image) error {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = service.checkQuota(tx, image.GalleryID, Usage{Bytes: image.Size, Images: 1}, false)
+	if err != nil {
+		return err
+	}
+	err = insertImage(tx, image)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// service to delete a single image. The image is moved to the trash, where it can be restored until it is purged.
 func (service *GalleryService) DeleteImage(galleryID int, filename string) error {
 	image, err := service.Image(galleryID, filename)
 	if err != nil {
 		return fmt.Errorf("deleting image: %w", err)
 	}
-	// remove the file
-	err = os.Remove(image.Path)
+	_, err = service.DB.Exec(`
+	UPDATE images
+	SET deleted_at = now()
+	WHERE id = $1;`, image.ID)
 	if err != nil {
 		return fmt.Errorf("deleting image: %w", err)
 	}
 	return nil
 }
 
+// UpdateImage saves the caption and visibility of an image.
+func (service *GalleryService) UpdateImage(image *Image) error {
+	if image.Visibility != "" {
+		_, err := ParseVisibility(string(image.Visibility))
+		if err != nil {
+			return fmt.Errorf("update image: %w", err)
+		}
+	}
+	_, err := service.DB.Exec(`
+	UPDATE images
+	SET caption = $2, visibility = $3
+	WHERE id = $1;`, image.ID, image.Caption, image.Visibility)
+	if err != nil {
+		return fmt.Errorf("update image: %w", err)
+	}
+	return nil
+}
+
+// queryRower is implemented by both *sql.DB and *sql.Tx, so that helpers can be used inside and outside of transactions
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// insertImage stores the image in the database. If the gallery already has
+// an image with the same filename, a suffix is added to the filename of the
+// new image until it is unique.
+func insertImage(q queryRower, image *Image) error {
+	edits, err := editsToDB(image.Edits)
+	if err != nil {
+		return fmt.Errorf("insert image: %w", err)
+	}
+	filename := image.Filename
+	for n := 2; n < 1000; n++ {
+		row := q.QueryRow(`
+		INSERT INTO images (gallery_id, filename, storage_key, checksum, dhash,
+			width, height, blurhash, dominant_color, size, content_type, caption,
+			visibility, edits)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14::jsonb)
+		ON CONFLICT (gallery_id, filename) WHERE deleted_at IS NULL DO NOTHING
+		RETURNING id, created_at;`, image.GalleryID, filename, image.Key,
+			image.Checksum, dHashToDB(image.DHash), image.Width, image.Height,
+			image.BlurHash, image.DominantColor, image.Size, image.ContentType,
+			image.Caption, image.Visibility, edits)
+		err := row.Scan(&image.ID, &image.CreatedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			// the filename is taken
+			filename = withSuffix(image.Filename, n)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("insert image: %w", err)
+		}
+		image.Filename = filename
+		return nil
+	}
+	return fmt.Errorf("insert image: no free filename for %v", image.Filename)
+}
+
 func (service *GalleryService) extensions() []string {
 	return []string{".png", ".jpg", ".jpeg", ".gif"}
 }
@@ -266,3 +701,63 @@ func hasExtension(file string, extensions []string) bool {
 	return false
 
 }
+
+// queryImages returns the images matching the given WHERE (and ORDER BY) clause
+func (service *GalleryService) queryImages(where string, args ...interface{}) ([]Image, error) {
+	rows, err := service.DB.Query(`
+	SELECT images.id, images.gallery_id, images.filename, images.storage_key,
+		images.checksum, images.dhash, images.width, images.height, images.blurhash,
+		images.dominant_color, images.size, images.content_type, images.caption,
+		images.visibility, images.edits, images.deleted_at, images.created_at
+	FROM images
+	`+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var images []Image
+	for rows.Next() {
+		var image Image
+		var dhash sql.NullInt64
+		var edits []byte
+		err = rows.Scan(&image.ID, &image.GalleryID, &image.Filename, &image.Key,
+			&image.Checksum, &dhash, &image.Width, &image.Height, &image.BlurHash,
+			&image.DominantColor, &image.Size, &image.ContentType, &image.Caption,
+			&image.Visibility, &edits, &image.DeletedAt, &image.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		image.DHash = dHashFromDB(dhash)
+		err = json.Unmarshal(edits, &image.Edits)
+		if err != nil {
+			return nil, fmt.Errorf("edits of %v: %w", image.Filename, err)
+		}
+		images = append(images, image)
+	}
+	return images, rows.Err()
+}
+
+// setImageDetails fills in the details of image that are computed from its decoded pixels
+func setImageDetails(image *Image, decoded stdimage.Image) {
+	hash := dHash(decoded)
+	image.DHash = &hash
+	image.Width = decoded.Bounds().Dx()
+	image.Height = decoded.Bounds().Dy()
+	image.BlurHash = blurHash(decoded)
+	image.DominantColor = dominantColor(decoded)
+}
+
+// hashContents returns the hex encoded SHA-256 checksum and size of r, and seeks back to the start of it.
+func hashContents(r io.ReadSeeker) (string, int64, error) {
+	hash := sha256.New()
+	size, err := io.Copy(hash, r)
+	if err != nil {
+		return "", 0, fmt.Errorf("hashing contents: %w", err)
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", 0, fmt.Errorf("hashing contents: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
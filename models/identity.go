@@ -0,0 +1,111 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type IdentityService struct {
+	DB *sql.DB
+	// Registration decides whether new users get an account when they sign in
+	// for the first time. Only RegistrationOpen (the default) creates
+	// accounts, otherwise identities can only be linked to existing ones.
+	Registration RegistrationMode
+}
+
+// SignIn returns the user that signed in at a provider as subject. Users
+// that sign in for the first time are linked to the account with their email
+// address, or get a new account without a password if there is none. The
+// provider has to have verified the email address for that, otherwise
+// ErrEmailUnverified is returned. ErrSignUpClosed is returned if an account
+// would have to be created while registration isn't open, and
+// ErrAccountSuspended if an admin has suspended the account.
+func (service *IdentityService) SignIn(provider, subject, email string, emailVerified bool) (*User, error) {
+	user, err := service.userByIdentity(service.DB, provider, subject)
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("identity sign in: %w", err)
+	}
+
+	email = strings.ToLower(email)
+	if email == "" || !emailVerified {
+		return nil, ErrEmailUnverified
+	}
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("identity sign in: %w", err)
+	}
+	defer tx.Rollback()
+
+	user = &User{
+		Email: email,
+	}
+	var row *sql.Row
+	if service.Registration == "" || service.Registration == RegistrationOpen {
+		// an empty password hash never matches a password, so the account can
+		// only be signed in to through its identities until a password is set
+		row = tx.QueryRow(`
+		WITH inserted AS (
+			INSERT INTO users (email, password_hash)
+			VALUES ($1, '') ON CONFLICT (email) DO NOTHING
+			RETURNING id, password_hash
+		)
+		SELECT id, password_hash FROM inserted
+		UNION ALL
+		SELECT id, password_hash FROM users WHERE email = $1;`, email)
+	} else {
+		row = tx.QueryRow(`
+		SELECT id, password_hash FROM users WHERE email = $1;`, email)
+	}
+	err = row.Scan(&user.ID, &user.PasswordHash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrSignUpClosed
+		}
+		return nil, fmt.Errorf("identity sign in: %w", err)
+	}
+	_, err = tx.Exec(`
+	INSERT INTO user_identities (user_id, provider, subject)
+	VALUES ($1, $2, $3) ON CONFLICT (provider, subject) DO NOTHING;`, user.ID, provider, subject)
+	if err != nil {
+		return nil, fmt.Errorf("identity sign in: %w", err)
+	}
+	// if the identity was linked concurrently, it might be to another user
+	user, err = service.userByIdentity(tx, provider, subject)
+	if err != nil {
+		return nil, fmt.Errorf("identity sign in: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("identity sign in: %w", err)
+	}
+	return user, nil
+}
+
+// userByIdentity returns the user that an identity is linked to, or ErrNotFound.
+// ErrAccountSuspended is returned if an admin has suspended the user.
+func (service *IdentityService) userByIdentity(q queryRower, provider, subject string) (*User, error) {
+	var user User
+	var suspendedAt *time.Time
+	row := q.QueryRow(`
+	SELECT users.id, users.email, users.password_hash, users.suspended_at
+	FROM user_identities
+	JOIN users ON users.id = user_identities.user_id
+	WHERE user_identities.provider = $1 AND user_identities.subject = $2;`, provider, subject)
+	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash, &suspendedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if suspendedAt != nil {
+		return nil, ErrAccountSuspended
+	}
+	return &user, nil
+}
@@ -0,0 +1,195 @@
+package models
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+)
+
+// ImageLimits bounds the size of the images we accept, so that a small file
+// that claims to be huge can't exhaust our memory once it is decoded.
+type ImageLimits struct {
+	MaxWidth  int
+	MaxHeight int
+	// MaxPixels is the largest width*height.
+	MaxPixels int64
+	// MaxFrames is the largest number of frames in an animated image.
+	MaxFrames int
+}
+
+// DefaultImageLimits are used for every limit that isn't set on the GalleryService.
+var DefaultImageLimits = ImageLimits{
+	MaxWidth:  20000,
+	MaxHeight: 20000,
+	MaxPixels: 50000000, // 50 megapixels, ~200MB once decoded
+	MaxFrames: 500,
+}
+
+// withDefaults fills in the limits that aren't set
+func (limits ImageLimits) withDefaults() ImageLimits {
+	if limits.MaxWidth <= 0 {
+		limits.MaxWidth = DefaultImageLimits.MaxWidth
+	}
+	if limits.MaxHeight <= 0 {
+		limits.MaxHeight = DefaultImageLimits.MaxHeight
+	}
+	if limits.MaxPixels <= 0 {
+		limits.MaxPixels = DefaultImageLimits.MaxPixels
+	}
+	if limits.MaxFrames <= 0 {
+		limits.MaxFrames = DefaultImageLimits.MaxFrames
+	}
+	return limits
+}
+
+// checkImage makes sure r holds a well formed image within limits, and
+// returns it decoded. Only the headers are read until we know that the image
+// is small enough to decode. It seeks back to the start of r afterwards.
+func checkImage(r io.ReadSeeker, limits ImageLimits) (image.Image, error) {
+	limits = limits.withDefaults()
+
+	config, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, FileError{Issue: "the image is corrupt or in an unsupported format"}
+	}
+	err = rewind(r)
+	if err != nil {
+		return nil, fmt.Errorf("checking image: %w", err)
+	}
+
+	if config.Width <= 0 || config.Height <= 0 {
+		return nil, FileError{Issue: fmt.Sprintf("invalid dimensions %dx%d", config.Width, config.Height)}
+	}
+	if config.Width > limits.MaxWidth || config.Height > limits.MaxHeight {
+		return nil, FileError{Issue: fmt.Sprintf("the image is %dx%d pixels, the maximum is %dx%d",
+			config.Width, config.Height, limits.MaxWidth, limits.MaxHeight)}
+	}
+	pixels := int64(config.Width) * int64(config.Height)
+	if pixels > limits.MaxPixels {
+		return nil, FileError{Issue: fmt.Sprintf("the image has %d pixels, the maximum is %d", pixels, limits.MaxPixels)}
+	}
+
+	if format == "gif" {
+		frames, err := countGIFFrames(r)
+		if err != nil {
+			return nil, FileError{Issue: "the image is corrupt or truncated"}
+		}
+		err = rewind(r)
+		if err != nil {
+			return nil, fmt.Errorf("checking image: %w", err)
+		}
+		if frames > limits.MaxFrames {
+			return nil, FileError{Issue: fmt.Sprintf("the image has %d frames, the maximum is %d", frames, limits.MaxFrames)}
+		}
+	}
+
+	// Now that we know it is safe to do so, decode the whole image. This is
+	// the only way to find out if the pixel data is truncated or corrupt.
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, FileError{Issue: "the image is corrupt or truncated"}
+	}
+	err = rewind(r)
+	if err != nil {
+		return nil, fmt.Errorf("checking image: %w", err)
+	}
+	return img, nil
+}
+
+func rewind(r io.Seeker) error {
+	_, err := r.Seek(0, io.SeekStart)
+	return err
+}
+
+// countGIFFrames counts the images in a GIF by walking its blocks, without
+// decoding any of the pixel data.
+func countGIFFrames(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+
+	// header (6 bytes) and logical screen descriptor (7 bytes)
+	header := make([]byte, 13)
+	_, err := io.ReadFull(br, header)
+	if err != nil {
+		return 0, err
+	}
+	if string(header[:3]) != "GIF" {
+		return 0, errors.New("not a gif")
+	}
+	// global color table
+	if header[10]&0x80 != 0 {
+		err = skip(br, 3*(1<<(int(header[10]&0x07)+1)))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	frames := 0
+	for {
+		introducer, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch introducer {
+		case 0x21: // extension: label byte followed by data sub-blocks
+			_, err = br.ReadByte()
+			if err != nil {
+				return 0, err
+			}
+			err = skipSubBlocks(br)
+			if err != nil {
+				return 0, err
+			}
+		case 0x2C: // image descriptor
+			frames++
+			descriptor := make([]byte, 9)
+			_, err = io.ReadFull(br, descriptor)
+			if err != nil {
+				return 0, err
+			}
+			// local color table
+			if descriptor[8]&0x80 != 0 {
+				err = skip(br, 3*(1<<(int(descriptor[8]&0x07)+1)))
+				if err != nil {
+					return 0, err
+				}
+			}
+			// LZW minimum code size, then the image data sub-blocks
+			_, err = br.ReadByte()
+			if err != nil {
+				return 0, err
+			}
+			err = skipSubBlocks(br)
+			if err != nil {
+				return 0, err
+			}
+		case 0x3B: // trailer
+			return frames, nil
+		default:
+			return 0, fmt.Errorf("unknown gif block 0x%x", introducer)
+		}
+	}
+}
+
+func skip(r io.Reader, n int) error {
+	_, err := io.CopyN(io.Discard, r, int64(n))
+	return err
+}
+
+// skipSubBlocks skips a sequence of sub-blocks, each prefixed by its size and ended by an empty one
+func skipSubBlocks(r *bufio.Reader) error {
+	for {
+		size, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			return nil
+		}
+		err = skip(r, int(size))
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ayushthe1/lenspix/rand"
+)
+
+// RegistrationMode decides who can create an account
+type RegistrationMode string
+
+const (
+	// RegistrationOpen lets anyone sign up
+	RegistrationOpen RegistrationMode = "open"
+	// RegistrationInvite only lets people with an invite code sign up
+	RegistrationInvite RegistrationMode = "invite"
+	// RegistrationClosed doesn't let anyone sign up
+	RegistrationClosed RegistrationMode = "closed"
+)
+
+// ParseRegistrationMode returns the RegistrationMode called s, defaulting to
+// RegistrationOpen when s is empty.
+func ParseRegistrationMode(s string) (RegistrationMode, error) {
+	switch mode := RegistrationMode(s); mode {
+	case "":
+		return RegistrationOpen, nil
+	case RegistrationOpen, RegistrationInvite, RegistrationClosed:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown registration mode %q", s)
+}
+
+// Invite lets people sign up when registration is invite only
+type Invite struct {
+	ID        int
+	CreatedBy int
+	// Code is only set when an Invite is created
+	Code     string
+	CodeHash string
+	// MaxUses is how many accounts can be created with the invite
+	MaxUses int
+	Uses    int
+	// ExpiresAt is nil for invites that don't expire
+	ExpiresAt *time.Time
+	// GalleryID is the gallery that users who sign up with the invite become
+	// members of, if any
+	GalleryID    *int
+	GalleryTitle string
+	CreatedAt    time.Time
+}
+
+// Usable reports whether accounts can still be created with the invite
+func (invite Invite) Usable() bool {
+	if invite.Uses >= invite.MaxUses {
+		return false
+	}
+	return invite.ExpiresAt == nil || time.Now().Before(*invite.ExpiresAt)
+}
+
+const (
+	// MaxInviteUses is the most accounts that can be created with one invite
+	MaxInviteUses = 1000
+)
+
+// InviteError is returned when an invite can't be created because one of its fields isn't valid.
+type InviteError struct {
+	Issue string
+}
+
+func (ie InviteError) Error() string {
+	return fmt.Sprintf("invalid invite: %v", ie.Issue)
+}
+
+type InviteService struct {
+	DB *sql.DB
+	// BytesPerToken is used to determine how many bytes to use when generating
+	// each invite code. If this value is not set or is less than the
+	// MinBytesPerToken const it will be ignored and MinBytesPerToken will be
+	// used.
+	BytesPerToken int
+}
+
+// Create stores the invite and sets its ID and Code. The gallery of the
+// invite has to be one of the galleries of its creator.
+func (service *InviteService) Create(invite *Invite) error {
+	if invite.MaxUses < 1 || invite.MaxUses > MaxInviteUses {
+		return InviteError{Issue: fmt.Sprintf("invites can be used between 1 and %d times", MaxInviteUses)}
+	}
+	if invite.ExpiresAt != nil && !invite.ExpiresAt.After(time.Now()) {
+		return InviteError{Issue: "it would already have expired"}
+	}
+	if invite.GalleryID != nil {
+		row := service.DB.QueryRow(`
+		SELECT title FROM galleries
+		WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL;`, *invite.GalleryID, invite.CreatedBy)
+		err := row.Scan(&invite.GalleryTitle)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return InviteError{Issue: "you can only invite people to your own galleries"}
+			}
+			return fmt.Errorf("create invite: %w", err)
+		}
+	}
+
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+	code, err := rand.String(bytesPerToken)
+	if err != nil {
+		return fmt.Errorf("create invite: %w", err)
+	}
+	invite.Code = code
+	invite.CodeHash = service.hash(code)
+	row := service.DB.QueryRow(`
+	INSERT INTO invites (created_by, code_hash, max_uses, expires_at, gallery_id)
+	VALUES ($1, $2, $3, $4, $5)
+	RETURNING id, created_at;`, invite.CreatedBy, invite.CodeHash, invite.MaxUses, invite.ExpiresAt, invite.GalleryID)
+	err = row.Scan(&invite.ID, &invite.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("create invite: %w", err)
+	}
+	return nil
+}
+
+// ByUserID returns the invites that the user created, newest first
+func (service *InviteService) ByUserID(userID int) ([]Invite, error) {
+	rows, err := service.DB.Query(`
+	SELECT invites.id, invites.code_hash, invites.max_uses, invites.uses, invites.expires_at,
+		invites.gallery_id, COALESCE(galleries.title, ''), invites.created_at
+	FROM invites
+	LEFT JOIN galleries ON galleries.id = invites.gallery_id
+	WHERE invites.created_by = $1
+	ORDER BY invites.created_at DESC;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query invites by user: %w", err)
+	}
+	defer rows.Close()
+
+	var invites []Invite
+	for rows.Next() {
+		invite := Invite{
+			CreatedBy: userID,
+		}
+		err = rows.Scan(&invite.ID, &invite.CodeHash, &invite.MaxUses, &invite.Uses, &invite.ExpiresAt,
+			&invite.GalleryID, &invite.GalleryTitle, &invite.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("query invites by user: %w", err)
+		}
+		invites = append(invites, invite)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("query invites by user: %w", rows.Err())
+	}
+	return invites, nil
+}
+
+// Delete deletes an invite of the user, so that it can't be used anymore.
+// Accounts that were already created with it are kept.
+func (service *InviteService) Delete(userID, id int) error {
+	result, err := service.DB.Exec(`
+	DELETE FROM invites WHERE id = $1 AND created_by = $2;`, id, userID)
+	if err != nil {
+		return fmt.Errorf("delete invite: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("delete invite: %w", err)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SignUp creates a user with an invite code and makes them a member of the
+// gallery of the invite, unless the gallery is in the trash. The returned
+// invite has no GalleryID then. The use of the invite and the new user are stored
+// together, so that a failed sign up doesn't use up the invite.
+// ErrInviteInvalid is returned if the code doesn't exist, is used up or has
+// expired.
+func (service *InviteService) SignUp(code, email, password string) (*User, *Invite, error) {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return nil, nil, fmt.Errorf("sign up with invite: %w", err)
+	}
+	defer tx.Rollback()
+
+	// the row stays locked until the transaction ends, so concurrent sign ups
+	// can't go over the limit
+	invite := Invite{
+		CodeHash: service.hash(code),
+	}
+	row := tx.QueryRow(`
+	UPDATE invites SET uses = uses + 1
+	WHERE code_hash = $1 AND uses < max_uses AND (expires_at IS NULL OR expires_at > now())
+	RETURNING id, created_by, max_uses, uses, expires_at, gallery_id, created_at;`, invite.CodeHash)
+	err = row.Scan(&invite.ID, &invite.CreatedBy, &invite.MaxUses, &invite.Uses, &invite.ExpiresAt,
+		&invite.GalleryID, &invite.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, ErrInviteInvalid
+		}
+		return nil, nil, fmt.Errorf("sign up with invite: %w", err)
+	}
+
+	user, err := createUser(tx, email, password)
+	if err != nil {
+		if errors.Is(err, ErrEmailTaken) {
+			return nil, nil, err
+		}
+		return nil, nil, fmt.Errorf("sign up with invite: %w", err)
+	}
+	if invite.GalleryID != nil {
+		// a gallery in the trash doesn't get new members, but the invite
+		// still signs the user up
+		res, err := tx.Exec(`
+		INSERT INTO gallery_members (gallery_id, user_id)
+		SELECT id, $2 FROM galleries WHERE id = $1 AND deleted_at IS NULL;`, *invite.GalleryID, user.ID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("sign up with invite: %w", err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return nil, nil, fmt.Errorf("sign up with invite: %w", err)
+		}
+		if n == 0 {
+			invite.GalleryID = nil
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, fmt.Errorf("sign up with invite: %w", err)
+	}
+	return user, &invite, nil
+}
+
+// function for hashing the invite code
+func (service *InviteService) hash(code string) string {
+	codeHash := sha256.Sum256([]byte(code))
+	return base64.URLEncoding.EncodeToString(codeHash[:])
+}
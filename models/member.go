@@ -0,0 +1,104 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// Member is a user that was invited to a gallery of someone else
+type Member struct {
+	UserID    int
+	Email     string
+	Username  string // empty if the user hasn't picked one
+	CreatedAt time.Time
+}
+
+// IsMember reports whether the user is a member of the gallery. Members can
+// view the gallery even when it is private.
+func (service *GalleryService) IsMember(galleryID, userID int) (bool, error) {
+	var isMember bool
+	row := service.DB.QueryRow(`
+	SELECT EXISTS (
+		SELECT 1 FROM gallery_members WHERE gallery_id = $1 AND user_id = $2
+	);`, galleryID, userID)
+	err := row.Scan(&isMember)
+	if err != nil {
+		return false, fmt.Errorf("query gallery member: %w", err)
+	}
+	return isMember, nil
+}
+
+// SharedWith returns the galleries of other users that the user is a member
+// of, sorted by title.
+func (service *GalleryService) SharedWith(userID int) ([]Gallery, error) {
+	rows, err := service.DB.Query(`
+	SELECT galleries.id, galleries.user_id, galleries.title, galleries.slug, galleries.visibility
+	FROM gallery_members
+	JOIN galleries ON galleries.id = gallery_members.gallery_id
+	WHERE gallery_members.user_id = $1 AND galleries.deleted_at IS NULL
+	ORDER BY galleries.title;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query shared galleries: %w", err)
+	}
+	defer rows.Close()
+
+	var galleries []Gallery
+	for rows.Next() {
+		var gallery Gallery
+		err = rows.Scan(&gallery.ID, &gallery.UserID, &gallery.Title, &gallery.Slug, &gallery.Visibility)
+		if err != nil {
+			return nil, fmt.Errorf("query shared galleries: %w", err)
+		}
+		galleries = append(galleries, gallery)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("query shared galleries: %w", rows.Err())
+	}
+	return galleries, nil
+}
+
+// Members returns the members of the gallery, in the order they joined.
+func (service *GalleryService) Members(galleryID int) ([]Member, error) {
+	rows, err := service.DB.Query(`
+	SELECT users.id, users.email, COALESCE(users.username, ''), gallery_members.created_at
+	FROM gallery_members
+	JOIN users ON users.id = gallery_members.user_id
+	WHERE gallery_members.gallery_id = $1
+	ORDER BY gallery_members.created_at, users.id;`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("query gallery members: %w", err)
+	}
+	defer rows.Close()
+
+	var members []Member
+	for rows.Next() {
+		var member Member
+		err = rows.Scan(&member.UserID, &member.Email, &member.Username, &member.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("query gallery members: %w", err)
+		}
+		members = append(members, member)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("query gallery members: %w", rows.Err())
+	}
+	return members, nil
+}
+
+// RemoveMember takes away the access of a member to the gallery.
+// ErrNotFound is returned if the user isn't a member of it.
+func (service *GalleryService) RemoveMember(galleryID, userID int) error {
+	res, err := service.DB.Exec(`
+	DELETE FROM gallery_members WHERE gallery_id = $1 AND user_id = $2;`, galleryID, userID)
+	if err != nil {
+		return fmt.Errorf("remove gallery member: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("remove gallery member: %w", err)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// CopyImages copies images into the gallery with id targetID, along with
+// their metadata and edit history, and returns the copies. Filenames that are
+// already taken in the target gallery get a " (n)" suffix. Either all of the
+// images are copied or none of them are.
+func (service *GalleryService) CopyImages(images []Image, targetID int) ([]Image, error) {
+	copies, err := service.copyFiles(images, targetID)
+	if err != nil {
+		return nil, fmt.Errorf("copy images: %w", err)
+	}
+
+	tx, err := service.DB.Begin()
+	if err != nil {
+		service.removeFiles(copies)
+		return nil, fmt.Errorf("copy images: %w", err)
+	}
+	defer tx.Rollback()
+	err = service.checkQuota(tx, targetID, totalUsage(copies), false)
+	if err != nil {
+		service.removeFiles(copies)
+		return nil, fmt.Errorf("copy images: %w", err)
+	}
+	for i := range copies {
+		err = insertImage(tx, &copies[i])
+		if err != nil {
+			service.removeFiles(copies)
+			return nil, fmt.Errorf("copy images: %w", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		service.removeFiles(copies)
+		return nil, fmt.Errorf("copy images: %w", err)
+	}
+	return copies, nil
+}
+
+// MoveImages moves images into the gallery with id targetID and returns them
+// as they are after the move. Filenames that are already taken in the target
+// gallery get a " (n)" suffix. Either all of the images are moved or none of
+// them are.
+func (service *GalleryService) MoveImages(images []Image, targetID int) ([]Image, error) {
+	for _, image := range images {
+		if image.GalleryID == targetID {
+			return nil, fmt.Errorf("move images: %v is already in gallery %d", image.Filename, targetID)
+		}
+	}
+	// The files are copied under the prefix of the target gallery first, as
+	// they would otherwise go away when the old gallery is deleted. The
+	// database only points at them once the transaction has been committed,
+	// and the old files are removed after that, so a failure at any point
+	// leaves every image where it was. The removal of the old files is
+	// recorded in the transaction, so it is retried if it fails.
+	moved, err := service.copyFiles(images, targetID)
+	if err != nil {
+		return nil, fmt.Errorf("move images: %w", err)
+	}
+
+	tx, err := service.DB.Begin()
+	if err != nil {
+		service.removeFiles(moved)
+		return nil, fmt.Errorf("move images: %w", err)
+	}
+	defer tx.Rollback()
+	// images are only moved between the galleries of a user, so only the target gallery can go over its quota
+	err = service.checkQuota(tx, targetID, totalUsage(images), true)
+	if err != nil {
+		service.removeFiles(moved)
+		return nil, fmt.Errorf("move images: %w", err)
+	}
+	var deletionIDs []int
+	for i, image := range images {
+		moved[i].Filename, err = freeFilename(tx, targetID, image.Filename)
+		if err != nil {
+			service.removeFiles(moved)
+			return nil, fmt.Errorf("move images: %w", err)
+		}
+		err = moveImageRow(tx, image, moved[i])
+		if err != nil {
+			service.removeFiles(moved)
+			return nil, fmt.Errorf("move images: %w", err)
+		}
+		ids, err := enqueueImageDeletion(tx, image)
+		if err != nil {
+			service.removeFiles(moved)
+			return nil, fmt.Errorf("move images: %w", err)
+		}
+		deletionIDs = append(deletionIDs, ids...)
+	}
+	err = tx.Commit()
+	if err != nil {
+		service.removeFiles(moved)
+		return nil, fmt.Errorf("move images: %w", err)
+	}
+
+	// the images are moved at this point
+	service.runDeletions(deletionIDs)
+	return moved, nil
+}
+
+// totalUsage returns how much the images store together
+func totalUsage(images []Image) Usage {
+	usage := Usage{Images: len(images)}
+	for _, image := range images {
+		usage.Bytes += image.Size
+	}
+	return usage
+}
+
+// moveImageRow points the database row of image at its new gallery, filename and key
+func moveImageRow(tx *sql.Tx, image, moved Image) error {
+	res, err := tx.Exec(`
+	UPDATE images
+	SET gallery_id = $3, filename = $4, storage_key = $5
+	WHERE id = $1 AND gallery_id = $2 AND deleted_at IS NULL;`, image.ID, image.GalleryID, moved.GalleryID,
+		moved.Filename, moved.Key)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		// deleted or moved by another request in the meantime
+		return fmt.Errorf("%v: %w", image.Filename, ErrNotFound)
+	}
+	return nil
+}
+
+// copyFiles stores a copy of the file of every image under a new key in the
+// gallery with id targetID, and returns the images as they would be in that
+// gallery. Nothing is written to the database.
+func (service *GalleryService) copyFiles(images []Image, targetID int) ([]Image, error) {
+	var copies []Image
+	for _, image := range images {
+		key, err := newImageKey(targetID, image.Filename)
+		if err == nil {
+			err = service.copyFile(image.Key, key)
+		}
+		if err != nil {
+			service.removeFiles(copies)
+			return nil, fmt.Errorf("copying %v: %w", image.Filename, err)
+		}
+		cp := image
+		cp.ID = 0
+		cp.GalleryID = targetID
+		cp.Key = key
+		copies = append(copies, cp)
+	}
+	return copies, nil
+}
+
+func (service *GalleryService) copyFile(srcKey, dstKey string) error {
+	src, err := service.storage().Open(srcKey)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return service.storage().Create(dstKey, src)
+}
+
+// removeFiles removes the stored files of images, ignoring any errors as a
+// file that is left behind only wastes some space.
+func (service *GalleryService) removeFiles(images []Image) {
+	for _, image := range images {
+		service.storage().Remove(image.Key)
+	}
+}
+
+// freeFilename returns filename, or filename with a " (n)" suffix if it is already taken in the gallery
+func freeFilename(q queryRower, galleryID int, filename string) (string, error) {
+	candidate := filename
+	for n := 2; n < 1000; n++ {
+		var id int
+		row := q.QueryRow(`
+		SELECT id FROM images
+		WHERE gallery_id = $1 AND filename = $2 AND deleted_at IS NULL;`, galleryID, candidate)
+		err := row.Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return candidate, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("free filename: %w", err)
+		}
+		candidate = withSuffix(filename, n)
+	}
+	return "", fmt.Errorf("free filename: no free filename for %v", filename)
+}
@@ -123,6 +123,22 @@ func (service *PasswordResetService) Consume(token string) (*User, error) {
 	return &user, nil
 }
 
+// DeleteExpired deletes the password resets that have expired, and returns how many
+// there were.
+func (service *PasswordResetService) DeleteExpired() (int, error) {
+	result, err := service.DB.Exec(`
+	DELETE FROM password_resets
+	WHERE expires_at < now();`)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired password resets: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete expired password resets: %w", err)
+	}
+	return int(n), nil
+}
+
 // function for hashing the token
 func (service *PasswordResetService) hash(token string) string {
 	tokenHash := sha256.Sum256([]byte(token))
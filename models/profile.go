@@ -0,0 +1,257 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ayushthe1/lenspix/rand"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+)
+
+const (
+	// MaxDisplayNameLength is the longest display name, in characters
+	MaxDisplayNameLength = 100
+	// MaxBioLength is the longest bio, in characters
+	MaxBioLength = 1000
+	// MaxWebsiteLength is the longest website URL, in bytes
+	MaxWebsiteLength = 500
+)
+
+// usernameRegexp matches the usernames we accept: 3 to 30 lowercase letters,
+// digits, dashes and underscores, starting with a letter or digit.
+var usernameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{2,29}$`)
+
+// Profile is the public face of a user, shown at /u/{username}.
+type Profile struct {
+	UserID int
+	// Username is empty until the user picks one, and there is no public profile until then
+	Username    string
+	DisplayName string
+	Bio         string
+	Website     string
+	AvatarKey   string
+}
+
+// Name returns the name to show for the user
+func (profile Profile) Name() string {
+	if profile.DisplayName != "" {
+		return profile.DisplayName
+	}
+	return profile.Username
+}
+
+// AvatarVersion returns a string that changes whenever the avatar does, to be used in its URL
+func (profile Profile) AvatarVersion() string {
+	return strings.TrimSuffix(path.Base(profile.AvatarKey), path.Ext(profile.AvatarKey))
+}
+
+// ProfileError is returned when a profile can't be saved because one of its fields isn't valid.
+type ProfileError struct {
+	Issue string
+}
+
+func (pe ProfileError) Error() string {
+	return fmt.Sprintf("invalid profile: %v", pe.Issue)
+}
+
+type ProfileService struct {
+	DB *sql.DB
+	// GalleryService is used to store avatars next to the images
+	GalleryService *GalleryService
+}
+
+// ByUserID returns the profile of a user. Users that haven't set up their profile get an empty one.
+func (service *ProfileService) ByUserID(userID int) (*Profile, error) {
+	profiles, err := service.queryProfiles(`WHERE id = $1;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("profile by user id: %w", err)
+	}
+	if len(profiles) == 0 {
+		return nil, ErrNotFound
+	}
+	return &profiles[0], nil
+}
+
+// ByUsername returns the profile with the given username, or ErrNotFound.
+// Usernames aren't case sensitive.
+func (service *ProfileService) ByUsername(username string) (*Profile, error) {
+	profiles, err := service.queryProfiles(`WHERE username = $1;`, strings.ToLower(username))
+	if err != nil {
+		return nil, fmt.Errorf("profile by username: %w", err)
+	}
+	if len(profiles) == 0 {
+		return nil, ErrNotFound
+	}
+	return &profiles[0], nil
+}
+
+// Update saves the username, display name, bio and website of a profile.
+// The username is lowercased. A ProfileError is returned for invalid fields,
+// and ErrUsernameTaken if another user has the username.
+func (service *ProfileService) Update(profile *Profile) error {
+	profile.Username = strings.ToLower(strings.TrimSpace(profile.Username))
+	profile.DisplayName = strings.TrimSpace(profile.DisplayName)
+	profile.Bio = strings.TrimSpace(profile.Bio)
+	profile.Website = strings.TrimSpace(profile.Website)
+	err := profile.validate()
+	if err != nil {
+		return fmt.Errorf("update profile: %w", err)
+	}
+
+	_, err = service.DB.Exec(`
+	UPDATE users
+	SET username = NULLIF($2, ''), display_name = $3, bio = $4, website = $5
+	WHERE id = $1;`, profile.UserID, profile.Username, profile.DisplayName, profile.Bio, profile.Website)
+	if err != nil {
+		var pgError *pgconn.PgError
+		if errors.As(err, &pgError) && pgError.Code == pgerrcode.UniqueViolation {
+			return ErrUsernameTaken
+		}
+		return fmt.Errorf("update profile: %w", err)
+	}
+	return nil
+}
+
+func (profile Profile) validate() error {
+	if profile.Username != "" && !usernameRegexp.MatchString(profile.Username) {
+		return ProfileError{Issue: "usernames are 3 to 30 lowercase letters, digits, dashes and underscores"}
+	}
+	if utf8.RuneCountInString(profile.DisplayName) > MaxDisplayNameLength {
+		return ProfileError{Issue: fmt.Sprintf("the display name can be at most %d characters long", MaxDisplayNameLength)}
+	}
+	if utf8.RuneCountInString(profile.Bio) > MaxBioLength {
+		return ProfileError{Issue: fmt.Sprintf("the bio can be at most %d characters long", MaxBioLength)}
+	}
+	if profile.Website != "" {
+		u, err := url.Parse(profile.Website)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(profile.Website) > MaxWebsiteLength {
+			return ProfileError{Issue: "the website has to be a http or https URL"}
+		}
+	}
+	return nil
+}
+
+// SetAvatar stores a new avatar for a user, replacing their old one.
+func (service *ProfileService) SetAvatar(userID int, contents io.ReadSeeker) error {
+	contentType, err := checkContentType(contents, service.GalleryService.imageContentTypes())
+	if err != nil {
+		return fmt.Errorf("set avatar: %w", err)
+	}
+	_, err = checkImage(contents, service.GalleryService.ImageLimits)
+	if err != nil {
+		return fmt.Errorf("set avatar: %w", err)
+	}
+
+	b, err := rand.Bytes(16)
+	if err != nil {
+		return fmt.Errorf("set avatar: %w", err)
+	}
+	ext := map[string]string{"image/png": ".png", "image/jpeg": ".jpg", "image/gif": ".gif"}[contentType]
+	key := path.Join(avatarsPrefix(userID), hex.EncodeToString(b)+ext)
+	err = service.GalleryService.storage().Create(key, contents)
+	if err != nil {
+		return fmt.Errorf("set avatar: %w", err)
+	}
+	err = service.setAvatarKey(userID, key)
+	if err != nil {
+		service.GalleryService.storage().Remove(key)
+		return fmt.Errorf("set avatar: %w", err)
+	}
+	return nil
+}
+
+// DeleteAvatar removes the avatar of a user.
+func (service *ProfileService) DeleteAvatar(userID int) error {
+	err := service.setAvatarKey(userID, "")
+	if err != nil {
+		return fmt.Errorf("delete avatar: %w", err)
+	}
+	return nil
+}
+
+// setAvatarKey points the profile at a new avatar, and removes the file of the old one
+func (service *ProfileService) setAvatarKey(userID int, key string) error {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var oldKey string
+	row := tx.QueryRow(`
+	SELECT avatar_key FROM users WHERE id = $1 FOR UPDATE;`, userID)
+	err = row.Scan(&oldKey)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+	UPDATE users
+	SET avatar_key = $2
+	WHERE id = $1;`, userID, key)
+	if err != nil {
+		return err
+	}
+	var deletionIDs []int
+	if oldKey != "" {
+		id, err := enqueueDeletion(tx, deleteObject, oldKey)
+		if err != nil {
+			return err
+		}
+		deletionIDs = append(deletionIDs, id)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	service.GalleryService.runDeletions(deletionIDs)
+	return nil
+}
+
+// OpenAvatar opens the avatar of a profile. Callers must close it.
+// ErrNotFound is returned if the profile doesn't have an avatar.
+func (service *ProfileService) OpenAvatar(profile Profile) (*Object, error) {
+	if profile.AvatarKey == "" {
+		return nil, ErrNotFound
+	}
+	obj, err := service.GalleryService.storage().Open(profile.AvatarKey)
+	if err != nil {
+		return nil, fmt.Errorf("open avatar: %w", err)
+	}
+	return obj, nil
+}
+
+// avatarsPrefix is where the avatars of a user are kept
+func avatarsPrefix(userID int) string {
+	return fmt.Sprintf("avatars/user-%d", userID)
+}
+
+// queryProfiles returns the profiles of the users matching the given WHERE clause
+func (service *ProfileService) queryProfiles(where string, args ...interface{}) ([]Profile, error) {
+	rows, err := service.DB.Query(`
+	SELECT id, COALESCE(username, ''), display_name, bio, website, avatar_key
+	FROM users
+	`+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var profiles []Profile
+	for rows.Next() {
+		var profile Profile
+		err = rows.Scan(&profile.UserID, &profile.Username, &profile.DisplayName, &profile.Bio,
+			&profile.Website, &profile.AvatarKey)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, rows.Err()
+}
@@ -0,0 +1,153 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ayushthe1/lenspix/rand"
+)
+
+// QuarantinedUpload is an upload that couldn't be scanned for malware. It is
+// kept out of its gallery until an admin releases or deletes it.
+type QuarantinedUpload struct {
+	ID          int
+	GalleryID   int
+	Filename    string
+	Key         string
+	Checksum    string
+	Size        int64
+	ContentType string
+	// Reason is why the upload couldn't be scanned
+	Reason    string
+	CreatedAt time.Time
+}
+
+// quarantine stores an upload that couldn't be scanned away from the gallery's images
+func (service *GalleryService) quarantine(galleryID int, filename string, contents io.Reader, checksum string, size int64, contentType, reason string) error {
+	b, err := rand.Bytes(16)
+	if err != nil {
+		return fmt.Errorf("quarantine: %w", err)
+	}
+	// Storage.List only returns the files directly inside the gallery, so
+	// these won't be picked up as images of the gallery.
+	key := path.Join(galleryPrefix(galleryID), "quarantine", hex.EncodeToString(b)+strings.ToLower(path.Ext(filename)))
+	err = service.storage().Create(key, contents)
+	if err != nil {
+		return fmt.Errorf("quarantine: %w", err)
+	}
+
+	_, err = service.DB.Exec(`
+	INSERT INTO quarantined_uploads (gallery_id, filename, storage_key, checksum, size, content_type, reason)
+	VALUES ($1, $2, $3, $4, $5, $6, $7);`, galleryID, filename, key, checksum, size, contentType, reason)
+	if err != nil {
+		service.storage().Remove(key)
+		return fmt.Errorf("quarantine: %w", err)
+	}
+	return nil
+}
+
+// Quarantined returns every upload that is waiting for review, oldest first.
+func (service *GalleryService) Quarantined() ([]QuarantinedUpload, error) {
+	rows, err := service.DB.Query(`
+	SELECT id, gallery_id, filename, storage_key, checksum, size, content_type, reason, created_at
+	FROM quarantined_uploads
+	ORDER BY created_at;`)
+	if err != nil {
+		return nil, fmt.Errorf("quarantined: %w", err)
+	}
+	defer rows.Close()
+
+	var uploads []QuarantinedUpload
+	for rows.Next() {
+		var upload QuarantinedUpload
+		err = rows.Scan(&upload.ID, &upload.GalleryID, &upload.Filename, &upload.Key, &upload.Checksum,
+			&upload.Size, &upload.ContentType, &upload.Reason, &upload.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("quarantined: %w", err)
+		}
+		uploads = append(uploads, upload)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("quarantined: %w", rows.Err())
+	}
+	return uploads, nil
+}
+
+// QuarantinedByID returns a single quarantined upload.
+func (service *GalleryService) QuarantinedByID(id int) (*QuarantinedUpload, error) {
+	upload := QuarantinedUpload{
+		ID: id,
+	}
+	row := service.DB.QueryRow(`
+	SELECT gallery_id, filename, storage_key, checksum, size, content_type, reason, created_at
+	FROM quarantined_uploads
+	WHERE id = $1;`, id)
+	err := row.Scan(&upload.GalleryID, &upload.Filename, &upload.Key, &upload.Checksum,
+		&upload.Size, &upload.ContentType, &upload.Reason, &upload.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("quarantined by id: %w", err)
+	}
+	return &upload, nil
+}
+
+// OpenQuarantined opens the stored file of a quarantined upload so that it can be inspected. Callers must close it.
+func (service *GalleryService) OpenQuarantined(upload QuarantinedUpload) (*Object, error) {
+	obj, err := service.storage().Open(upload.Key)
+	if err != nil {
+		return nil, fmt.Errorf("open quarantined: %w", err)
+	}
+	return obj, nil
+}
+
+// ReleaseQuarantined adds a quarantined upload to its gallery without scanning it again.
+func (service *GalleryService) ReleaseQuarantined(id int) (Image, error) {
+	upload, err := service.QuarantinedByID(id)
+	if err != nil {
+		return Image{}, fmt.Errorf("release quarantined: %w", err)
+	}
+	obj, err := service.OpenQuarantined(*upload)
+	if err != nil {
+		return Image{}, fmt.Errorf("release quarantined: %w", err)
+	}
+	defer obj.Close()
+
+	image, err := service.createImage(upload.GalleryID, upload.Filename, obj, false)
+	if err != nil {
+		return Image{}, fmt.Errorf("release quarantined: %w", err)
+	}
+	err = service.DeleteQuarantined(id)
+	if err != nil {
+		return Image{}, fmt.Errorf("release quarantined: %w", err)
+	}
+	return image, nil
+}
+
+// DeleteQuarantined removes a quarantined upload for good.
+func (service *GalleryService) DeleteQuarantined(id int) error {
+	var key string
+	row := service.DB.QueryRow(`
+	DELETE FROM quarantined_uploads
+	WHERE id = $1
+	RETURNING storage_key;`, id)
+	err := row.Scan(&key)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("delete quarantined: %w", err)
+	}
+	err = service.storage().Remove(key)
+	if err != nil {
+		return fmt.Errorf("delete quarantined: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Quota limits how much can be stored. Limits that are 0 aren't enforced.
+type Quota struct {
+	MaxBytes  int64
+	MaxImages int
+}
+
+// Usage is how much is stored. Images in the trash are included, as their
+// files are kept until they are purged.
+type Usage struct {
+	Bytes  int64
+	Images int
+}
+
+// QuotaError is returned when an image can't be added because it would take
+// a user or gallery over its quota.
+type QuotaError struct {
+	Issue string
+}
+
+func (qe QuotaError) Error() string {
+	return fmt.Sprintf("over quota: %v", qe.Issue)
+}
+
+// UserUsage returns how much the galleries of a user store in total.
+func (service *GalleryService) UserUsage(userID int) (Usage, error) {
+	return userUsage(service.DB, userID)
+}
+
+// GalleryUsages returns how much each gallery of a user stores, keyed by
+// gallery id. Galleries in the trash are included.
+func (service *GalleryService) GalleryUsages(userID int) (map[int]Usage, error) {
+	rows, err := service.DB.Query(`
+	SELECT galleries.id, COUNT(images.id), COALESCE(SUM(images.size), 0)
+	FROM galleries
+	LEFT JOIN images ON images.gallery_id = galleries.id
+	WHERE galleries.user_id = $1
+	GROUP BY galleries.id;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("gallery usages: %w", err)
+	}
+	defer rows.Close()
+
+	usages := make(map[int]Usage)
+	for rows.Next() {
+		var id int
+		var usage Usage
+		err = rows.Scan(&id, &usage.Images, &usage.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("gallery usages: %w", err)
+		}
+		usages[id] = usage
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("gallery usages: %w", rows.Err())
+	}
+	return usages, nil
+}
+
+// galleryUsage returns how much a single gallery stores
+func galleryUsage(q queryRower, galleryID int) (Usage, error) {
+	var usage Usage
+	row := q.QueryRow(`
+	SELECT COUNT(id), COALESCE(SUM(size), 0)
+	FROM images
+	WHERE gallery_id = $1;`, galleryID)
+	err := row.Scan(&usage.Images, &usage.Bytes)
+	if err != nil {
+		return Usage{}, fmt.Errorf("gallery usage: %w", err)
+	}
+	return usage, nil
+}
+
+// userUsage returns how much the galleries of a user store in total
+func userUsage(q queryRower, userID int) (Usage, error) {
+	var usage Usage
+	row := q.QueryRow(`
+	SELECT COUNT(images.id), COALESCE(SUM(images.size), 0)
+	FROM galleries
+	JOIN images ON images.gallery_id = galleries.id
+	WHERE galleries.user_id = $1;`, userID)
+	err := row.Scan(&usage.Images, &usage.Bytes)
+	if err != nil {
+		return Usage{}, fmt.Errorf("user usage: %w", err)
+	}
+	return usage, nil
+}
+
+// checkQuota returns a QuotaError if adding images with a total size of bytes
+// to a gallery would take the gallery or its user over their quota. The
+// user's quota isn't checked if the images already belong to the same user,
+// as when they are moved between galleries.
+//
+// tx has to be the transaction that adds the images. The row of the user
+// that owns the gallery stays locked until it ends, so that concurrent
+// uploads to any of their galleries can't all fit under the quota.
+func (service *GalleryService) checkQuota(tx *sql.Tx, galleryID int, added Usage, sameUser bool) error {
+	var userID int
+	row := tx.QueryRow(`
+	SELECT users.id
+	FROM galleries
+	JOIN users ON users.id = galleries.user_id
+	WHERE galleries.id = $1
+	FOR UPDATE OF users;`, galleryID)
+	err := row.Scan(&userID)
+	if err != nil {
+		return fmt.Errorf("check quota: %w", err)
+	}
+
+	usage, err := galleryUsage(tx, galleryID)
+	if err != nil {
+		return fmt.Errorf("check quota: %w", err)
+	}
+	err = exceeds(service.GalleryQuota, usage, added, "this gallery")
+	if err != nil {
+		return err
+	}
+	if sameUser {
+		return nil
+	}
+	usage, err = userUsage(tx, userID)
+	if err != nil {
+		return fmt.Errorf("check quota: %w", err)
+	}
+	return exceeds(service.UserQuota, usage, added, "your account")
+}
+
+// exceeds returns a QuotaError if usage plus added goes over quota
+func exceeds(quota Quota, usage, added Usage, owner string) error {
+	if quota.MaxImages > 0 && usage.Images+added.Images > quota.MaxImages {
+		return QuotaError{
+			Issue: fmt.Sprintf("%v is limited to %d images and already has %d", owner, quota.MaxImages, usage.Images),
+		}
+	}
+	if quota.MaxBytes > 0 && usage.Bytes+added.Bytes > quota.MaxBytes {
+		return QuotaError{
+			Issue: fmt.Sprintf("%v is limited to %v and already uses %v", owner, FormatBytes(quota.MaxBytes), FormatBytes(usage.Bytes)),
+		}
+	}
+	return nil
+}
+
+// FormatBytes formats a number of bytes for humans, like "1.5 MB"
+func FormatBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n) / unit
+	for _, prefix := range []string{"kB", "MB", "GB", "TB"} {
+		if value < unit {
+			return fmt.Sprintf("%.1f %v", value, prefix)
+		}
+		value /= unit
+	}
+	return fmt.Sprintf("%.1f PB", value)
+}
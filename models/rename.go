@@ -0,0 +1,95 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+)
+
+// RenameImage gives an image of a gallery a new filename. The old filename
+// keeps working through RenamedImage, so that links to the image don't break.
+// ErrFilenameTaken is returned if another image of the gallery already uses
+// the new filename.
+func (service *GalleryService) RenameImage(galleryID int, filename, newFilename string) (Image, error) {
+	image, err := service.Image(galleryID, filename)
+	if err != nil {
+		return Image{}, fmt.Errorf("rename image: %w", err)
+	}
+	newFilename = SanitizeFilename(newFilename)
+	if newFilename == image.Filename {
+		return image, nil
+	}
+	err = checkExtension(newFilename, service.extensions())
+	if err != nil {
+		return Image{}, fmt.Errorf("rename image: %w", err)
+	}
+
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return Image{}, fmt.Errorf("rename image: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+	UPDATE images
+	SET filename = $2
+	WHERE id = $1;`, image.ID, newFilename)
+	if err != nil {
+		var pgError *pgconn.PgError
+		if errors.As(err, &pgError) && pgError.Code == pgerrcode.UniqueViolation {
+			// the only unique constraint on filenames is the one per gallery
+			return Image{}, fmt.Errorf("rename image %v to %v: %w", image.Filename, newFilename, ErrFilenameTaken)
+		}
+		return Image{}, fmt.Errorf("rename image: %w", err)
+	}
+	// the new name now belongs to a real image, so it mustn't redirect anymore
+	_, err = tx.Exec(`
+	DELETE FROM image_redirects
+	WHERE gallery_id = $1 AND filename = $2;`, galleryID, newFilename)
+	if err != nil {
+		return Image{}, fmt.Errorf("rename image: %w", err)
+	}
+	_, err = tx.Exec(`
+	INSERT INTO image_redirects (gallery_id, filename, image_id)
+	VALUES ($1, $2, $3) ON CONFLICT (gallery_id, filename) DO
+	UPDATE
+	SET image_id = $3, created_at = now();`, galleryID, image.Filename, image.ID)
+	if err != nil {
+		return Image{}, fmt.Errorf("rename image: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return Image{}, fmt.Errorf("rename image: %w", err)
+	}
+
+	image.Filename = newFilename
+	return image, nil
+}
+
+// RenamedImage returns the image that used to be called filename in the
+// gallery, or ErrNotFound if there never was one or it has been deleted.
+func (service *GalleryService) RenamedImage(galleryID int, filename string) (Image, error) {
+	var imageID int
+	row := service.DB.QueryRow(`
+	SELECT image_id FROM image_redirects
+	WHERE gallery_id = $1 AND filename = $2;`, galleryID, filename)
+	err := row.Scan(&imageID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Image{}, ErrNotFound
+		}
+		return Image{}, fmt.Errorf("renamed image: %w", err)
+	}
+	images, err := service.queryImages(`
+	WHERE images.id = $1 AND images.deleted_at IS NULL;`, imageID)
+	if err != nil {
+		return Image{}, fmt.Errorf("renamed image: %w", err)
+	}
+	if len(images) == 0 {
+		return Image{}, ErrNotFound
+	}
+	return images[0], nil
+}
@@ -0,0 +1,151 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	stdimage "image"
+	"image/jpeg"
+	"image/png"
+	"path"
+	"strings"
+)
+
+// Rendition is a version of an image that is ready to be served. It is
+// either the original file, or a file derived from it which is generated on
+// first use and then kept in storage.
+type Rendition struct {
+	*Object
+	ContentType string
+	// ETag is a strong ETag for the contents, including the quotes
+	ETag string
+}
+
+// RenditionOptions describe how a rendition differs from the original image.
+// The zero value is the original image.
+type RenditionOptions struct {
+	// Edits are applied to the original image, in order
+	Edits []Edit
+	// Watermark is drawn over the edited image if set. GIFs are never
+	// watermarked, see Rendition.
+	Watermark *Watermark
+}
+
+// variant returns a name that is unique for every combination of options that changes the rendered image
+func (opts RenditionOptions) variant() string {
+	var parts []string
+	if len(opts.Edits) > 0 {
+		parts = append(parts, "e"+editsFingerprint(opts.Edits))
+	}
+	if opts.Watermark != nil {
+		parts = append(parts, "wm"+opts.Watermark.fingerprint())
+	}
+	return strings.Join(parts, "-")
+}
+
+// Rendition opens the version of image described by opts. Callers must close it.
+func (service *GalleryService) Rendition(image Image, opts RenditionOptions) (*Rendition, error) {
+	if image.ContentType == "image/gif" {
+		// renditions are a single frame, so a watermark would cost animated gifs their animation
+		opts.Watermark = nil
+	}
+	variant := opts.variant()
+	if variant == "" {
+		obj, err := service.OpenImage(image)
+		if err != nil {
+			return nil, fmt.Errorf("rendition: %w", err)
+		}
+		return &Rendition{
+			Object:      obj,
+			ContentType: image.ContentType,
+			ETag:        `"` + image.Checksum + `"`,
+		}, nil
+	}
+
+	contentType, ext := "image/png", ".png"
+	if image.ContentType == "image/jpeg" {
+		contentType, ext = "image/jpeg", ".jpg"
+	}
+	rendition := Rendition{
+		ContentType: contentType,
+		ETag:        `"` + image.Checksum + "-" + variant + `"`,
+	}
+	key := path.Join(renditionsPrefix(image.GalleryID), fmt.Sprintf("%d-%s%s", image.ID, variant, ext))
+
+	obj, err := service.storage().Open(key)
+	if err == nil {
+		rendition.Object = obj
+		return &rendition, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("rendition: %w", err)
+	}
+
+	// the rendition hasn't been generated yet
+	data, err := service.renderImage(image, opts, contentType)
+	if err != nil {
+		return nil, fmt.Errorf("rendition: %w", err)
+	}
+	err = service.storage().Create(key, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("rendition: %w", err)
+	}
+	obj, err = service.storage().Open(key)
+	if err != nil {
+		return nil, fmt.Errorf("rendition: %w", err)
+	}
+	rendition.Object = obj
+	return &rendition, nil
+}
+
+// renderImage applies opts to the original image and encodes the result as contentType
+func (service *GalleryService) renderImage(image Image, opts RenditionOptions, contentType string) ([]byte, error) {
+	obj, err := service.OpenImage(image)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	img, _, err := stdimage.Decode(obj)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %v: %w", image.Filename, err)
+	}
+
+	img = applyEdits(img, opts.Edits)
+	if opts.Watermark != nil {
+		mark, err := service.watermarkImage(*opts.Watermark)
+		if err != nil {
+			return nil, err
+		}
+		img = applyWatermark(img, mark, *opts.Watermark)
+	}
+
+	var buf bytes.Buffer
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("encoding %v: %w", image.Filename, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// renditionsPrefix is where the renditions of the images of a gallery are kept
+func renditionsPrefix(galleryID int) string {
+	return path.Join(galleryPrefix(galleryID), "renditions")
+}
+
+// renditionsKeyPrefix is what the keys of all renditions of an image start with
+func renditionsKeyPrefix(image Image) string {
+	return path.Join(renditionsPrefix(image.GalleryID), fmt.Sprintf("%d-", image.ID))
+}
+
+// removeRenditions deletes the generated renditions of a single image
+func (service *GalleryService) removeRenditions(image Image) error {
+	err := service.removeObjects(deleteMatching, renditionsKeyPrefix(image))
+	if err != nil {
+		return fmt.Errorf("remove renditions: %w", err)
+	}
+	return nil
+}
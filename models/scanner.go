@@ -0,0 +1,122 @@
+package models
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Scanner checks uploaded files for malware before they are stored.
+type Scanner interface {
+	// Scan reads all of r and reports if it is infected. An error means the
+	// file couldn't be scanned, not that it is infected.
+	Scan(r io.Reader) (ScanResult, error)
+}
+
+type ScanResult struct {
+	Infected bool
+	// Signature is the name of the malware that was found, if any.
+	Signature string
+}
+
+const (
+	// DefaultClamdTimeout is the default time we wait on clamd to scan a file.
+	DefaultClamdTimeout = 30 * time.Second
+
+	// the size of the chunks the file is streamed to clamd in
+	clamdChunkSize = 32 * 1024
+)
+
+// ClamdScanner scans files with a clamd daemon using its INSTREAM command.
+type ClamdScanner struct {
+	// Network is "tcp" or "unix". Defaults to "tcp".
+	Network string
+	// Address of clamd, eg "clamav:3310" or "/var/run/clamav/clamd.ctl".
+	Address string
+	// Timeout for the whole scan. Defaults to DefaultClamdTimeout.
+	Timeout time.Duration
+}
+
+func (cs ClamdScanner) Scan(r io.Reader) (ScanResult, error) {
+	network := cs.Network
+	if network == "" {
+		network = "tcp"
+	}
+	timeout := cs.Timeout
+	if timeout == 0 {
+		timeout = DefaultClamdTimeout
+	}
+
+	conn, err := net.DialTimeout(network, cs.Address, timeout)
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("clamd scan: %w", err)
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("clamd scan: %w", err)
+	}
+
+	// The "z" prefix means that the command and the reply are terminated by a
+	// null byte. The file is sent in chunks, each prefixed by its length as a
+	// 4 byte big endian integer, and a zero length chunk ends the stream.
+	w := bufio.NewWriter(conn)
+	_, err = w.WriteString("zINSTREAM\x00")
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("clamd scan: %w", err)
+	}
+	buf := make([]byte, clamdChunkSize)
+	for {
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			err = binary.Write(w, binary.BigEndian, uint32(n))
+			if err != nil {
+				return ScanResult{}, fmt.Errorf("clamd scan: %w", err)
+			}
+			_, err = w.Write(buf[:n])
+			if err != nil {
+				return ScanResult{}, fmt.Errorf("clamd scan: %w", err)
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return ScanResult{}, fmt.Errorf("clamd scan: %w", readErr)
+		}
+	}
+	err = binary.Write(w, binary.BigEndian, uint32(0))
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("clamd scan: %w", err)
+	}
+	err = w.Flush()
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("clamd scan: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return ScanResult{}, fmt.Errorf("clamd scan: reading reply: %w", err)
+	}
+	return parseClamdReply(reply)
+}
+
+// parseClamdReply parses replies like "stream: OK", "stream: Eicar-Signature FOUND"
+// and "INSTREAM size limit exceeded. ERROR".
+func parseClamdReply(reply string) (ScanResult, error) {
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	switch {
+	case strings.HasSuffix(reply, " FOUND"):
+		signature := strings.TrimSuffix(reply, " FOUND")
+		signature = strings.TrimPrefix(signature, "stream: ")
+		return ScanResult{Infected: true, Signature: signature}, nil
+	case strings.HasSuffix(reply, ": OK"):
+		return ScanResult{}, nil
+	default:
+		return ScanResult{}, fmt.Errorf("clamd scan: unexpected reply %q", reply)
+	}
+}
@@ -0,0 +1,295 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// eicar is the standard antivirus test file
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeScanner reports every file containing needle as infected, and fails
+// every scan if err is set
+type fakeScanner struct {
+	needle    []byte
+	signature string
+	err       error
+
+	mu      sync.Mutex
+	scanned int
+}
+
+func (scanner *fakeScanner) Scan(r io.Reader) (ScanResult, error) {
+	scanner.mu.Lock()
+	scanner.scanned++
+	scanner.mu.Unlock()
+
+	if scanner.err != nil {
+		return ScanResult{}, scanner.err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("fake scan: %w", err)
+	}
+	if len(scanner.needle) > 0 && bytes.Contains(data, scanner.needle) {
+		return ScanResult{Infected: true, Signature: scanner.signature}, nil
+	}
+	return ScanResult{}, nil
+}
+
+func TestParseClamdReply(t *testing.T) {
+	tests := map[string]struct {
+		reply   string
+		want    ScanResult
+		wantErr bool
+	}{
+		"ok": {
+			reply: "stream: OK\x00",
+		},
+		"found": {
+			reply: "stream: Eicar-Signature FOUND\x00",
+			want:  ScanResult{Infected: true, Signature: "Eicar-Signature"},
+		},
+		"error": {
+			reply:   "INSTREAM size limit exceeded. ERROR\x00",
+			wantErr: true,
+		},
+		"malformed": {
+			reply:   "garbage",
+			wantErr: true,
+		},
+		"empty": {
+			reply:   "",
+			wantErr: true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := parseClamdReply(tc.reply)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+// fakeClamd accepts a single INSTREAM command, and replies with reply(stream)
+func fakeClamd(t *testing.T, reply func(stream []byte) string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		cmd, err := r.ReadString(0)
+		if err != nil || cmd != "zINSTREAM\x00" {
+			conn.Write([]byte("UNKNOWN COMMAND\x00"))
+			return
+		}
+		var stream []byte
+		for {
+			var size uint32
+			err = binary.Read(r, binary.BigEndian, &size)
+			if err != nil {
+				return
+			}
+			if size == 0 {
+				break
+			}
+			chunk := make([]byte, size)
+			_, err = io.ReadFull(r, chunk)
+			if err != nil {
+				return
+			}
+			stream = append(stream, chunk...)
+		}
+		conn.Write([]byte(reply(stream) + "\x00"))
+	}()
+	return l.Addr().String()
+}
+
+func TestClamdScanner(t *testing.T) {
+	// bigger than a chunk, so that it is sent in several
+	data := append(bytes.Repeat([]byte("a"), 2*clamdChunkSize+10), eicar...)
+	addr := fakeClamd(t, func(stream []byte) string {
+		if !bytes.Equal(stream, data) {
+			return "stream: got the wrong bytes ERROR"
+		}
+		return "stream: Eicar-Signature FOUND"
+	})
+	scanner := ClamdScanner{Address: addr, Timeout: 5 * time.Second}
+	result, err := scanner.Scan(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Infected || result.Signature != "Eicar-Signature" {
+		t.Errorf("got %+v, want Eicar-Signature", result)
+	}
+}
+
+func TestClamdScannerUnreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	scanner := ClamdScanner{Address: addr, Timeout: time.Second}
+	_, err = scanner.Scan(strings.NewReader("x"))
+	if err == nil {
+		t.Fatal("got no error from a clamd that isn't there")
+	}
+}
+
+// scanTest is a gallery to upload into with a fake scanner
+type scanTest struct {
+	service   *GalleryService
+	scanner   *fakeScanner
+	galleryID int
+	image     []byte
+}
+
+func newScanTest(t *testing.T) *scanTest {
+	t.Helper()
+	db := testDB(t)
+	userService := &UserService{DB: db}
+	user, err := userService.Create(fmt.Sprintf("scan-%d@example.com", time.Now().UnixNano()), "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test := &scanTest{
+		scanner: &fakeScanner{needle: []byte(eicar), signature: "Eicar-Signature"},
+	}
+	test.service = &GalleryService{
+		DB:        db,
+		ImagesDir: t.TempDir(),
+		Scanner:   test.scanner,
+	}
+	gallery, err := test.service.Create("Scanned", user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.galleryID = gallery.ID
+
+	var buf bytes.Buffer
+	err = png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 8)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.image = buf.Bytes()
+	return test
+}
+
+// quarantined returns the uploads of the gallery that were quarantined
+func (test *scanTest) quarantined(t *testing.T) []QuarantinedUpload {
+	t.Helper()
+	uploads, err := test.service.Quarantined()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ours []QuarantinedUpload
+	for _, upload := range uploads {
+		if upload.GalleryID == test.galleryID {
+			ours = append(ours, upload)
+		}
+	}
+	return ours
+}
+
+func (test *scanTest) images(t *testing.T) []Image {
+	t.Helper()
+	images, err := test.service.Images(test.galleryID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return images
+}
+
+func TestCreateImageScanned(t *testing.T) {
+	test := newScanTest(t)
+	image, err := test.service.CreateImage(test.galleryID, "clean.png", bytes.NewReader(test.image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if test.scanner.scanned != 1 {
+		t.Errorf("scanned %d files, want 1", test.scanner.scanned)
+	}
+	if images := test.images(t); len(images) != 1 || images[0].ID != image.ID {
+		t.Errorf("gallery has %v, want only %v", images, image.Filename)
+	}
+}
+
+func TestCreateImageInfected(t *testing.T) {
+	test := newScanTest(t)
+	// a PNG decoder stops at the end of the image, so it is still a valid image
+	infected := append(append([]byte(nil), test.image...), eicar...)
+	_, err := test.service.CreateImage(test.galleryID, "infected.png", bytes.NewReader(infected))
+	var fileErr FileError
+	if !errors.As(err, &fileErr) || !strings.Contains(fileErr.Issue, "Eicar-Signature") {
+		t.Fatalf("got error %v, want a FileError about Eicar-Signature", err)
+	}
+	if images := test.images(t); len(images) != 0 {
+		t.Errorf("gallery has %v, want no images", images)
+	}
+	if uploads := test.quarantined(t); len(uploads) != 0 {
+		t.Errorf("quarantined %v, want nothing", uploads)
+	}
+}
+
+func TestCreateImageScanFailed(t *testing.T) {
+	test := newScanTest(t)
+	test.scanner.err = errors.New("clamd is down")
+	_, err := test.service.CreateImage(test.galleryID, "unscanned.png", bytes.NewReader(test.image))
+	if !errors.Is(err, ErrQuarantined) {
+		t.Fatalf("got error %v, want ErrQuarantined", err)
+	}
+	if images := test.images(t); len(images) != 0 {
+		t.Errorf("gallery has %v, want no images", images)
+	}
+	uploads := test.quarantined(t)
+	if len(uploads) != 1 {
+		t.Fatalf("quarantined %v, want the upload", uploads)
+	}
+	if uploads[0].Filename != "unscanned.png" || uploads[0].Reason != "clamd is down" {
+		t.Errorf("quarantined %+v, want unscanned.png because clamd is down", uploads[0])
+	}
+	obj, err := test.service.OpenQuarantined(uploads[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+	data, err := io.ReadAll(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, test.image) {
+		t.Error("the quarantined file isn't the upload")
+	}
+}
@@ -38,6 +38,17 @@ type SessionService struct {
 // will be returned as the Token field on the Session type, but only the hashed
 // session token is stored in the database.
 func (ss *SessionService) Create(userID int) (*Session, error) {
+	return ss.create(userID, nil)
+}
+
+// Impersonate creates a session that signs the admin in as the user, for
+// support. The admin is kept on the session, so that it can be told apart
+// from the sessions of the user.
+func (ss *SessionService) Impersonate(adminID, userID int) (*Session, error) {
+	return ss.create(userID, &adminID)
+}
+
+func (ss *SessionService) create(userID int, impersonatorID *int) (*Session, error) {
 	bytesPerToken := ss.BytesPerToken
 	if bytesPerToken < MinBytesPerToken {
 		bytesPerToken = MinBytesPerToken
@@ -52,25 +63,13 @@ func (ss *SessionService) Create(userID int) (*Session, error) {
 		Tokenhash: ss.hash(token),
 	}
 
-	// Try to update the user's session. If err, create a new session
+	// A user can have a session on every device they signed in on
 	row := ss.DB.QueryRow(`
-		UPDATE sessions
-		SET token_hash = $2
-		WHERE user_id = $1
-		RETURNING id;`, session.UserId, session.Tokenhash)
+		INSERT INTO sessions (user_id, token_hash, impersonator_id)
+		VALUES ($1, $2, $3)
+		RETURNING id;`, session.UserId, session.Tokenhash, impersonatorID)
 
 	err = row.Scan(&session.ID)
-
-	if err == sql.ErrNoRows {
-		// Store the token in our DB
-		row := ss.DB.QueryRow(`
-			INSERT INTO sessions (user_id, token_hash)
-			VALUES ($1, $2)
-			RETURNING id;`, session.UserId, session.Tokenhash)
-
-		err = row.Scan(&session.ID)
-	}
-
 	if err != nil {
 		return nil, fmt.Errorf("create: %w", err)
 	}
@@ -85,19 +84,25 @@ func (ss *SessionService) User(token string) (*User, error) {
 	tokenhash := ss.hash(token)
 
 	// Query for the session with that hash
+	// Suspended users are signed out, unless an admin is signed in as them
 	var user User
+	var impersonatorID sql.NullInt64
 	row := ss.DB.QueryRow(`
 		SELECT users.id,
     	users.email,
-    	users.password_hash
+    	users.password_hash,
+    	users.is_admin,
+    	sessions.impersonator_id
 	FROM sessions
     	JOIN users ON users.id = sessions.user_id
-	WHERE sessions.token_hash = $1;`, tokenhash)
+	WHERE sessions.token_hash = $1
+		AND (users.suspended_at IS NULL OR sessions.impersonator_id IS NOT NULL);`, tokenhash)
 
-	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash)
+	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash, &user.IsAdmin, &impersonatorID)
 	if err != nil {
 		return nil, fmt.Errorf("user: %w", err)
 	}
+	user.ImpersonatorID = int(impersonatorID.Int64)
 
 	// Return the user
 	return &user, nil
@@ -115,6 +120,19 @@ func (ss *SessionService) Delete(token string) error {
 	return nil
 }
 
+// DeleteOthers signs a user out everywhere except for the session with the
+// given token. If the token isn't one of the user's sessions, all of their
+// sessions are deleted.
+func (ss *SessionService) DeleteOthers(userID int, token string) error {
+	_, err := ss.DB.Exec(`
+	DELETE FROM sessions
+	WHERE user_id = $1 AND token_hash <> $2;`, userID, ss.hash(token))
+	if err != nil {
+		return fmt.Errorf("delete others: %w", err)
+	}
+	return nil
+}
+
 // function for hashing the session token using SHA256
 func (ss *SessionService) hash(token string) string {
 	tokenHash := sha256.Sum256([]byte(token))
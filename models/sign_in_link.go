@@ -0,0 +1,140 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ayushthe1/lenspix/rand"
+)
+
+// SignInLink lets a user sign in without their password, with a link that
+// is emailed to them.
+type SignInLink struct {
+	ID     int
+	UserID int
+	// Token is only set when a SignInLink is created
+	Token     string
+	Tokenhash string
+	ExpiresAt time.Time
+}
+
+const (
+	// DefaultSignInLinkDuration is the default time that a SignInLink is
+	// valid for.
+	DefaultSignInLinkDuration = 15 * time.Minute
+)
+
+type SignInLinkService struct {
+	DB *sql.DB
+	// BytesPerToken is used to determine how many bytes to use when generating
+	// each sign in token. If this value is not set or is less than the
+	// MinBytesPerToken const it will be ignored and MinBytesPerToken will be
+	// used.
+	BytesPerToken int
+	// Duration is the amount of time that a SignInLink is valid for.
+	// Defaults to DefaultSignInLinkDuration
+	Duration time.Duration
+}
+
+// Create makes a sign in link for the user with the given email address. A
+// user only has one link at a time, so any earlier one stops working.
+// ErrNotFound is returned if there is no user with the address.
+func (service *SignInLinkService) Create(email string) (*SignInLink, error) {
+	email = strings.ToLower(email)
+	var userID int
+	row := service.DB.QueryRow(`
+	SELECT id FROM users WHERE email = $1;`, email)
+	err := row.Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("create sign in link: %w", err)
+	}
+
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create sign in link: %w", err)
+	}
+	duration := service.Duration
+	if duration == 0 {
+		duration = DefaultSignInLinkDuration
+	}
+
+	link := SignInLink{
+		UserID:    userID,
+		Token:     token,
+		Tokenhash: service.hash(token),
+		ExpiresAt: time.Now().Add(duration),
+	}
+	row = service.DB.QueryRow(`
+	INSERT INTO sign_in_links (user_id, token_hash, expires_at)
+	VALUES ($1, $2, $3) ON CONFLICT (user_id) DO
+	UPDATE
+	SET token_hash = $2, expires_at = $3
+	RETURNING id;`, link.UserID, link.Tokenhash, link.ExpiresAt)
+	err = row.Scan(&link.ID)
+	if err != nil {
+		return nil, fmt.Errorf("create sign in link: %w", err)
+	}
+	return &link, nil
+}
+
+// Consume returns the user of a sign in token and deletes the link, so that
+// it can only be used once. ErrNotFound is returned if the token isn't valid
+// (anymore), and ErrAccountSuspended if an admin has suspended the user.
+func (service *SignInLinkService) Consume(token string) (*User, error) {
+	var user User
+	var expiresAt time.Time
+	var suspendedAt *time.Time
+	row := service.DB.QueryRow(`
+	DELETE FROM sign_in_links
+	USING users
+	WHERE sign_in_links.token_hash = $1 AND users.id = sign_in_links.user_id
+	RETURNING sign_in_links.expires_at, users.id, users.email, users.password_hash, users.suspended_at;`, service.hash(token))
+	err := row.Scan(&expiresAt, &user.ID, &user.Email, &user.PasswordHash, &suspendedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("consume sign in link: %w", err)
+	}
+	if time.Now().After(expiresAt) {
+		return nil, fmt.Errorf("consume sign in link: token expired: %w", ErrNotFound)
+	}
+	if suspendedAt != nil {
+		return nil, ErrAccountSuspended
+	}
+	return &user, nil
+}
+
+// DeleteExpired deletes the sign in links that have expired, and returns how many
+// there were.
+func (service *SignInLinkService) DeleteExpired() (int, error) {
+	result, err := service.DB.Exec(`
+	DELETE FROM sign_in_links
+	WHERE expires_at < now();`)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired sign in links: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete expired sign in links: %w", err)
+	}
+	return int(n), nil
+}
+
+// function for hashing the token
+func (service *SignInLinkService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
@@ -0,0 +1,158 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+)
+
+// MaxSlugLength is the longest slug of a gallery
+const MaxSlugLength = 60
+
+// slugRegexp matches the slugs we accept: lowercase letters and digits, in
+// groups separated by single dashes.
+var slugRegexp = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// reservedSlugs can't be used by galleries, as they are taken by other pages
+// under /u/{username}.
+var reservedSlugs = []string{"avatar"}
+
+// SlugError is returned when a gallery can't be given a slug because it isn't valid.
+type SlugError struct {
+	Issue string
+}
+
+func (se SlugError) Error() string {
+	return fmt.Sprintf("invalid slug: %v", se.Issue)
+}
+
+// Slugify turns the title of a gallery into a slug, like "Summer in Rome!"
+// into "summer-in-rome". It isn't guaranteed to be unique.
+func Slugify(title string) string {
+	var sb strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(title) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if dash && sb.Len() > 0 {
+				sb.WriteByte('-')
+			}
+			sb.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+		if sb.Len() >= MaxSlugLength {
+			break
+		}
+	}
+	slug := strings.Trim(sb.String(), "-")
+	if slug == "" || checkSlug(slug) != nil {
+		// nothing usable in the title, or only digits which would look like an id
+		slug = strings.Trim("gallery-"+slug, "-")
+	}
+	return slug
+}
+
+// checkSlug returns a SlugError if slug can't be used by a gallery
+func checkSlug(slug string) error {
+	if len(slug) > MaxSlugLength || !slugRegexp.MatchString(slug) {
+		return SlugError{Issue: fmt.Sprintf("slugs are up to %d lowercase letters and digits, separated by dashes", MaxSlugLength)}
+	}
+	// galleries can also be addressed by their id
+	if _, err := strconv.Atoi(slug); err == nil {
+		return SlugError{Issue: "slugs can't be only digits"}
+	}
+	for _, reserved := range reservedSlugs {
+		if slug == reserved {
+			return SlugError{Issue: fmt.Sprintf("%q is reserved", slug)}
+		}
+	}
+	return nil
+}
+
+// uniqueSlug returns base, or base with a number appended, such that no other
+// gallery of the user has it as its slug.
+func uniqueSlug(q queryRower, userID int, base string) (string, error) {
+	if len(base) > MaxSlugLength-4 {
+		// leave room for the number
+		base = strings.TrimRight(base[:MaxSlugLength-4], "-")
+	}
+	slug := base
+	for n := 2; ; n++ {
+		var taken bool
+		row := q.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM galleries WHERE user_id = $1 AND slug = $2);`, userID, slug)
+		err := row.Scan(&taken)
+		if err != nil {
+			return "", fmt.Errorf("unique slug: %w", err)
+		}
+		if !taken {
+			return slug, nil
+		}
+		slug = fmt.Sprintf("%s-%d", base, n)
+	}
+}
+
+// setSlug changes the slug of a gallery to a valid slug in tx. The old slug
+// keeps working through RenamedGallery, so that links to the gallery don't
+// break. gallery.Slug is left as it is, so that callers only change it once
+// tx has been committed.
+func setSlug(tx *sql.Tx, gallery *Gallery, slug string) error {
+	_, err := tx.Exec(`
+	UPDATE galleries
+	SET slug = $2
+	WHERE id = $1;`, gallery.ID, slug)
+	if err != nil {
+		var pgError *pgconn.PgError
+		if errors.As(err, &pgError) && pgError.Code == pgerrcode.UniqueViolation {
+			return fmt.Errorf("%v: %w", slug, ErrSlugTaken)
+		}
+		return err
+	}
+	// the new slug now belongs to a real gallery, so it mustn't redirect anymore
+	_, err = tx.Exec(`
+	DELETE FROM gallery_redirects
+	WHERE user_id = $1 AND slug = $2;`, gallery.UserID, slug)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+	INSERT INTO gallery_redirects (user_id, slug, gallery_id)
+	VALUES ($1, $2, $3) ON CONFLICT (user_id, slug) DO
+	UPDATE
+	SET gallery_id = $3, created_at = now();`, gallery.UserID, gallery.Slug, gallery.ID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// RenamedGallery returns the gallery of the user with the given username that
+// used to have slug, or ErrNotFound if there never was one or it has been
+// deleted.
+func (service *GalleryService) RenamedGallery(username, slug string) (*Gallery, error) {
+	var galleryID int
+	row := service.DB.QueryRow(`
+	SELECT gallery_redirects.gallery_id
+	FROM gallery_redirects
+	JOIN users ON users.id = gallery_redirects.user_id
+	WHERE users.username = $1 AND gallery_redirects.slug = $2;`, strings.ToLower(username), strings.ToLower(slug))
+	err := row.Scan(&galleryID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("renamed gallery: %w", err)
+	}
+	gallery, err := service.ByID(galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("renamed gallery: %w", err)
+	}
+	return gallery, nil
+}
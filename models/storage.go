@@ -0,0 +1,197 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage is the place where the bytes of our images live. Keys are slash
+// separated paths like "gallery-2/cat.png". The GalleryService only talks to
+// a Storage, so images can be kept on the local disk or in any other backend
+// (like an object store) that implements this interface.
+type Storage interface {
+	// Create stores everything read from r under key, replacing any existing
+	// object with the same key.
+	Create(key string, r io.Reader) error
+	// Open returns the object stored under key. Callers must close it.
+	// ErrNotFound is returned if the key doesn't exist.
+	Open(key string) (*Object, error)
+	// List returns the keys of all objects directly under prefix.
+	List(prefix string) ([]string, error)
+	// Prefixes returns the prefixes directly under prefix that hold objects,
+	// like "gallery-2" for "gallery-2/cat.png". An empty prefix lists the top
+	// level of the storage.
+	Prefixes(prefix string) ([]string, error)
+	// Remove deletes a single object. Removing a key that doesn't exist is
+	// not an error.
+	Remove(key string) error
+	// RemoveAll deletes every object under prefix. Like Remove, it succeeds
+	// if there is nothing to delete.
+	RemoveAll(prefix string) error
+}
+
+// Object is an opened object from a Storage. It is seekable so that it can
+// be used to serve Range requests no matter which backend it came from.
+type Object struct {
+	io.ReadSeekCloser
+	Size    int64
+	ModTime time.Time
+}
+
+// FileStorage is a Storage that keeps objects as files inside Dir.
+type FileStorage struct {
+	Dir string
+}
+
+func (fsys FileStorage) Create(key string, r io.Reader) error {
+	p, err := fsys.path(key)
+	if err != nil {
+		return fmt.Errorf("create %v: %w", key, err)
+	}
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return fmt.Errorf("create %v: %w", key, err)
+	}
+	// Write to a temporary file first and rename it into place once it is
+	// complete, so that readers never see a partially written file.
+	dst, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("create %v: %w", key, err)
+	}
+	defer os.Remove(dst.Name()) // a no-op once the file has been renamed
+
+	_, err = io.Copy(dst, r)
+	if err != nil {
+		dst.Close()
+		return fmt.Errorf("create %v: %w", key, err)
+	}
+	err = dst.Close()
+	if err != nil {
+		return fmt.Errorf("create %v: %w", key, err)
+	}
+	err = os.Chmod(dst.Name(), 0644)
+	if err != nil {
+		return fmt.Errorf("create %v: %w", key, err)
+	}
+	err = os.Rename(dst.Name(), p)
+	if err != nil {
+		return fmt.Errorf("create %v: %w", key, err)
+	}
+	return nil
+}
+
+func (fsys FileStorage) Open(key string) (*Object, error) {
+	p, err := fsys.path(key)
+	if err != nil {
+		return nil, fmt.Errorf("open %v: %w", key, err)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("open %v: %w", key, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("open %v: %w", key, err)
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, ErrNotFound
+	}
+	return &Object{
+		ReadSeekCloser: f,
+		Size:           info.Size(),
+		ModTime:        info.ModTime(),
+	}, nil
+}
+
+func (fsys FileStorage) List(prefix string) ([]string, error) {
+	p, err := fsys.path(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("list %v: %w", prefix, err)
+	}
+	entries, err := os.ReadDir(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("list %v: %w", prefix, err)
+	}
+	var keys []string
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".tmp-") {
+			continue
+		}
+		keys = append(keys, path.Join(prefix, entry.Name()))
+	}
+	return keys, nil
+}
+
+func (fsys FileStorage) Prefixes(prefix string) ([]string, error) {
+	p := fsys.Dir
+	if prefix != "" {
+		var err error
+		p, err = fsys.path(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("prefixes %v: %w", prefix, err)
+		}
+	}
+	entries, err := os.ReadDir(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("prefixes %v: %w", prefix, err)
+	}
+	var prefixes []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			prefixes = append(prefixes, path.Join(prefix, entry.Name()))
+		}
+	}
+	return prefixes, nil
+}
+
+func (fsys FileStorage) Remove(key string) error {
+	p, err := fsys.path(key)
+	if err != nil {
+		return fmt.Errorf("remove %v: %w", key, err)
+	}
+	err = os.Remove(p)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("remove %v: %w", key, err)
+	}
+	return nil
+}
+
+func (fsys FileStorage) RemoveAll(prefix string) error {
+	p, err := fsys.path(prefix)
+	if err != nil {
+		return fmt.Errorf("remove all %v: %w", prefix, err)
+	}
+	err = os.RemoveAll(p)
+	if err != nil {
+		return fmt.Errorf("remove all %v: %w", prefix, err)
+	}
+	return nil
+}
+
+// path turns a key into a file path inside Dir. Keys that would escape Dir
+// (eg "../../etc/passwd") are rejected.
+func (fsys FileStorage) path(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if cleaned == "/" || strings.Contains(key, "\\") || cleaned != "/"+key {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return filepath.Join(fsys.Dir, filepath.FromSlash(cleaned[1:])), nil
+}
@@ -0,0 +1,308 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultTrashRetention is how long deleted galleries and images stay in the
+// trash before they are purged, when no other retention is configured.
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+// TrashedGalleries returns the galleries in the trash of a user, most recently deleted first.
+func (service *GalleryService) TrashedGalleries(userID int) ([]Gallery, error) {
+	rows, err := service.DB.Query(`
+	SELECT id, title, visibility, deleted_at
+	FROM galleries
+	WHERE user_id = $1 AND deleted_at IS NOT NULL
+	ORDER BY deleted_at DESC;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("trashed galleries: %w", err)
+	}
+	defer rows.Close()
+
+	var galleries []Gallery
+	for rows.Next() {
+		gallery := Gallery{
+			UserID: userID,
+		}
+		err = rows.Scan(&gallery.ID, &gallery.Title, &gallery.Visibility, &gallery.DeletedAt)
+		if err != nil {
+			return nil, fmt.Errorf("trashed galleries: %w", err)
+		}
+		galleries = append(galleries, gallery)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("trashed galleries: %w", rows.Err())
+	}
+	return galleries, nil
+}
+
+// TrashedImages returns the images in the trash of a user, most recently
+// deleted first. Images of galleries that are in the trash themselves aren't
+// included, as they are restored or purged along with their gallery.
+func (service *GalleryService) TrashedImages(userID int) ([]Image, error) {
+	images, err := service.queryImages(`
+	JOIN galleries ON galleries.id = images.gallery_id
+	WHERE galleries.user_id = $1 AND galleries.deleted_at IS NULL AND images.deleted_at IS NOT NULL
+	ORDER BY images.deleted_at DESC;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("trashed images: %w", err)
+	}
+	return images, nil
+}
+
+// RestoreGallery takes a gallery of the user out of the trash. ErrNotFound is
+// returned if the user doesn't have such a gallery in their trash.
+func (service *GalleryService) RestoreGallery(userID, id int) error {
+	res, err := service.DB.Exec(`
+	UPDATE galleries
+	SET deleted_at = NULL
+	WHERE id = $1 AND user_id = $2 AND deleted_at IS NOT NULL;`, id, userID)
+	if err != nil {
+		return fmt.Errorf("restore gallery: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("restore gallery: %w", err)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RestoreImage takes an image of the user out of the trash and returns it. If
+// another image took its filename in the meantime, a " (n)" suffix is added.
+// ErrNotFound is returned if the user doesn't have such an image in their trash.
+func (service *GalleryService) RestoreImage(userID, imageID int) (Image, error) {
+	image, err := service.trashedImage(userID, imageID)
+	if err != nil {
+		return Image{}, fmt.Errorf("restore image: %w", err)
+	}
+
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return Image{}, fmt.Errorf("restore image: %w", err)
+	}
+	defer tx.Rollback()
+	image.Filename, err = freeFilename(tx, image.GalleryID, image.Filename)
+	if err != nil {
+		return Image{}, fmt.Errorf("restore image: %w", err)
+	}
+	_, err = tx.Exec(`
+	UPDATE images
+	SET filename = $2, deleted_at = NULL
+	WHERE id = $1;`, image.ID, image.Filename)
+	if err != nil {
+		return Image{}, fmt.Errorf("restore image: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return Image{}, fmt.Errorf("restore image: %w", err)
+	}
+	image.DeletedAt = nil
+	return image, nil
+}
+
+// PurgeGallery deletes a gallery in the trash of the user for good, along
+// with all of its images. ErrNotFound is returned if the user doesn't have
+// such a gallery in their trash.
+func (service *GalleryService) PurgeGallery(userID, id int) error {
+	var exists bool
+	row := service.DB.QueryRow(`
+	SELECT EXISTS (SELECT 1 FROM galleries WHERE id = $1 AND user_id = $2 AND deleted_at IS NOT NULL);`, id, userID)
+	err := row.Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("purge gallery: %w", err)
+	}
+	if !exists {
+		return ErrNotFound
+	}
+	return service.purgeGallery(id)
+}
+
+// Purge deletes any gallery for good, whether or not it is in the trash,
+// along with all of its images. ErrNotFound is returned if there is no such
+// gallery.
+func (service *GalleryService) Purge(id int) error {
+	var exists bool
+	row := service.DB.QueryRow(`
+	SELECT EXISTS (SELECT 1 FROM galleries WHERE id = $1);`, id)
+	err := row.Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("purge gallery: %w", err)
+	}
+	if !exists {
+		return ErrNotFound
+	}
+	return service.purgeGallery(id)
+}
+
+// PurgeImage deletes an image in the trash of the user for good. ErrNotFound
+// is returned if the user doesn't have such an image in their trash.
+func (service *GalleryService) PurgeImage(userID, imageID int) error {
+	image, err := service.trashedImage(userID, imageID)
+	if err != nil {
+		return fmt.Errorf("purge image: %w", err)
+	}
+	return service.purgeImage(image)
+}
+
+// PurgeTrash deletes every gallery and image that was moved to the trash
+// before the given time for good, and returns how many of them there were.
+func (service *GalleryService) PurgeTrash(before time.Time) (int, error) {
+	var galleryIDs []int
+	rows, err := service.DB.Query(`
+	SELECT id FROM galleries
+	WHERE deleted_at < $1;`, before)
+	if err != nil {
+		return 0, fmt.Errorf("purge trash: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			return 0, fmt.Errorf("purge trash: %w", err)
+		}
+		galleryIDs = append(galleryIDs, id)
+	}
+	if rows.Err() != nil {
+		return 0, fmt.Errorf("purge trash: %w", rows.Err())
+	}
+
+	purged := 0
+	for _, id := range galleryIDs {
+		err = service.purgeGallery(id)
+		if err != nil {
+			return purged, fmt.Errorf("purge trash: %w", err)
+		}
+		purged++
+	}
+
+	images, err := service.queryImages(`
+	WHERE images.deleted_at < $1;`, before)
+	if err != nil {
+		return purged, fmt.Errorf("purge trash: %w", err)
+	}
+	for _, image := range images {
+		err = service.purgeImage(image)
+		if err != nil {
+			return purged, fmt.Errorf("purge trash: %w", err)
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// PurgeUser deletes every gallery of a user for good, including the ones in
+// the trash, as well as their data exports and avatar, so that the user can
+// be deleted.
+func (service *GalleryService) PurgeUser(userID int) error {
+	rows, err := service.DB.Query(`
+	SELECT id FROM galleries
+	WHERE user_id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("purge user: %w", err)
+	}
+	defer rows.Close()
+	var galleryIDs []int
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			return fmt.Errorf("purge user: %w", err)
+		}
+		galleryIDs = append(galleryIDs, id)
+	}
+	if rows.Err() != nil {
+		return fmt.Errorf("purge user: %w", rows.Err())
+	}
+
+	for _, id := range galleryIDs {
+		err = service.purgeGallery(id)
+		if err != nil {
+			return fmt.Errorf("purge user: %w", err)
+		}
+	}
+
+	// the rows of the data exports and the avatar key go away with the user
+	var deletionIDs []int
+	for _, prefix := range []string{exportsPrefix(userID), avatarsPrefix(userID)} {
+		id, err := enqueueDeletion(service.DB, deleteTree, prefix)
+		if err != nil {
+			return fmt.Errorf("purge user: %w", err)
+		}
+		deletionIDs = append(deletionIDs, id)
+	}
+	service.runDeletions(deletionIDs)
+	return nil
+}
+
+// trashedImage returns an image in the trash of the user, or ErrNotFound
+func (service *GalleryService) trashedImage(userID, imageID int) (Image, error) {
+	images, err := service.queryImages(`
+	JOIN galleries ON galleries.id = images.gallery_id
+	WHERE images.id = $1 AND galleries.user_id = $2 AND galleries.deleted_at IS NULL
+		AND images.deleted_at IS NOT NULL;`, imageID, userID)
+	if err != nil {
+		return Image{}, err
+	}
+	if len(images) == 0 {
+		return Image{}, ErrNotFound
+	}
+	return images[0], nil
+}
+
+// purgeGallery deletes a gallery and its images for good. The files are
+// removed once the rows are gone, see deletion.go.
+func (service *GalleryService) purgeGallery(id int) error {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("purge gallery: %w", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+	DELETE FROM galleries
+	WHERE id = $1;`, id)
+	if err != nil {
+		return fmt.Errorf("purge gallery: %w", err)
+	}
+	deletionID, err := enqueueDeletion(tx, deleteTree, galleryPrefix(id))
+	if err != nil {
+		return fmt.Errorf("purge gallery: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("purge gallery: %w", err)
+	}
+	service.runDeletions([]int{deletionID})
+	return nil
+}
+
+// purgeImage deletes an image for good. The file and renditions are removed
+// once the row is gone, see deletion.go.
+func (service *GalleryService) purgeImage(image Image) error {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("purge image: %w", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+	DELETE FROM images
+	WHERE id = $1;`, image.ID)
+	if err != nil {
+		return fmt.Errorf("purge image: %w", err)
+	}
+	deletionIDs, err := enqueueImageDeletion(tx, image)
+	if err != nil {
+		return fmt.Errorf("purge image: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("purge image: %w", err)
+	}
+	service.runDeletions(deletionIDs)
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgerrcode"
@@ -15,14 +16,41 @@ type User struct {
 	ID           int
 	Email        string
 	PasswordHash string
+	// IsAdmin users can manage the accounts of other users in the admin area
+	IsAdmin bool
+	// ImpersonatorID is the admin that is signed in as the user, if any. It is
+	// only set for users that are looked up by their session.
+	ImpersonatorID int
 }
 
+// HasPassword reports whether the user can sign in with a password. Users
+// that signed up with an identity provider don't have one until they set it,
+// and neither do users whose password was removed by an admin.
+func (user User) HasPassword() bool {
+	return user.PasswordHash != ""
+}
+
+const (
+	// DefaultDeletionGracePeriod is how long an account is kept after its
+	// user asked for it to be deleted, so that they can change their mind.
+	DefaultDeletionGracePeriod = 14 * 24 * time.Hour
+)
+
 type UserService struct {
 	DB *sql.DB
+	// DeletionGracePeriod is how long an account is kept after its user asked
+	// for it to be deleted. Defaults to DefaultDeletionGracePeriod
+	DeletionGracePeriod time.Duration
 }
 
 // Create() creates a new user in the database
 func (us *UserService) Create(email, password string) (*User, error) {
+	return createUser(us.DB, email, password)
+}
+
+// createUser inserts the user with q, so that users can also be created as
+// part of a transaction.
+func createUser(q queryRower, email, password string) (*User, error) {
 	// Postgres is case-sensitive
 	email = strings.ToLower(email)
 
@@ -39,7 +67,7 @@ func (us *UserService) Create(email, password string) (*User, error) {
 		PasswordHash: passwordHash,
 	}
 
-	row := us.DB.QueryRow(`
+	row := q.QueryRow(`
 	INSERT INTO users (email, password_hash)
 	VALUES ($1, $2) RETURNING id`, user.Email, user.PasswordHash)
 
@@ -72,11 +100,12 @@ func (us *UserService) Authenticate(email, password string) (*User, error) {
 		Email: email,
 	}
 
+	var suspendedAt *time.Time
 	row := us.DB.QueryRow(`
-	SELECT id, password_hash
+	SELECT id, password_hash, is_admin, suspended_at
 	FROM users WHERE email=$1`, email)
 
-	err := row.Scan(&user.ID, &user.PasswordHash)
+	err := row.Scan(&user.ID, &user.PasswordHash, &user.IsAdmin, &suspendedAt)
 	if err != nil {
 		return nil, fmt.Errorf("authenticate: %w", err)
 	}
@@ -86,10 +115,63 @@ func (us *UserService) Authenticate(email, password string) (*User, error) {
 	if err != nil {
 		return nil, fmt.Errorf("authenticate: %w", err)
 	}
+	// only tell users that know the password that the account is suspended
+	if suspendedAt != nil {
+		return nil, ErrAccountSuspended
+	}
+
+	return &user, nil
+}
 
+// ByID returns the user with the given id, or ErrNotFound if there is none.
+func (us *UserService) ByID(id int) (*User, error) {
+	user := User{
+		ID: id,
+	}
+	row := us.DB.QueryRow(`
+	SELECT email, password_hash
+	FROM users WHERE id = $1;`, id)
+	err := row.Scan(&user.Email, &user.PasswordHash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("user by id: %w", err)
+	}
 	return &user, nil
 }
 
+// ByEmail returns the user with the given email address, or ErrNotFound if
+// there is none.
+func (us *UserService) ByEmail(email string) (*User, error) {
+	user := User{
+		Email: strings.ToLower(email),
+	}
+	row := us.DB.QueryRow(`
+	SELECT id, password_hash, is_admin
+	FROM users WHERE email = $1;`, user.Email)
+	err := row.Scan(&user.ID, &user.PasswordHash, &user.IsAdmin)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("user by email: %w", err)
+	}
+	return &user, nil
+}
+
+// SetAdmin gives the user access to the admin area, or takes it away.
+func (us *UserService) SetAdmin(userID int, isAdmin bool) error {
+	_, err := us.DB.Exec(`
+	UPDATE users
+	SET is_admin = $2
+	WHERE id = $1;`, userID, isAdmin)
+	if err != nil {
+		return fmt.Errorf("set admin: %w", err)
+	}
+	return nil
+}
+
 func (us *UserService) UpdatePassword(userID int, password string) error {
 	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -106,3 +188,103 @@ func (us *UserService) UpdatePassword(userID int, password string) error {
 	}
 	return nil
 }
+
+// UpdateEmail changes the email address of a user. ErrEmailTaken is returned
+// if another user already has the address.
+func (us *UserService) UpdateEmail(userID int, email string) error {
+	email = strings.ToLower(email)
+	_, err := us.DB.Exec(`
+	UPDATE users
+	SET email = $2
+	WHERE id = $1;`, userID, email)
+	if err != nil {
+		var pgError *pgconn.PgError
+		if errors.As(err, &pgError) && pgError.Code == pgerrcode.UniqueViolation {
+			return ErrEmailTaken
+		}
+		return fmt.Errorf("update email: %w", err)
+	}
+	return nil
+}
+
+// ScheduleDeletion marks the account of a user to be deleted once the grace
+// period is over, and returns when that is.
+func (us *UserService) ScheduleDeletion(userID int) (time.Time, error) {
+	grace := us.DeletionGracePeriod
+	if grace == 0 {
+		grace = DefaultDeletionGracePeriod
+	}
+	deleteAt := time.Now().Add(grace)
+	_, err := us.DB.Exec(`
+	UPDATE users
+	SET delete_at = $2
+	WHERE id = $1;`, userID, deleteAt)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("schedule deletion: %w", err)
+	}
+	return deleteAt, nil
+}
+
+// CancelDeletion keeps the account of a user that was scheduled to be deleted.
+func (us *UserService) CancelDeletion(userID int) error {
+	_, err := us.DB.Exec(`
+	UPDATE users
+	SET delete_at = NULL
+	WHERE id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("cancel deletion: %w", err)
+	}
+	return nil
+}
+
+// ScheduledDeletion returns when the account of a user will be deleted, or
+// nil if it isn't scheduled to be.
+func (us *UserService) ScheduledDeletion(userID int) (*time.Time, error) {
+	var deleteAt *time.Time
+	row := us.DB.QueryRow(`
+	SELECT delete_at FROM users WHERE id = $1;`, userID)
+	err := row.Scan(&deleteAt)
+	if err != nil {
+		return nil, fmt.Errorf("scheduled deletion: %w", err)
+	}
+	return deleteAt, nil
+}
+
+// DueForDeletion returns the users whose accounts were scheduled to be
+// deleted before the given time.
+func (us *UserService) DueForDeletion(before time.Time) ([]User, error) {
+	rows, err := us.DB.Query(`
+	SELECT id, email, password_hash
+	FROM users
+	WHERE delete_at < $1;`, before)
+	if err != nil {
+		return nil, fmt.Errorf("due for deletion: %w", err)
+	}
+	defer rows.Close()
+	var users []User
+	for rows.Next() {
+		var user User
+		err = rows.Scan(&user.ID, &user.Email, &user.PasswordHash)
+		if err != nil {
+			return nil, fmt.Errorf("due for deletion: %w", err)
+		}
+		users = append(users, user)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("due for deletion: %w", rows.Err())
+	}
+	return users, nil
+}
+
+// Delete removes a user along with their sessions and tokens. Their galleries
+// have to be purged with GalleryService.PurgeUser first, as the files of the
+// images would otherwise be left behind.
+func (us *UserService) Delete(userID int) error {
+	_, err := us.DB.Exec(`
+	DELETE FROM users
+	WHERE id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("delete user: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,329 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"path"
+	"time"
+
+	"github.com/ayushthe1/lenspix/rand"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// WatermarkPosition is where a watermark is placed on an image
+type WatermarkPosition string
+
+const (
+	WatermarkCenter      WatermarkPosition = "center"
+	WatermarkTopLeft     WatermarkPosition = "top-left"
+	WatermarkTopRight    WatermarkPosition = "top-right"
+	WatermarkBottomLeft  WatermarkPosition = "bottom-left"
+	WatermarkBottomRight WatermarkPosition = "bottom-right"
+	// WatermarkTiled repeats the watermark over the whole image
+	WatermarkTiled WatermarkPosition = "tiled"
+)
+
+// WatermarkPositions lists every valid WatermarkPosition.
+var WatermarkPositions = []WatermarkPosition{
+	WatermarkCenter, WatermarkTopLeft, WatermarkTopRight,
+	WatermarkBottomLeft, WatermarkBottomRight, WatermarkTiled,
+}
+
+// ParseWatermarkPosition converts s into a WatermarkPosition, returning an error if it isn't a valid one.
+func ParseWatermarkPosition(s string) (WatermarkPosition, error) {
+	for _, p := range WatermarkPositions {
+		if string(p) == s {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("invalid watermark position: %q", s)
+}
+
+// Watermark is the watermark that is drawn over the images of a gallery when
+// they are viewed by anyone but the owner. It is either Text or a PNG logo.
+type Watermark struct {
+	GalleryID int
+	Text      string
+	// LogoKey is where the logo lives in the GalleryService's Storage. A logo
+	// is used instead of Text when it is set.
+	LogoKey  string
+	Position WatermarkPosition
+	// Opacity between 0 (invisible) and 1 (opaque)
+	Opacity float64
+	// Scale is the width of the watermark as a fraction of the image width
+	Scale     float64
+	UpdatedAt time.Time
+}
+
+// fingerprint changes whenever a setting that affects the rendered watermark changes
+func (wm Watermark) fingerprint() string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%q|%q|%v|%v|%v", wm.Text, wm.LogoKey, wm.Position, wm.Opacity, wm.Scale)))
+	return hex.EncodeToString(h[:8])
+}
+
+// Watermark returns the watermark of a gallery, or ErrNotFound if it doesn't have one.
+func (service *GalleryService) Watermark(galleryID int) (*Watermark, error) {
+	wm := Watermark{
+		GalleryID: galleryID,
+	}
+	row := service.DB.QueryRow(`
+	SELECT text, logo_key, position, opacity, scale, updated_at
+	FROM gallery_watermarks
+	WHERE gallery_id = $1;`, galleryID)
+	err := row.Scan(&wm.Text, &wm.LogoKey, &wm.Position, &wm.Opacity, &wm.Scale, &wm.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query watermark: %w", err)
+	}
+	return &wm, nil
+}
+
+// WatermarkError is returned when the settings of a watermark aren't valid.
+type WatermarkError struct {
+	Issue string
+}
+
+func (we WatermarkError) Error() string {
+	return fmt.Sprintf("invalid watermark: %v", we.Issue)
+}
+
+// SetWatermark creates or updates the watermark of a gallery. The old logo
+// and the renditions with the old watermark are removed once the new one is
+// saved, see deletion.go.
+func (service *GalleryService) SetWatermark(wm *Watermark) error {
+	if wm.Text == "" && wm.LogoKey == "" {
+		return fmt.Errorf("set watermark: %w", WatermarkError{Issue: "either a text or a logo is required"})
+	}
+	// the font only has glyphs for printable ASCII, anything else would be drawn as a box
+	for _, r := range wm.Text {
+		if r < ' ' || r > '~' {
+			return fmt.Errorf("set watermark: %w", WatermarkError{Issue: "the text can only contain letters, digits and punctuation without accents"})
+		}
+	}
+	if wm.Opacity < 0 || wm.Opacity > 1 {
+		return fmt.Errorf("set watermark: invalid opacity %v", wm.Opacity)
+	}
+	if wm.Scale <= 0 || wm.Scale > 1 {
+		return fmt.Errorf("set watermark: invalid scale %v", wm.Scale)
+	}
+
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("set watermark: %w", err)
+	}
+	defer tx.Rollback()
+
+	var oldLogoKey sql.NullString
+	row := tx.QueryRow(`
+	SELECT logo_key FROM gallery_watermarks WHERE gallery_id = $1
+	FOR UPDATE;`, wm.GalleryID)
+	err = row.Scan(&oldLogoKey)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("set watermark: %w", err)
+	}
+
+	row = tx.QueryRow(`
+	INSERT INTO gallery_watermarks (gallery_id, text, logo_key, position, opacity, scale)
+	VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (gallery_id) DO
+	UPDATE
+	SET text = $2, logo_key = $3, position = $4, opacity = $5, scale = $6, updated_at = now()
+	RETURNING updated_at;`, wm.GalleryID, wm.Text, wm.LogoKey, wm.Position, wm.Opacity, wm.Scale)
+	err = row.Scan(&wm.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("set watermark: %w", err)
+	}
+
+	var deletionIDs []int
+	// the old logo isn't used anymore
+	if oldLogoKey.Valid && oldLogoKey.String != "" && oldLogoKey.String != wm.LogoKey {
+		id, err := enqueueDeletion(tx, deleteObject, oldLogoKey.String)
+		if err != nil {
+			return fmt.Errorf("set watermark: %w", err)
+		}
+		deletionIDs = append(deletionIDs, id)
+	}
+	// renditions with the old watermark won't be served again
+	id, err := enqueueDeletion(tx, deleteTree, renditionsPrefix(wm.GalleryID))
+	if err != nil {
+		return fmt.Errorf("set watermark: %w", err)
+	}
+	deletionIDs = append(deletionIDs, id)
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("set watermark: %w", err)
+	}
+	service.runDeletions(deletionIDs)
+	return nil
+}
+
+// CreateWatermarkLogo stores a PNG logo for the watermark of a gallery and
+// returns its storage key, to be used as the LogoKey of the Watermark.
+func (service *GalleryService) CreateWatermarkLogo(galleryID int, contents io.ReadSeeker) (string, error) {
+	_, err := checkContentType(contents, []string{"image/png"})
+	if err != nil {
+		return "", fmt.Errorf("create watermark logo: %w", err)
+	}
+	_, err = checkImage(contents, service.ImageLimits)
+	if err != nil {
+		return "", fmt.Errorf("create watermark logo: %w", err)
+	}
+
+	b, err := rand.Bytes(16)
+	if err != nil {
+		return "", fmt.Errorf("create watermark logo: %w", err)
+	}
+	key := path.Join(galleryPrefix(galleryID), "watermark", hex.EncodeToString(b)+".png")
+	err = service.storage().Create(key, contents)
+	if err != nil {
+		return "", fmt.Errorf("create watermark logo: %w", err)
+	}
+	return key, nil
+}
+
+// DeleteWatermark removes the watermark of a gallery, along with its logo.
+// The files are removed once the row is gone, see deletion.go.
+func (service *GalleryService) DeleteWatermark(galleryID int) error {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("delete watermark: %w", err)
+	}
+	defer tx.Rollback()
+
+	var logoKey string
+	row := tx.QueryRow(`
+	DELETE FROM gallery_watermarks
+	WHERE gallery_id = $1
+	RETURNING logo_key;`, galleryID)
+	err = row.Scan(&logoKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("delete watermark: %w", err)
+	}
+
+	var deletionIDs []int
+	if logoKey != "" {
+		id, err := enqueueDeletion(tx, deleteObject, logoKey)
+		if err != nil {
+			return fmt.Errorf("delete watermark: %w", err)
+		}
+		deletionIDs = append(deletionIDs, id)
+	}
+	id, err := enqueueDeletion(tx, deleteTree, renditionsPrefix(galleryID))
+	if err != nil {
+		return fmt.Errorf("delete watermark: %w", err)
+	}
+	deletionIDs = append(deletionIDs, id)
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("delete watermark: %w", err)
+	}
+	service.runDeletions(deletionIDs)
+	return nil
+}
+
+// watermarkImage renders the text or logo of wm at its natural size
+func (service *GalleryService) watermarkImage(wm Watermark) (image.Image, error) {
+	if wm.LogoKey != "" {
+		obj, err := service.storage().Open(wm.LogoKey)
+		if err != nil {
+			return nil, fmt.Errorf("watermark logo: %w", err)
+		}
+		defer obj.Close()
+		logo, _, err := image.Decode(obj)
+		if err != nil {
+			return nil, fmt.Errorf("watermark logo: %w", err)
+		}
+		return logo, nil
+	}
+	return textImage(wm.Text), nil
+}
+
+// textImage draws text in white with a dark outline, so that it can be read
+// on both light and dark photos. The text must be printable ASCII, which is
+// all that the font has glyphs for.
+func textImage(text string) image.Image {
+	face := basicfont.Face7x13
+	const padding = 2
+	width := font.MeasureString(face, text).Ceil() + 2*padding
+	height := face.Metrics().Height.Ceil() + 2*padding
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	d := font.Drawer{Dst: img, Face: face}
+	baseline := padding + face.Metrics().Ascent.Ceil()
+	// the outline is the text drawn shifted in every direction
+	d.Src = image.NewUniform(color.NRGBA{A: 160})
+	for _, offset := range []image.Point{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+		d.Dot = fixed.P(padding+offset.X, baseline+offset.Y)
+		d.DrawString(text)
+	}
+	d.Src = image.White
+	d.Dot = fixed.P(padding, baseline)
+	d.DrawString(text)
+	return img
+}
+
+// applyWatermark draws mark over img as configured by wm and returns the result.
+func applyWatermark(img image.Image, mark image.Image, wm Watermark) *image.NRGBA {
+	bounds := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+
+	// scale the mark to the configured fraction of the image width, keeping its aspect ratio
+	markBounds := mark.Bounds()
+	width := int(float64(dst.Bounds().Dx()) * wm.Scale)
+	height := width * markBounds.Dy() / markBounds.Dx()
+	if width < 1 || height < 1 {
+		return dst
+	}
+	scaled := image.NewNRGBA(image.Rect(0, 0, width, height))
+	xdraw.CatmullRom.Scale(scaled, scaled.Bounds(), mark, markBounds, xdraw.Src, nil)
+
+	opacity := image.NewUniform(color.Alpha{A: uint8(wm.Opacity * 255)})
+	margin := dst.Bounds().Dx() / 50
+	var positions []image.Point
+	switch wm.Position {
+	case WatermarkTopLeft:
+		positions = []image.Point{{margin, margin}}
+	case WatermarkTopRight:
+		positions = []image.Point{{dst.Bounds().Dx() - width - margin, margin}}
+	case WatermarkBottomLeft:
+		positions = []image.Point{{margin, dst.Bounds().Dy() - height - margin}}
+	case WatermarkBottomRight:
+		positions = []image.Point{{dst.Bounds().Dx() - width - margin, dst.Bounds().Dy() - height - margin}}
+	case WatermarkTiled:
+		for y := 0; y < dst.Bounds().Dy(); y += height * 2 {
+			// shift every other row so that the tiles don't line up in columns
+			shift := 0
+			if (y/(height*2))%2 == 1 {
+				shift = width
+			}
+			for x := -shift; x < dst.Bounds().Dx(); x += width * 2 {
+				positions = append(positions, image.Point{x, y})
+			}
+		}
+	default:
+		positions = []image.Point{{(dst.Bounds().Dx() - width) / 2, (dst.Bounds().Dy() - height) / 2}}
+	}
+
+	for _, p := range positions {
+		r := image.Rectangle{Min: p, Max: p.Add(image.Point{width, height})}
+		draw.DrawMask(dst, r, scaled, image.Point{}, opacity, image.Point{}, draw.Over)
+	}
+	return dst
+}
@@ -0,0 +1,13 @@
+package oidc
+
+import "time"
+
+// SetMinKeysRefresh changes how long providers wait before fetching their
+// keys again, and returns a function that changes it back.
+func SetMinKeysRefresh(d time.Duration) func() {
+	old := minKeysRefresh
+	minKeysRefresh = d
+	return func() {
+		minKeysRefresh = old
+	}
+}
@@ -0,0 +1,233 @@
+// Package oidc signs users in with OpenID Connect providers, using the
+// authorization code flow with PKCE. Providers are configured by their issuer,
+// everything else is found through discovery.
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ayushthe1/lenspix/rand"
+)
+
+// Provider is an OpenID Connect provider that users can sign in with.
+type Provider struct {
+	// ID names the provider in URLs, like "studio" in /oauth/studio/signin
+	ID string
+	// Name is shown to users, like "Sign in with Name"
+	Name string
+	// Issuer is the issuer identifier of the provider, eg
+	// "https://accounts.example.com". Its discovery document lives at
+	// Issuer + "/.well-known/openid-configuration".
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is where the provider sends users back to after they signed in
+	RedirectURL string
+	// Scopes are requested along with "openid". Defaults to email and profile.
+	Scopes []string
+	// HTTPClient is used to talk to the provider. Defaults to a client with a
+	// 10 second timeout.
+	HTTPClient *http.Client
+
+	mu       sync.Mutex
+	metadata *metadata
+	keys     map[string]interface{}
+	// keysFetchedAt limits how often unknown key ids make us fetch the keys again
+	keysFetchedAt time.Time
+}
+
+// metadata is the part of the discovery document that we use
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Claims are the claims of a verified ID token that identify the user.
+type Claims struct {
+	// Subject identifies the user at the provider. Unlike the email address
+	// it never changes, so identities are linked through it.
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// AuthFlow holds the secrets of a sign in that is in progress. They have to
+// be kept by the client, usually in a cookie, until the provider sends the
+// user back.
+type AuthFlow struct {
+	State string
+	Nonce string
+	// Verifier is the PKCE code verifier, which proves to the token endpoint
+	// that the code is exchanged by whoever started the flow.
+	Verifier string
+}
+
+// NewAuthFlow creates the random secrets for a new sign in.
+func NewAuthFlow() (AuthFlow, error) {
+	var flow AuthFlow
+	for _, s := range []*string{&flow.State, &flow.Nonce, &flow.Verifier} {
+		b, err := rand.Bytes(32)
+		if err != nil {
+			return AuthFlow{}, fmt.Errorf("new auth flow: %w", err)
+		}
+		// PKCE verifiers mustn't be padded
+		*s = base64.RawURLEncoding.EncodeToString(b)
+	}
+	return flow, nil
+}
+
+// Challenge returns the S256 PKCE code challenge of a code verifier.
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns the URL of the provider that a user is sent to in
+// order to sign in.
+func (p *Provider) AuthCodeURL(ctx context.Context, flow AuthFlow) (string, error) {
+	md, err := p.discover(ctx)
+	if err != nil {
+		return "", fmt.Errorf("auth code url: %w", err)
+	}
+	scopes := p.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"email", "profile"}
+	}
+	vals := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {strings.Join(append([]string{"openid"}, scopes...), " ")},
+		"state":                 {flow.State},
+		"nonce":                 {flow.Nonce},
+		"code_challenge":        {Challenge(flow.Verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(md.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return md.AuthorizationEndpoint + sep + vals.Encode(), nil
+}
+
+// Exchange trades the code that the provider sent the user back with for an
+// ID token, and returns its claims once it has been verified. flow has to be
+// the one that the sign in was started with.
+func (p *Provider) Exchange(ctx context.Context, code string, flow AuthFlow) (*Claims, error) {
+	md, err := p.discover(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("exchange: %w", err)
+	}
+	vals := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"code_verifier": {flow.Verifier},
+		"client_id":     {p.ClientID},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, md.TokenEndpoint, strings.NewReader(vals.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("exchange: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		// client_secret_basic, which every provider has to support
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("exchange: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token)
+	if err != nil {
+		return nil, fmt.Errorf("exchange: decoding token response: %w", err)
+	}
+	if token.Error != "" {
+		if token.ErrorDescription != "" {
+			return nil, fmt.Errorf("exchange: %s: %s", token.Error, token.ErrorDescription)
+		}
+		return nil, fmt.Errorf("exchange: %s", token.Error)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("exchange: token endpoint returned %v", resp.Status)
+	}
+	if token.IDToken == "" {
+		return nil, fmt.Errorf("exchange: no id token in token response")
+	}
+
+	claims, err := p.verify(ctx, token.IDToken, flow.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("exchange: %w", err)
+	}
+	return claims, nil
+}
+
+// discover fetches the discovery document of the provider, once
+func (p *Provider) discover(ctx context.Context) (*metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	var md metadata
+	err := p.getJSON(ctx, strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", &md)
+	if err != nil {
+		return nil, fmt.Errorf("discover: %w", err)
+	}
+	// the issuer has to match exactly, or a provider could speak for another one
+	if md.Issuer != p.Issuer {
+		return nil, fmt.Errorf("discover: issuer %q doesn't match %q", md.Issuer, p.Issuer)
+	}
+	if md.AuthorizationEndpoint == "" || md.TokenEndpoint == "" || md.JWKSURI == "" {
+		return nil, fmt.Errorf("discover: incomplete discovery document")
+	}
+	p.metadata = &md
+	return p.metadata, nil
+}
+
+// getJSON fetches a JSON document from the provider and decodes it into v
+func (p *Provider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %v: %v", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+func (p *Provider) client() *http.Client {
+	if p.HTTPClient != nil {
+		return p.HTTPClient
+	}
+	return &http.Client{Timeout: 10 * time.Second}
+}
@@ -0,0 +1,304 @@
+package oidc_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ayushthe1/lenspix/oidc"
+	"github.com/ayushthe1/lenspix/oidc/oidctest"
+)
+
+const redirectURL = "https://lenspix.test/oauth/test/callback"
+
+func newServer(t *testing.T) (*oidctest.Server, *oidc.Provider) {
+	t.Helper()
+	server, err := oidctest.NewServer("lenspix", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	return server, server.Provider("test", redirectURL)
+}
+
+func newFlow(t *testing.T) oidc.AuthFlow {
+	t.Helper()
+	flow, err := oidc.NewAuthFlow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return flow
+}
+
+// authorize signs in at the authorization endpoint of the server and returns
+// the code that it sends the user back with
+func authorize(t *testing.T, server *oidctest.Server, provider *oidc.Provider, flow oidc.AuthFlow) string {
+	t.Helper()
+	authURL, err := provider.AuthCodeURL(context.Background(), flow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := *server.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: status %v, want %v", resp.StatusCode, http.StatusFound)
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(location.String(), redirectURL+"?") {
+		t.Fatalf("authorize: redirected to %v, want %v", location, redirectURL)
+	}
+	if got := location.Query().Get("state"); got != flow.State {
+		t.Fatalf("authorize: state %q, want %q", got, flow.State)
+	}
+	return location.Query().Get("code")
+}
+
+// signIn goes through the whole flow and returns the claims of the ID token
+func signIn(t *testing.T, server *oidctest.Server, provider *oidc.Provider) (*oidc.Claims, error) {
+	t.Helper()
+	flow := newFlow(t)
+	code := authorize(t, server, provider, flow)
+	return provider.Exchange(context.Background(), code, flow)
+}
+
+// wantError fails the test unless err mentions want
+func wantError(t *testing.T, err error, want string) {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("got no error, want one about %q", want)
+	}
+	if !strings.Contains(err.Error(), want) {
+		t.Fatalf("got error %q, want one about %q", err, want)
+	}
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	server, provider := newServer(t)
+	flow := newFlow(t)
+	authURL, err := provider.AuthCodeURL(context.Background(), flow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.Scheme + "://" + u.Host + u.Path; got != server.URL+"/authorize" {
+		t.Errorf("authorization endpoint %v, want %v", got, server.URL+"/authorize")
+	}
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             "lenspix",
+		"redirect_uri":          redirectURL,
+		"scope":                 "openid email profile",
+		"state":                 flow.State,
+		"nonce":                 flow.Nonce,
+		"code_challenge":        oidc.Challenge(flow.Verifier),
+		"code_challenge_method": "S256",
+	}
+	for name, value := range want {
+		if got := u.Query().Get(name); got != value {
+			t.Errorf("%v = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	_, provider := newServer(t)
+	// the discovery document names the issuer without the slash
+	provider.Issuer += "/"
+	_, err := provider.AuthCodeURL(context.Background(), newFlow(t))
+	wantError(t, err, "doesn't match")
+}
+
+func TestChallenge(t *testing.T) {
+	// from appendix B of RFC 7636
+	got := oidc.Challenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	want := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	if got != want {
+		t.Errorf("Challenge = %q, want %q", got, want)
+	}
+}
+
+func TestExchange(t *testing.T) {
+	server, provider := newServer(t)
+	server.User.Email = "Jane@Example.com"
+	claims, err := signIn(t, server, provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := oidc.Claims{
+		Subject:       server.User.Subject,
+		Email:         "jane@example.com",
+		EmailVerified: true,
+		Name:          server.User.Name,
+	}
+	if *claims != want {
+		t.Errorf("claims %+v, want %+v", *claims, want)
+	}
+}
+
+func TestExchangeVerifierMismatch(t *testing.T) {
+	server, provider := newServer(t)
+	flow := newFlow(t)
+	code := authorize(t, server, provider, flow)
+	other := flow
+	other.Verifier = newFlow(t).Verifier
+	_, err := provider.Exchange(context.Background(), code, other)
+	wantError(t, err, "invalid_grant")
+
+	// the code is used up even though the exchange failed
+	_, err = provider.Exchange(context.Background(), code, flow)
+	wantError(t, err, "invalid_grant")
+}
+
+func TestExchangeNonceMismatch(t *testing.T) {
+	server, provider := newServer(t)
+	flow := newFlow(t)
+	code := authorize(t, server, provider, flow)
+	other := flow
+	other.Nonce = newFlow(t).Nonce
+	_, err := provider.Exchange(context.Background(), code, other)
+	wantError(t, err, "nonce doesn't match")
+}
+
+func TestExchangeClaims(t *testing.T) {
+	now := time.Now()
+	tests := map[string]struct {
+		claims map[string]interface{}
+		// want is what the error is about, or empty if there shouldn't be one
+		want string
+	}{
+		"other issuer": {
+			claims: map[string]interface{}{"iss": "https://evil.example.com"},
+			want:   "issued by",
+		},
+		"other audience": {
+			claims: map[string]interface{}{"aud": "someone-else"},
+			want:   "not issued for this client",
+		},
+		"several audiences without azp": {
+			claims: map[string]interface{}{"aud": []string{"someone-else", "lenspix"}},
+			want:   "authorized party",
+		},
+		"several audiences with other azp": {
+			claims: map[string]interface{}{"aud": []string{"someone-else", "lenspix"}, "azp": "someone-else"},
+			want:   "authorized party",
+		},
+		"several audiences with our azp": {
+			claims: map[string]interface{}{"aud": []string{"someone-else", "lenspix"}, "azp": "lenspix"},
+		},
+		"expired": {
+			claims: map[string]interface{}{"exp": now.Add(-time.Hour).Unix(), "iat": now.Add(-2 * time.Hour).Unix()},
+			want:   "expired",
+		},
+		"expired within the clock skew": {
+			claims: map[string]interface{}{"exp": now.Add(-time.Minute).Unix()},
+		},
+		"issued in the future": {
+			claims: map[string]interface{}{"iat": now.Add(time.Hour).Unix()},
+			want:   "issued in the future",
+		},
+		"no subject": {
+			claims: map[string]interface{}{"sub": ""},
+			want:   "no subject",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			server, provider := newServer(t)
+			server.IssueIDToken = func(claims map[string]interface{}) (string, error) {
+				for k, v := range tc.claims {
+					claims[k] = v
+				}
+				return server.IDToken(claims)
+			}
+			_, err := signIn(t, server, provider)
+			if tc.want == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			wantError(t, err, tc.want)
+		})
+	}
+}
+
+// encodeToken encodes an ID token with the given header, signed with sign
+func encodeToken(t *testing.T, header, claims map[string]interface{}, sign func(signed string) []byte) string {
+	t.Helper()
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign(signed))
+}
+
+func TestExchangeAlgorithms(t *testing.T) {
+	tests := map[string]func(signed string) []byte{
+		"none": func(signed string) []byte {
+			return nil
+		},
+		// signed with the client secret, which the provider and we both know
+		"HS256": func(signed string) []byte {
+			mac := hmac.New(sha256.New, []byte("secret"))
+			mac.Write([]byte(signed))
+			return mac.Sum(nil)
+		},
+	}
+	for alg, sign := range tests {
+		t.Run(alg, func(t *testing.T) {
+			server, provider := newServer(t)
+			server.IssueIDToken = func(claims map[string]interface{}) (string, error) {
+				return encodeToken(t, map[string]interface{}{"alg": alg, "typ": "JWT"}, claims, sign), nil
+			}
+			_, err := signIn(t, server, provider)
+			wantError(t, err, "unsupported algorithm")
+		})
+	}
+}
+
+func TestExchangeKeyRotation(t *testing.T) {
+	server, provider := newServer(t)
+	_, err := signIn(t, server, provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = server.RotateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the keys were fetched a moment ago, so they aren't fetched again yet
+	_, err = signIn(t, server, provider)
+	wantError(t, err, "unknown key")
+
+	defer oidc.SetMinKeysRefresh(0)()
+	_, err = signIn(t, server, provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+}